@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/agent"
+	"github.com/operator-framework/operator-sdk/pkg/log/zap"
+	"github.com/spf13/pflag"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// agentCommand is the first argument that runs the operator binary as the agent sidecar of shell pods
+const agentCommand = "agent"
+
+// runAgent runs the agent sidecar with the given command-line arguments
+func runAgent(args []string) {
+	flags := pflag.NewFlagSet(agentCommand, pflag.ExitOnError)
+	flags.AddFlagSet(zap.FlagSet())
+	opts := agent.Options{}
+	flags.StringVar(&opts.ListenAddress, "listen", ":4445", "address to serve the agent endpoints on")
+	flags.StringVar(&opts.SessionsDir, "sessions-dir", "", "directory shared with the shell container for terminal sessions; empty disables sessions")
+	flags.IntVar(&opts.MaxSessions, "max-sessions", 5, "maximum number of concurrent terminal sessions")
+	flags.IntVar(&opts.Scrollback, "scrollback", 10000, "lines of history kept for each terminal session")
+	flags.StringVar(&opts.ProxyAddress, "proxy-listen", "", "address of the terminal proxy for machine-exec; empty disables the proxy")
+	flags.StringVar(&opts.ProxyUpstream, "proxy-upstream", "http://127.0.0.1:4444", "URL of machine-exec")
+	flags.StringVar(&opts.Sink, "sink", "", "where the terminal proxy stores recordings: stdout, pvc or s3; empty disables recording")
+	flags.StringVar(&opts.RecordingsDir, "recordings-dir", "/var/run/cloudshell/recordings", "directory recordings are written to (pvc) or buffered in (s3)")
+	flags.StringVar(&opts.HomeDir, "home-dir", "", "the shell's home directory, to which dotfiles set by the operator are written; empty refuses dotfiles")
+	_ = flags.Parse(args)
+	// The token and S3 settings are read from the environment, so that they can be taken from a Secret
+	opts.Token = os.Getenv("CLOUDSHELL_AGENT_TOKEN")
+	opts.S3 = agent.S3Options{
+		Endpoint:       os.Getenv("CLOUDSHELL_S3_ENDPOINT"),
+		Bucket:         os.Getenv("CLOUDSHELL_S3_BUCKET"),
+		Region:         os.Getenv("CLOUDSHELL_S3_REGION"),
+		CredentialsDir: os.Getenv("CLOUDSHELL_S3_CREDENTIALS_DIR"),
+	}
+	logf.SetLogger(zap.Logger())
+
+	if err := agent.Run(opts); err != nil {
+		log.Error(err, "Agent failed")
+		os.Exit(1)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
 
 	"github.com/che-incubator/cloudshell-operator/pkg/apis"
+	operatorconfig "github.com/che-incubator/cloudshell-operator/pkg/config"
 	"github.com/che-incubator/cloudshell-operator/pkg/controller"
 	"github.com/che-incubator/cloudshell-operator/version"
 
@@ -25,6 +27,7 @@ import (
 	"github.com/spf13/pflag"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -47,6 +50,20 @@ func printVersion() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case agentCommand:
+			runAgent(os.Args[2:])
+			return
+		case reportCommand:
+			runReport(os.Args[2:])
+			return
+		case pauseCommand:
+			runPause()
+			return
+		}
+	}
+
 	// Add the zap logger flag set to the CLI. The flag set must
 	// be added before calling pflag.Parse().
 	pflag.CommandLine.AddFlagSet(zap.FlagSet())
@@ -69,11 +86,15 @@ func main() {
 
 	printVersion()
 
-	namespace, err := k8sutil.GetWatchNamespace()
+	// WATCH_NAMESPACE may be a single namespace, a comma-separated list of namespaces, or empty to watch all
+	// namespaces.
+	watchNamespace, err := k8sutil.GetWatchNamespace()
 	if err != nil {
 		log.Error(err, "Failed to get watch namespace")
 		os.Exit(1)
 	}
+	namespaces := parseWatchNamespaces(watchNamespace)
+	operatorconfig.ControllerCfg.SetWatchNamespaces(namespaces)
 
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
@@ -82,6 +103,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Read operator configuration and detect optional cluster features
+	if err := operatorconfig.LoadControllerConfig(cfg); err != nil {
+		log.Error(err, "Failed to load controller configuration")
+		os.Exit(1)
+	}
+
 	ctx := context.TODO()
 	// Become the leader before proceeding
 	err = leader.Become(ctx, "cloudshell-operator-lock")
@@ -91,11 +118,25 @@ func main() {
 	}
 
 	// Create a new Cmd to provide shared dependencies and start components
-	mgr, err := manager.New(cfg, manager.Options{
-		Namespace:          namespace,
+	options := manager.Options{
 		MapperProvider:     restmapper.NewDynamicRESTMapper,
 		MetricsBindAddress: fmt.Sprintf("%s:%d", metricsHost, metricsPort),
-	})
+	}
+	switch len(namespaces) {
+	case 0:
+		log.Info("Watching all namespaces")
+	case 1:
+		log.Info("Watching namespace", "namespace", namespaces[0])
+		options.Namespace = namespaces[0]
+	default:
+		log.Info("Watching multiple namespaces", "namespaces", namespaces)
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	if !operatorconfig.ControllerCfg.GetNamespaceSelector().Empty() && len(namespaces) > 0 {
+		log.Info("Namespace selector is set but operator is not cluster-wide; label changes on namespaces will " +
+			"only be noticed on the next reconcile")
+	}
+	mgr, err := manager.New(cfg, options)
 	if err != nil {
 		log.Error(err, "")
 		os.Exit(1)
@@ -115,7 +156,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = serveCRMetrics(cfg); err != nil {
+	if err = serveCRMetrics(cfg, namespaces); err != nil {
 		log.Info("Could not generate and serve custom resource metrics", "error", err.Error())
 	}
 
@@ -133,7 +174,11 @@ func main() {
 	// CreateServiceMonitors will automatically create the prometheus-operator ServiceMonitor resources
 	// necessary to configure Prometheus to scrape metrics from this operator.
 	services := []*v1.Service{service}
-	_, err = metrics.CreateServiceMonitors(cfg, namespace, services)
+	operatorNamespace, err := k8sutil.GetOperatorNamespace()
+	if err != nil {
+		log.Info("Could not determine operator namespace", "error", err.Error())
+	}
+	_, err = metrics.CreateServiceMonitors(cfg, operatorNamespace, services)
 	if err != nil {
 		log.Info("Could not create ServiceMonitor object", "error", err.Error())
 		// If this operator is deployed to a cluster without the prometheus-operator running, it will return
@@ -152,22 +197,32 @@ func main() {
 	}
 }
 
+// parseWatchNamespaces splits a comma-separated WATCH_NAMESPACE value into a list of namespaces. An empty result
+// means all namespaces should be watched.
+func parseWatchNamespaces(watchNamespace string) []string {
+	var namespaces []string
+	for _, ns := range strings.Split(watchNamespace, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
 // serveCRMetrics gets the Operator/CustomResource GVKs and generates metrics based on those types.
 // It serves those metrics on "http://metricsHost:operatorMetricsPort".
-func serveCRMetrics(cfg *rest.Config) error {
+func serveCRMetrics(cfg *rest.Config, namespaces []string) error {
 	// Below function returns filtered operator/CustomResource specific GVKs.
 	// For more control override the below GVK list with your own custom logic.
 	filteredGVK, err := k8sutil.GetGVKsFromAddToScheme(apis.AddToScheme)
 	if err != nil {
 		return err
 	}
-	// Get the namespace the operator is currently deployed in.
-	operatorNs, err := k8sutil.GetOperatorNamespace()
-	if err != nil {
-		return err
+	// Generate metrics for the watched namespaces; an empty namespace generates metrics for all namespaces.
+	ns := namespaces
+	if len(ns) == 0 {
+		ns = []string{""}
 	}
-	// To generate metrics in other namespaces, add the values below.
-	ns := []string{operatorNs}
 	// Generate and serve custom resource specific metrics.
 	err = kubemetrics.GenerateAndServeCRMetrics(cfg, ns, filteredGVK, metricsHost, operatorMetricsPort)
 	if err != nil {
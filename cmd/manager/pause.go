@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// pauseCommand is the first argument that runs the operator binary as a container that does nothing until it is
+// stopped. The pre-puller runs it in every cached image.
+const pauseCommand = "pause"
+
+// runPause waits for the container to be stopped
+func runPause() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+}
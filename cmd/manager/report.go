@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis"
+	"github.com/che-incubator/cloudshell-operator/pkg/report"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// reportCommand is the first argument that runs the operator binary to print a usage report of CloudShells
+const reportCommand = "report"
+
+// runReport prints the usage and cost of CloudShells, using the current kubeconfig
+func runReport(args []string) {
+	flags := pflag.NewFlagSet(reportCommand, pflag.ExitOnError)
+	opts := report.Options{}
+	flags.StringVarP(&opts.Namespace, "namespace", "n", "", "namespace of the CloudShells to report; empty reports all namespaces")
+	flags.Float64Var(&opts.CPUCost, "cpu-cost", 1, "cost of one requested CPU core for an hour")
+	flags.Float64Var(&opts.MemoryCost, "memory-cost", 0.125, "cost of one requested GiB of memory for an hour")
+	_ = flags.Parse(args)
+
+	if err := printReport(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "report failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printReport(opts report.Options) error {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return err
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return err
+	}
+	if err := apis.AddToScheme(scheme); err != nil {
+		return err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entries, err := report.Generate(c, opts, now)
+	if err != nil {
+		return err
+	}
+	return report.Print(os.Stdout, entries, now)
+}
@@ -9,6 +9,7 @@ require (
 	github.com/google/uuid v1.0.0
 	github.com/openshift/api v3.9.1-0.20190424152011-77b8897ec79a+incompatible
 	github.com/operator-framework/operator-sdk v0.12.0
+	github.com/prometheus/client_golang v1.0.0
 	github.com/spf13/pflag v1.0.3
 	k8s.io/api v0.0.0
 	k8s.io/apimachinery v0.0.0
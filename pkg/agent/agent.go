@@ -0,0 +1,233 @@
+// Package agent implements the cloudshell agent, a sidecar in shell pods that manages terminal sessions and reports
+// their state to the operator, tracks terminal activity, records terminal sessions for audit, and applies the
+// configuration the operator sets for the CloudShell using the pod. It is run by the operator binary with the "agent"
+// subcommand.
+package agent
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Paths of the agent's endpoints
+const (
+	SessionsPath = "/sessions"
+	ActivityPath = "/activity"
+	ConfigPath   = "/config"
+)
+
+// Activity is returned by the activity endpoint
+type Activity struct {
+	// LastActivityTime is the last time input was sent to a terminal, or nil if none was since the agent started
+	LastActivityTime *metav1.Time `json:"lastActivityTime"`
+}
+
+var log = logf.Log.WithName("agent")
+
+// Options configure the agent
+type Options struct {
+	// ListenAddress is the address the agent serves its endpoints on
+	ListenAddress string
+	// Token must be presented as a bearer token by clients of the agent's endpoints
+	Token string
+	// SessionsDir is a directory shared with the shell container, holding the session scripts and tmux socket. Named
+	// sessions are disabled if it is empty.
+	SessionsDir string
+	MaxSessions int
+	Scrollback  int
+	// ProxyAddress is the address of the terminal proxy placed between the auth proxy and machine-exec, which tracks
+	// activity and records terminals. The proxy is disabled if it is empty.
+	ProxyAddress string
+	// ProxyUpstream is the URL of machine-exec
+	ProxyUpstream string
+	// Sink is where recordings are stored: "stdout", "pvc" or "s3". Terminals are not recorded if it is empty.
+	Sink string
+	// RecordingsDir is where recordings are written for the pvc sink, and buffered for the s3 sink
+	RecordingsDir string
+	S3            S3Options
+	// HomeDir is the shell's home directory, mounted in the agent so that dotfiles set through the config endpoint
+	// can be written to it. Dotfiles are refused if it is empty.
+	HomeDir string
+}
+
+// sessionScript attaches to a named tmux session, creating it if it does not exist and the session limit allows.
+// The placeholders are the sessions directory and the session limit.
+const sessionScript = `#!/bin/sh
+# Attaches to the named terminal session, creating it if it does not exist
+dir=%[1]s
+name="${1:-main}"
+if ! command -v tmux >/dev/null 2>&1; then
+  echo "tmux is not installed in this image; this session will not persist" >&2
+  exec "${SHELL:-/bin/sh}" -l
+fi
+tmux="tmux -S $dir/tmux.sock -f $dir/tmux.conf"
+if ! $tmux has-session -t "=$name" 2>/dev/null; then
+  count=$($tmux list-sessions 2>/dev/null | wc -l)
+  if [ "$count" -ge %[2]d ]; then
+    echo "The limit of %[2]d sessions is reached. Existing sessions:" >&2
+    $tmux list-sessions -F '  #{session_name}' >&2
+    exit 1
+  fi
+fi
+exec $tmux new-session -A -s "$name"
+`
+
+// reportScript writes the state of all sessions to the sessions file read by the agent. It is run by tmux hooks.
+const reportScript = `#!/bin/sh
+dir=%[1]s
+{ tmux -S "$dir/tmux.sock" list-sessions -F '#{session_name}	#{session_attached}	#{session_created}' 2>/dev/null; true; } > "$dir/sessions.tmp"
+mv "$dir/sessions.tmp" "$dir/sessions"
+`
+
+const tmuxConf = `set -g history-limit %[2]d
+set-hook -g session-created 'run-shell -b %[1]s/report'
+set-hook -g session-closed 'run-shell -b %[1]s/report'
+set-hook -g client-attached 'run-shell -b %[1]s/report'
+set-hook -g client-detached 'run-shell -b %[1]s/report'
+`
+
+// Run serves the agent's endpoints and, if enabled, the terminal proxy until either fails
+func Run(opts Options) error {
+	if opts.Token == "" {
+		return fmt.Errorf("the agent token must be set")
+	}
+	errs := make(chan error, 2)
+	mux := http.NewServeMux()
+	config := &configServer{homeDir: opts.HomeDir}
+	mux.Handle(ConfigPath, config)
+	if opts.ProxyAddress != "" {
+		var sink Sink
+		if opts.Sink != "" {
+			var err error
+			if sink, err = NewSink(opts.Sink, opts.RecordingsDir, opts.S3); err != nil {
+				return err
+			}
+		}
+		var sessionCommand []string
+		if opts.SessionsDir != "" {
+			sessionCommand = []string{filepath.Join(opts.SessionsDir, "session")}
+		}
+		// Until the operator sets the shell's identity, recordings are identified by the pod's name
+		hostname, _ := os.Hostname()
+		proxy, err := newTerminalProxy(opts.ProxyUpstream, hostname, sink, sessionCommand)
+		if err != nil {
+			return err
+		}
+		config.proxy = proxy
+		mux.HandleFunc(ActivityPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Activity{LastActivityTime: proxy.lastActivity()}); err != nil {
+				log.Error(err, "Failed to write activity")
+			}
+		})
+		// Terminal connections are long-lived, so the terminal proxy has no read or write timeouts
+		server := &http.Server{Addr: opts.ProxyAddress, Handler: proxy}
+		log.Info("Proxying terminals", "address", opts.ProxyAddress, "sink", opts.Sink)
+		go func() { errs <- server.ListenAndServe() }()
+	}
+
+	if opts.SessionsDir != "" {
+		if err := writeSessionScripts(opts); err != nil {
+			return err
+		}
+		mux.HandleFunc(SessionsPath, func(w http.ResponseWriter, r *http.Request) {
+			serveSessions(w, filepath.Join(opts.SessionsDir, "sessions"))
+		})
+	}
+	server := &http.Server{
+		Addr:         opts.ListenAddress,
+		Handler:      requireToken(opts.Token, mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	log.Info("Serving agent endpoints", "address", opts.ListenAddress)
+	go func() { errs <- server.ListenAndServe() }()
+	return <-errs
+}
+
+// requireToken rejects requests that do not carry token as a bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeSessionScripts writes the scripts used by the shell container to attach to sessions
+func writeSessionScripts(opts Options) error {
+	files := map[string]string{
+		"session":   fmt.Sprintf(sessionScript, opts.SessionsDir, opts.MaxSessions),
+		"report":    fmt.Sprintf(reportScript, opts.SessionsDir),
+		"tmux.conf": fmt.Sprintf(tmuxConf, opts.SessionsDir, opts.Scrollback),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(opts.SessionsDir, name), []byte(content), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serveSessions(w http.ResponseWriter, path string) {
+	sessions, err := readSessions(path)
+	if err != nil {
+		log.Error(err, "Failed to read sessions")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		log.Error(err, "Failed to write sessions")
+	}
+}
+
+// readSessions parses the sessions file written by the report script. A missing file means no session was created yet.
+func readSessions(path string) ([]v1alpha1.SessionStatus, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []v1alpha1.SessionStatus{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sessions := []v1alpha1.SessionStatus{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		attached, err := strconv.ParseInt(fields[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		created, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, v1alpha1.SessionStatus{
+			Name:      fields[0],
+			Attached:  int32(attached),
+			CreatedAt: metav1.Unix(created, 0),
+		})
+	}
+	return sessions, scanner.Err()
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxConfigSize bounds the size of a configuration sent to the config endpoint; dotfiles come from a ConfigMap, which
+// is at most 1MiB
+const maxConfigSize = 4 << 20
+
+// Config is the configuration of a shell that depends on the CloudShell using its pod rather than on the pod itself,
+// so that the pod of a pooled shell is unchanged when it is claimed. The operator sets it through the config endpoint.
+type Config struct {
+	// Shell identifies the shell in recordings, as <namespace>/<name>
+	Shell string `json:"shell"`
+	// Dotfiles are written to the home directory, by file name. They are not returned by the config endpoint.
+	Dotfiles map[string][]byte `json:"dotfiles,omitempty"`
+	// DotfilesHash is the HashDotfiles of the dotfiles last written, as returned by the config endpoint
+	DotfilesHash string `json:"dotfilesHash,omitempty"`
+}
+
+// HashDotfiles returns a hash of the names and contents of dotfiles, or an empty string if there are none
+func HashDotfiles(dotfiles map[string][]byte) string {
+	if len(dotfiles) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(dotfiles))
+	for name := range dotfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(dotfiles[name]))
+		hash.Write(dotfiles[name])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)[:16])
+}
+
+// configServer serves the config endpoint. The configuration is kept in memory, so the operator sets it again when
+// the agent restarts.
+type configServer struct {
+	// homeDir is the shell's home directory, where dotfiles are written; dotfiles are refused if it is empty
+	homeDir string
+	// proxy is the terminal proxy, whose recordings identify the shell; it is nil if the proxy is disabled
+	proxy *terminalProxy
+
+	mu     sync.Mutex
+	config Config
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		config := s.config
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(config); err != nil {
+			log.Error(err, "Failed to write config")
+		}
+	case http.MethodPut:
+		config := Config{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxConfigSize)).Decode(&config); err != nil {
+			http.Error(w, fmt.Sprintf("invalid config: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.apply(config); err != nil {
+			log.Error(err, "Failed to apply config")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// apply writes a configuration's dotfiles, if they changed, and sets the shell's identity. On failure, the previous
+// configuration is kept, so that the operator retries.
+func (s *configServer) apply(config Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := HashDotfiles(config.Dotfiles)
+	if hash != s.config.DotfilesHash {
+		if err := writeDotfiles(s.homeDir, config.Dotfiles); err != nil {
+			return err
+		}
+	}
+	if s.proxy != nil {
+		s.proxy.setShell(config.Shell)
+	}
+	s.config = Config{Shell: config.Shell, DotfilesHash: hash}
+	log.Info("Applied config", "shell", config.Shell, "dotfiles", len(config.Dotfiles))
+	return nil
+}
+
+// writeDotfiles writes each dotfile to the home directory, replacing the file or link in its place. Files are written
+// to a temporary file first, so that the shell never reads a partial file.
+func writeDotfiles(homeDir string, dotfiles map[string][]byte) error {
+	if len(dotfiles) > 0 && homeDir == "" {
+		return fmt.Errorf("dotfiles cannot be installed: the agent has no home directory")
+	}
+	for name, content := range dotfiles {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+			return fmt.Errorf("invalid dotfile name %q", name)
+		}
+		tmp, err := ioutil.TempFile(homeDir, ".cloudshell-dotfile-")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(content)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0644)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(homeDir, name))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("failed to write %s: %s", name, err)
+		}
+	}
+	return nil
+}
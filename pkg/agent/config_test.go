@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func putConfig(t *testing.T, server *configServer, config Config) int {
+	body, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, ConfigPath, bytes.NewReader(body)))
+	return recorder.Code
+}
+
+func getConfig(t *testing.T, server *configServer) Config {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ConfigPath, nil))
+	config := Config{}
+	if err := json.NewDecoder(recorder.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestConfigServer(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	// A link left by a previous install is replaced rather than written through
+	target := filepath.Join(home, "target")
+	if err := ioutil.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(home, ".bashrc")); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := newTerminalProxy("http://127.0.0.1:4444", "pod", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &configServer{homeDir: home, proxy: proxy}
+
+	dotfiles := map[string][]byte{".bashrc": []byte("alias ll='ls -l'\n"), ".vimrc": []byte("set nu\n")}
+	if code := putConfig(t, server, Config{Shell: "ns/shell", Dotfiles: dotfiles}); code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", code)
+	}
+	for name, content := range dotfiles {
+		written, err := ioutil.ReadFile(filepath.Join(home, name))
+		if err != nil || !bytes.Equal(written, content) {
+			t.Errorf("expected %s to hold %q, got %q (%v)", name, content, written, err)
+		}
+	}
+	if old, _ := ioutil.ReadFile(target); string(old) != "old" {
+		t.Errorf("expected the link target to be unchanged, got %q", old)
+	}
+	if proxy.getShell() != "ns/shell" {
+		t.Errorf("expected the proxy's shell to be ns/shell, got %q", proxy.getShell())
+	}
+	expected := Config{Shell: "ns/shell", DotfilesHash: HashDotfiles(dotfiles)}
+	if config := getConfig(t, server); config.Shell != expected.Shell || config.DotfilesHash != expected.DotfilesHash ||
+		config.Dotfiles != nil {
+		t.Errorf("expected config %+v, got %+v", expected, config)
+	}
+
+	// An invalid dotfile is refused, and the previous configuration is kept
+	code := putConfig(t, server, Config{Shell: "ns/other", Dotfiles: map[string][]byte{"../escape": nil}})
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(home), "escape")); !os.IsNotExist(err) {
+		t.Errorf("expected no file outside the home directory, got %v", err)
+	}
+	if config := getConfig(t, server); config.Shell != "ns/shell" || proxy.getShell() != "ns/shell" {
+		t.Errorf("expected the previous config to be kept, got %+v", config)
+	}
+}
+
+func TestHashDotfiles(t *testing.T) {
+	if hash := HashDotfiles(nil); hash != "" {
+		t.Errorf("expected no hash without dotfiles, got %q", hash)
+	}
+	a := HashDotfiles(map[string][]byte{"ab": []byte("c")})
+	b := HashDotfiles(map[string][]byte{"a": []byte("bc")})
+	if a == b {
+		t.Errorf("expected names and contents not to run together")
+	}
+}
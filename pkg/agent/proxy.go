@@ -0,0 +1,504 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// attachPathPrefix is the path of machine-exec's websocket endpoint carrying terminal input and output
+	attachPathPrefix = "/attach/"
+	// connectPath is the path of machine-exec's JSON-RPC websocket endpoint, on which terminals are created
+	connectPath = "/connect"
+	// userHeader holds the user authenticated by the auth proxy
+	userHeader = "X-Forwarded-User"
+	// maxFramePayload bounds the size of websocket frames parsed for recording
+	maxFramePayload = 16 << 20
+)
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// terminalProxy proxies requests from the auth proxy to machine-exec. It tracks input to terminals and, if it has a
+// sink, records the terminal connections.
+type terminalProxy struct {
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+	// sink stores recordings; terminals are not recorded if it is nil
+	sink Sink
+	// shellMu guards shell, which identifies the shell in recordings as <namespace>/<name>. It is set by the operator
+	// through the config endpoint, and is the pod's name until then.
+	shellMu sync.Mutex
+	shell   string
+	// sessionCommand attaches to the default terminal session. If set, terminals created with the default shell run
+	// it instead, so that reconnecting reattaches to the session.
+	sessionCommand []string
+	// activity is the Unix time of the last input to a terminal, or zero if there was none
+	activity int64
+}
+
+func newTerminalProxy(upstream, shell string, sink Sink, sessionCommand []string) (*terminalProxy, error) {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %s", upstream, err)
+	}
+	return &terminalProxy{
+		upstream:       upstreamURL,
+		proxy:          httputil.NewSingleHostReverseProxy(upstreamURL),
+		sink:           sink,
+		shell:          shell,
+		sessionCommand: sessionCommand,
+	}, nil
+}
+
+func (p *terminalProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, attachPathPrefix):
+		p.serveTerminal(w, r)
+	case r.URL.Path == connectPath && len(p.sessionCommand) > 0:
+		p.serveConnect(w, r)
+	default:
+		p.proxy.ServeHTTP(w, r)
+	}
+}
+
+func (p *terminalProxy) setShell(shell string) {
+	p.shellMu.Lock()
+	defer p.shellMu.Unlock()
+	p.shell = shell
+}
+
+func (p *terminalProxy) getShell() string {
+	p.shellMu.Lock()
+	defer p.shellMu.Unlock()
+	return p.shell
+}
+
+func (p *terminalProxy) touch() {
+	atomic.StoreInt64(&p.activity, time.Now().Unix())
+}
+
+// lastActivity returns the time of the last input to a terminal, or nil if there was none
+func (p *terminalProxy) lastActivity() *metav1.Time {
+	activity := atomic.LoadInt64(&p.activity)
+	if activity == 0 {
+		return nil
+	}
+	t := metav1.Unix(activity, 0)
+	return &t
+}
+
+// startRecording opens the recording of a terminal, or returns nil if terminals are not recorded
+func (p *terminalProxy) startRecording(r *http.Request, user string, start time.Time) (recording Recording, name string, err error) {
+	if p.sink == nil {
+		return nil, "", nil
+	}
+	name = fmt.Sprintf("%s-%s-%s", start.UTC().Format("20060102T150405Z"),
+		unsafeNameChars.ReplaceAllString(user, "_"), unsafeNameChars.ReplaceAllString(path.Base(r.URL.Path), "_"))
+	recording, err = p.sink.Open(name, Header{
+		Version:   2,
+		Width:     80,
+		Height:    24,
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("%s on %s", user, p.getShell()),
+	})
+	return recording, name, err
+}
+
+// serveTerminal relays a terminal websocket connection, noting input as activity and recording the messages in both
+// directions if terminals are recorded. A terminal is refused if its recording cannot be started.
+func (p *terminalProxy) serveTerminal(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get(userHeader)
+	if user == "" {
+		user = "unknown"
+	}
+	start := time.Now()
+	recording, name, err := p.startRecording(r, user, start)
+	if err != nil {
+		log.Error(err, "Failed to start recording", "user", user)
+		http.Error(w, "session recording is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if recording == nil {
+		// Terminals that are not recorded are still parsed, to track input
+		recording = noRecording{}
+	} else {
+		log.Info("Recording terminal", "user", user, "recording", name)
+	}
+	p.touch()
+
+	clientConn, buffered, upstreamConn, upstream, ok := p.forwardUpgrade(w, r)
+	if !ok {
+		recording.Close()
+		return
+	}
+
+	var mu sync.Mutex
+	record := func(src io.Reader, kind string) io.Reader {
+		return &recordedReader{src: src, parser: &frameParser{emit: func(data []byte) {
+			if kind == "i" {
+				p.touch()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err := recording.Event(time.Since(start).Seconds(), kind, data); err != nil {
+				log.Error(err, "Failed to record terminal event", "recording", name)
+			}
+		}}}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	relay := func(dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); errors.Is(err, errUnparsableFrame) {
+			log.Error(err, "Closing terminal that cannot be recorded", "user", user, "recording", name)
+		}
+		// Closing both connections ends the relay in the other direction
+		clientConn.Close()
+		upstreamConn.Close()
+	}
+	go relay(clientConn, record(upstream, "o"))
+	go relay(upstreamConn, record(buffered.Reader, "i"))
+	wg.Wait()
+
+	if err := recording.Close(); err != nil {
+		log.Error(err, "Failed to store recording", "recording", name)
+	}
+}
+
+// serveConnect relays a JSON-RPC connection to machine-exec, replacing the command of terminals created with the
+// default shell by the session command
+func (p *terminalProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	clientConn, buffered, upstreamConn, upstream, ok := p.forwardUpgrade(w, r)
+	if !ok {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(clientConn, upstream)
+		clientConn.Close()
+		upstreamConn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		if err := relayCreates(upstreamConn, buffered.Reader, p.sessionCommand); err != nil && err != io.EOF {
+			log.V(1).Info("Terminal connection closed", "error", err.Error())
+		}
+		clientConn.Close()
+		upstreamConn.Close()
+	}()
+	wg.Wait()
+}
+
+// forwardUpgrade dials machine-exec, hijacks the client connection and forwards the websocket upgrade request and
+// machine-exec's response. On success, the returned reader yields the websocket frames machine-exec sends after the
+// handshake. Otherwise the client gets an error, or machine-exec's response if it refused the upgrade, and false is
+// returned.
+func (p *terminalProxy) forwardUpgrade(w http.ResponseWriter, r *http.Request) (clientConn net.Conn, buffered *bufio.ReadWriter, upstreamConn net.Conn, upstream *bufio.Reader, ok bool) {
+	upstreamConn, err := net.DialTimeout("tcp", p.upstream.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, nil, nil, nil, false
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstreamConn.Close()
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, nil, nil, nil, false
+	}
+	clientConn, buffered, err = hijacker.Hijack()
+	if err != nil {
+		upstreamConn.Close()
+		log.Error(err, "Failed to hijack connection")
+		return nil, nil, nil, nil, false
+	}
+	fail := func(err error, msg string) (net.Conn, *bufio.ReadWriter, net.Conn, *bufio.Reader, bool) {
+		upstreamConn.Close()
+		clientConn.Close()
+		if err != nil {
+			log.Error(err, msg)
+		}
+		return nil, nil, nil, nil, false
+	}
+	// Compressed frames cannot be parsed; leaving out the extension makes machine-exec send them uncompressed
+	r.Header.Del("Sec-WebSocket-Extensions")
+	if err := r.Write(upstreamConn); err != nil {
+		return fail(err, "Failed to forward terminal request")
+	}
+	// The handshake response is not a websocket frame, so it is relayed before frames are parsed
+	upstream = bufio.NewReader(upstreamConn)
+	resp, err := http.ReadResponse(upstream, r)
+	if err != nil {
+		return fail(err, "Failed to read terminal response")
+	}
+	err = resp.Write(clientConn)
+	resp.Body.Close()
+	if err != nil {
+		return fail(err, "Failed to forward terminal response")
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fail(nil, "")
+	}
+	return clientConn, buffered, upstreamConn, upstream, true
+}
+
+// relayCreates copies websocket frames from src to dst, replacing the command of JSON-RPC requests creating a
+// terminal with the default shell by command. If the stream cannot be parsed, the rest of it is copied unchanged.
+func relayCreates(dst io.Writer, src io.Reader, command []string) error {
+	var buf []byte
+	chunk := make([]byte, 32<<10)
+	for {
+		n, readErr := src.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for {
+			size, payload, err := parseFrame(buf)
+			if err != nil {
+				if _, err := dst.Write(buf); err != nil {
+					return err
+				}
+				_, err := io.Copy(dst, src)
+				return err
+			}
+			if size == 0 {
+				break
+			}
+			frame := buf[:size]
+			if rewritten, ok := rewriteCreate(frame, payload, command); ok {
+				frame = rewritten
+			}
+			if _, err := dst.Write(frame); err != nil {
+				return err
+			}
+			buf = buf[size:]
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// rewriteCreate returns a copy of a websocket frame holding a machine-exec "create" request for the default shell,
+// with the command replaced. It returns false for any other frame, including fragmented messages.
+func rewriteCreate(frame, payload []byte, command []string) ([]byte, bool) {
+	// Only single-frame text messages are rewritten
+	if frame[0] != 0x81 {
+		return nil, false
+	}
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, false
+	}
+	var method string
+	if err := json.Unmarshal(request["method"], &method); err != nil || method != "create" {
+		return nil, false
+	}
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(request["params"], &params); err != nil {
+		return nil, false
+	}
+	var cmd []string
+	if raw, ok := params["cmd"]; ok {
+		if err := json.Unmarshal(raw, &cmd); err != nil {
+			return nil, false
+		}
+	}
+	if !isDefaultShell(cmd) {
+		return nil, false
+	}
+	var err error
+	if params["cmd"], err = json.Marshal(command); err != nil {
+		return nil, false
+	}
+	if request["params"], err = json.Marshal(params); err != nil {
+		return nil, false
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, false
+	}
+	return encodeFrame(frame[0], data, frame[1]&0x80 != 0), true
+}
+
+// isDefaultShell returns whether a terminal command runs a plain (login) shell rather than a specific program
+func isDefaultShell(cmd []string) bool {
+	if len(cmd) == 0 {
+		return true
+	}
+	switch path.Base(cmd[0]) {
+	case "sh", "bash", "zsh", "ash":
+	default:
+		return false
+	}
+	return len(cmd) == 1 || (len(cmd) == 2 && (cmd[1] == "-l" || cmd[1] == "--login"))
+}
+
+// encodeFrame encodes a websocket frame with the given first header byte (flags and opcode) and payload, masking it
+// with a random key if masked is set, as required for frames sent by clients
+func encodeFrame(first byte, payload []byte, masked bool) []byte {
+	frame := []byte{first, 0}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame[1] = byte(length)
+	case length <= 0xffff:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		// A fixed key is valid; masking only protects intermediaries from crafted payloads
+		key = []byte{0, 0, 0, 0}
+	}
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+// noRecording is used for terminals that are not recorded
+type noRecording struct{}
+
+func (noRecording) Event(float64, string, []byte) error { return nil }
+func (noRecording) Close() error                        { return nil }
+
+// errUnparsableFrame is returned for websocket streams that cannot be parsed, and therefore cannot be recorded
+var errUnparsableFrame = errors.New("terminal stream cannot be parsed")
+
+// recordedReader reads a stream of websocket frames through a frameParser. Data is only passed on once the parser
+// accepted it, so that a stream that cannot be recorded is not relayed either.
+type recordedReader struct {
+	src    io.Reader
+	parser *frameParser
+}
+
+func (r *recordedReader) Read(b []byte) (int, error) {
+	n, err := r.src.Read(b)
+	if n > 0 {
+		if _, parseErr := r.parser.Write(b[:n]); parseErr != nil {
+			return 0, parseErr
+		}
+	}
+	return n, err
+}
+
+// frameParser extracts the payload of websocket data frames from a stream of frames. Once the stream cannot be
+// parsed, every write fails with errUnparsableFrame.
+type frameParser struct {
+	buf  []byte
+	emit func([]byte)
+	err  error
+}
+
+func (p *frameParser) Write(data []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.buf = append(p.buf, data...)
+	for {
+		size, payload, err := parseFrame(p.buf)
+		if err != nil {
+			p.err = fmt.Errorf("%w: %v", errUnparsableFrame, err)
+			p.buf = nil
+			return 0, p.err
+		}
+		if size == 0 {
+			break
+		}
+		if len(payload) > 0 {
+			p.emit(payload)
+		}
+		p.buf = p.buf[size:]
+	}
+	return len(data), nil
+}
+
+// parseFrame parses the websocket frame at the start of b, returning its size and, for data frames, its unmasked
+// payload. The size is zero if b does not hold a complete frame.
+func parseFrame(b []byte) (size int, payload []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil
+	}
+	opcode := b[0] & 0x0f
+	masked := b[1]&0x80 != 0
+	length := uint64(b[1] & 0x7f)
+	offset := 2
+	switch length {
+	case 126:
+		if len(b) < 4 {
+			return 0, nil, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(b[2:4]))
+		offset = 4
+	case 127:
+		if len(b) < 10 {
+			return 0, nil, nil
+		}
+		length = binary.BigEndian.Uint64(b[2:10])
+		offset = 10
+	}
+	// Reserved opcodes have no defined meaning, and control frames are never fragmented or longer than 125 bytes
+	if opcode > 2 && opcode < 8 || opcode > 10 {
+		return 0, nil, fmt.Errorf("frame has the reserved opcode %#x", opcode)
+	}
+	if opcode >= 8 && (b[0]&0x80 == 0 || length > 125) {
+		return 0, nil, fmt.Errorf("control frame with opcode %#x is fragmented or too long", opcode)
+	}
+	if length > maxFramePayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", length, maxFramePayload)
+	}
+	var key []byte
+	if masked {
+		if len(b) < offset+4 {
+			return 0, nil, nil
+		}
+		key = b[offset : offset+4]
+		offset += 4
+	}
+	end := offset + int(length)
+	if len(b) < end {
+		return 0, nil, nil
+	}
+	// Continuation, text and binary frames carry data; the others are control frames
+	if opcode > 2 {
+		return end, nil, nil
+	}
+	payload = append([]byte{}, b[offset:end]...)
+	for i := range payload {
+		if masked {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return end, payload, nil
+}
@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFrame(t *testing.T) {
+	// The examples of RFC 6455 section 5.7
+	hello := []byte("Hello")
+	long := bytes.Repeat([]byte{'a'}, 256)
+	huge := bytes.Repeat([]byte{'b'}, 65536)
+	tests := []struct {
+		name    string
+		frame   []byte
+		size    int
+		payload []byte
+		invalid bool
+	}{
+		{
+			name:    "unmasked text",
+			frame:   []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+			size:    7,
+			payload: hello,
+		},
+		{
+			name:    "masked text",
+			frame:   []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+			size:    11,
+			payload: hello,
+		},
+		{
+			name:    "first fragment",
+			frame:   []byte{0x01, 0x03, 0x48, 0x65, 0x6c},
+			size:    5,
+			payload: []byte("Hel"),
+		},
+		{
+			name:    "continuation",
+			frame:   []byte{0x80, 0x02, 0x6c, 0x6f},
+			size:    4,
+			payload: []byte("lo"),
+		},
+		{
+			name:  "ping",
+			frame: []byte{0x89, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+			size:  7,
+		},
+		{
+			name:    "16-bit length",
+			frame:   append([]byte{0x82, 0x7e, 0x01, 0x00}, long...),
+			size:    260,
+			payload: long,
+		},
+		{
+			name:    "64-bit length",
+			frame:   append([]byte{0x82, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00}, huge...),
+			size:    65546,
+			payload: huge,
+		},
+		{
+			name:  "incomplete header",
+			frame: []byte{0x82, 0x7f, 0x00},
+		},
+		{
+			name:  "incomplete mask",
+			frame: []byte{0x81, 0x85, 0x37, 0xfa},
+		},
+		{
+			name:  "incomplete payload",
+			frame: []byte{0x81, 0x05, 0x48, 0x65},
+		},
+		{
+			name:    "too large",
+			frame:   []byte{0x82, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01},
+			invalid: true,
+		},
+		{
+			name:    "reserved opcode",
+			frame:   []byte{0x83, 0x00},
+			invalid: true,
+		},
+		{
+			name:    "fragmented ping",
+			frame:   []byte{0x09, 0x00},
+			invalid: true,
+		},
+		{
+			name:    "long ping",
+			frame:   []byte{0x89, 0x7e, 0x00, 0x7e},
+			invalid: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size, payload, err := parseFrame(test.frame)
+			if (err != nil) != test.invalid {
+				t.Fatalf("expected invalid %t, got error %v", test.invalid, err)
+			}
+			if size != test.size {
+				t.Errorf("expected size %d, got %d", test.size, size)
+			}
+			if !bytes.Equal(payload, test.payload) {
+				t.Errorf("expected payload %q, got %q", test.payload, payload)
+			}
+		})
+	}
+}
+
+func TestFrameParserSplitWrites(t *testing.T) {
+	var stream []byte
+	stream = append(stream, encodeFrame(0x01, []byte("Hel"), true)...)
+	stream = append(stream, encodeFrame(0x89, nil, true)...)
+	stream = append(stream, encodeFrame(0x80, []byte("lo"), true)...)
+	stream = append(stream, encodeFrame(0x82, bytes.Repeat([]byte{'x'}, 300), false)...)
+
+	var got []string
+	parser := &frameParser{emit: func(data []byte) { got = append(got, string(data)) }}
+	// Frames arrive split at arbitrary points
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		parser.Write(stream[i:end])
+	}
+	expected := []string{"Hel", "lo", strings.Repeat("x", 300)}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if parser.err != nil {
+		t.Errorf("parser failed: %v", parser.err)
+	}
+}
+
+func TestFrameParserFailsClosed(t *testing.T) {
+	var got []string
+	parser := &frameParser{emit: func(data []byte) { got = append(got, string(data)) }}
+	if _, err := parser.Write(encodeFrame(0x81, []byte("ls"), true)); err != nil {
+		t.Fatal(err)
+	}
+	oversized := []byte{0x82, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01}
+	if _, err := parser.Write(oversized); !errors.Is(err, errUnparsableFrame) {
+		t.Fatalf("expected an unparsable frame, got %v", err)
+	}
+	// Valid frames are not accepted after the stream failed
+	if _, err := parser.Write(encodeFrame(0x81, []byte("rm"), true)); !errors.Is(err, errUnparsableFrame) {
+		t.Fatalf("expected an unparsable frame, got %v", err)
+	}
+	if expected := []string{"ls"}; fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// memorySink keeps the events of recordings in memory
+type memorySink struct {
+	mu     sync.Mutex
+	events []string
+	closed chan struct{}
+}
+
+func (s *memorySink) Open(name string, header Header) (Recording, error) {
+	return s, nil
+}
+
+func (s *memorySink) Event(elapsed float64, kind string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, kind+":"+string(data))
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestServeTerminalRecordsFramesOnly(t *testing.T) {
+	output := encodeFrame(0x81, []byte("$ "), false)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buffered.Write(output)
+		buffered.Flush()
+		// Wait for the client's frame before closing
+		buffered.Read(make([]byte, 64))
+	}))
+	defer upstream.Close()
+
+	sink := &memorySink{closed: make(chan struct{})}
+	proxy, err := newTerminalProxy(upstream.URL, "ns/shell", sink, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /attach/1 HTTP/1.1\r\nHost: shell\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %s", resp.Status)
+	}
+	frame := make([]byte, len(output))
+	if _, err := io.ReadFull(reader, frame); err != nil || !bytes.Equal(frame, output) {
+		t.Fatalf("expected frame %q, got %q (%v)", output, frame, err)
+	}
+	conn.Write(encodeFrame(0x81, []byte("ls\r"), true))
+
+	select {
+	case <-sink.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording was not closed")
+	}
+	expected := []string{"o:$ ", "i:ls\r"}
+	if fmt.Sprint(sink.events) != fmt.Sprint(expected) {
+		t.Errorf("expected events %q, got %q", expected, sink.events)
+	}
+}
+
+func TestServeTerminalClosesUnparsableStream(t *testing.T) {
+	input := encodeFrame(0x81, []byte("ls\r"), true)
+	relayed := make(chan struct{})
+	received := make(chan []byte, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buffered.Flush()
+		if _, err := io.ReadFull(buffered, make([]byte, len(input))); err != nil {
+			t.Error(err)
+		}
+		close(relayed)
+		// Everything relayed after the first frame, until the proxy closes the connection
+		data, _ := ioutil.ReadAll(buffered)
+		received <- data
+	}))
+	defer upstream.Close()
+
+	sink := &memorySink{closed: make(chan struct{})}
+	proxy, err := newTerminalProxy(upstream.URL, "ns/shell", sink, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /attach/1 HTTP/1.1\r\nHost: shell\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %s", resp.Status)
+	}
+	conn.Write(input)
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("input was not relayed")
+	}
+	// An oversized frame ends the session without being relayed
+	conn.Write([]byte{0x82, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 'r', 'm'})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	select {
+	case <-sink.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording was not closed")
+	}
+	select {
+	case data := <-received:
+		if len(data) > 0 {
+			t.Errorf("expected the oversized frame not to be relayed, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection was not closed")
+	}
+	expected := []string{"i:ls\r"}
+	if fmt.Sprint(sink.events) != fmt.Sprint(expected) {
+		t.Errorf("expected events %q, got %q", expected, sink.events)
+	}
+}
@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3UploadAttempts = 3
+	castContentType  = "application/x-asciicast"
+)
+
+// Keys of the Secret holding the temporary credentials a shell uploads recordings with, mounted in the agent as
+// S3Options.CredentialsDir
+const (
+	S3AccessKeyIDKey     = "accessKeyId"
+	S3SecretAccessKeyKey = "secretAccessKey"
+	S3SessionTokenKey    = "sessionToken"
+	// S3PrefixKey holds the key prefix the credentials may upload to
+	S3PrefixKey = "prefix"
+)
+
+// S3Options configure uploads to an S3-compatible object store. Objects are addressed path-style, which is supported
+// by AWS and by most S3-compatible stores.
+type S3Options struct {
+	Endpoint string
+	Bucket   string
+	Region   string
+	// CredentialsDir holds the credentials and key prefix of the shell, in files named after the S3*Key constants.
+	// They are read for each upload, as the operator refreshes the credentials before they expire.
+	CredentialsDir string
+}
+
+// S3Credentials sign requests to S3 and STS. The session token is only set for temporary credentials.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3Sink buffers each recording in a file and uploads it when the recording is closed. Recordings that fail to
+// upload are left in the directory.
+type s3Sink struct {
+	dir      string
+	endpoint *url.URL
+	opts     S3Options
+	client   *http.Client
+}
+
+func newS3Sink(dir string, opts S3Options) (*s3Sink, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" || opts.CredentialsDir == "" {
+		return nil, fmt.Errorf("the S3 bucket and credentials directory must be set")
+	}
+	return &s3Sink{
+		dir:      dir,
+		endpoint: endpoint,
+		opts:     opts,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *s3Sink) Open(name string, header Header) (Recording, error) {
+	filename := filepath.Join(s.dir, name+".cast")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := newCastRecording(file, header, func() error {
+		defer file.Close()
+		var err error
+		for attempt := 1; attempt <= s3UploadAttempts; attempt++ {
+			if err = s.upload(name+".cast", file); err == nil {
+				return os.Remove(filename)
+			}
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+		return fmt.Errorf("failed to upload %s, which is kept in %s: %s", name, filename, err)
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recording, nil
+}
+
+// loadCredentials reads the current credentials and key prefix from the credentials directory
+func (s *s3Sink) loadCredentials() (creds S3Credentials, prefix string, err error) {
+	values := map[string]string{}
+	for _, key := range []string{S3AccessKeyIDKey, S3SecretAccessKeyKey, S3SessionTokenKey, S3PrefixKey} {
+		data, err := ioutil.ReadFile(filepath.Join(s.opts.CredentialsDir, key))
+		if err != nil && !(os.IsNotExist(err) && key == S3SessionTokenKey) {
+			return S3Credentials{}, "", err
+		}
+		values[key] = strings.TrimSpace(string(data))
+	}
+	creds = S3Credentials{
+		AccessKeyID:     values[S3AccessKeyIDKey],
+		SecretAccessKey: values[S3SecretAccessKeyKey],
+		SessionToken:    values[S3SessionTokenKey],
+	}
+	return creds, values[S3PrefixKey], nil
+}
+
+// upload puts the contents of file in the bucket under name, below the prefix of the shell's credentials
+func (s *s3Sink) upload(name string, file *os.File) error {
+	creds, prefix, err := s.loadCredentials()
+	if err != nil {
+		return fmt.Errorf("failed to read S3 credentials: %s", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	target := *s.endpoint
+	target.Path = path.Join("/", s.opts.Bucket, prefix, name)
+	req, err := http.NewRequest(http.MethodPut, target.String(), ioutil.NopCloser(file))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", castContentType)
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, s.opts.Region, "s3", creds, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("upload failed with %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req, signing the host and all headers set on req.
+// The request path must be in canonical form, which holds for the object keys used here.
+func signV4(req *http.Request, payloadHash, region, service string, creds S3Credentials, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, canonicalPath, canonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query parameters sorted by name and value, percent-encoded as required by AWS
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{awsEscape(name), awsEscape(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, len(params))
+	for i, param := range params {
+		pairs[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes all characters except the unreserved ones, with spaces encoded as %20
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
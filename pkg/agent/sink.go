@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Header is the header line of an asciinema v2 recording
+type Header struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+// Recording receives the events of a terminal session
+type Recording interface {
+	// Event records data sent to ("i") or received from ("o") the terminal, elapsed seconds after the recording started
+	Event(elapsed float64, kind string, data []byte) error
+	// Close ends the recording and stores it
+	Close() error
+}
+
+// Sink stores recordings
+type Sink interface {
+	// Open starts a recording with a name unique within the shell
+	Open(name string, header Header) (Recording, error)
+}
+
+// castRecording writes a recording in asciinema v2 format: a header line followed by one line per event
+type castRecording struct {
+	w       io.Writer
+	onClose func() error
+}
+
+func newCastRecording(w io.Writer, header Header, onClose func() error) (*castRecording, error) {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	return &castRecording{w: w, onClose: onClose}, nil
+}
+
+func (c *castRecording) Event(elapsed float64, kind string, data []byte) error {
+	line, err := json.Marshal([]interface{}{elapsed, kind, string(data)})
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(append(line, '\n'))
+	return err
+}
+
+func (c *castRecording) Close() error {
+	return c.onClose()
+}
+
+// dirSink writes each recording to a file in a directory, such as a mounted PersistentVolumeClaim
+type dirSink struct {
+	dir string
+}
+
+func (s *dirSink) Open(name string, header Header) (Recording, error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, name+".cast"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := newCastRecording(file, header, file.Close)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recording, nil
+}
+
+// stdoutSink writes recordings to standard output for log collection. Each line of a recording is wrapped in a JSON
+// object naming the recording, so that interleaved recordings can be told apart.
+type stdoutSink struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type stdoutLine struct {
+	Recording string          `json:"recording"`
+	Cast      json.RawMessage `json:"cast"`
+}
+
+func (s *stdoutSink) Open(name string, header Header) (Recording, error) {
+	return newCastRecording(&stdoutWriter{sink: s, name: name}, header, func() error { return nil })
+}
+
+// stdoutWriter wraps each line written by a castRecording for stdoutSink
+type stdoutWriter struct {
+	sink *stdoutSink
+	name string
+}
+
+func (w *stdoutWriter) Write(line []byte) (int, error) {
+	wrapped, err := json.Marshal(stdoutLine{Recording: w.name, Cast: bytes.TrimSuffix(line, []byte("\n"))})
+	if err != nil {
+		return 0, err
+	}
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	if _, err := w.sink.out.Write(append(wrapped, '\n')); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+// NewSink returns the sink of the given kind ("stdout", "pvc" or "s3"). Recordings are written to dir for the pvc
+// sink, and buffered there until they are uploaded for the s3 sink.
+func NewSink(kind, dir string, s3 S3Options) (Sink, error) {
+	switch kind {
+	case "stdout":
+		return &stdoutSink{out: os.Stdout}, nil
+	case "pvc":
+		return &dirSink{dir: dir}, nil
+	case "s3":
+		return newS3Sink(dir, s3)
+	default:
+		return nil, fmt.Errorf("unsupported recording sink %q", kind)
+	}
+}
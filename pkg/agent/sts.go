@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AssumeRoleOptions request temporary credentials from an AWS STS-compatible endpoint
+type AssumeRoleOptions struct {
+	Endpoint string
+	Region   string
+	// Credentials of the caller, which must be allowed to assume the role
+	Credentials S3Credentials
+	RoleARN     string
+	SessionName string
+	// Policy further restricts the permissions of the role for the issued credentials, if set
+	Policy   string
+	Duration time.Duration
+}
+
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+// AssumeRole returns temporary credentials for a role and when they expire
+func AssumeRole(opts AssumeRoleOptions) (S3Credentials, time.Time, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {opts.RoleARN},
+		"RoleSessionName": {opts.SessionName},
+		"DurationSeconds": {strconv.Itoa(int(opts.Duration.Seconds()))},
+	}
+	if opts.Policy != "" {
+		form.Set("Policy", opts.Policy)
+	}
+	body := form.Encode()
+	req, err := http.NewRequest(http.MethodPost, opts.Endpoint, strings.NewReader(body))
+	if err != nil {
+		return S3Credentials{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	hash := sha256.Sum256([]byte(body))
+	signV4(req, hex.EncodeToString(hash[:]), opts.Region, "sts", opts.Credentials, time.Now().UTC())
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return S3Credentials{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return S3Credentials{}, time.Time{}, fmt.Errorf("assuming role %s failed with %s: %s", opts.RoleARN, resp.Status, message)
+	}
+	result := &assumeRoleResponse{}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(result); err != nil {
+		return S3Credentials{}, time.Time{}, fmt.Errorf("invalid response assuming role %s: %s", opts.RoleARN, err)
+	}
+	creds := result.Credentials
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return S3Credentials{}, time.Time{}, fmt.Errorf("no credentials returned assuming role %s", opts.RoleARN)
+	}
+	return S3Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}, creds.Expiration, nil
+}
+
+// GetUploadPolicy returns a session policy only allowing objects to be put in bucket below prefix
+func GetUploadPolicy(bucket, prefix string) string {
+	return fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:PutObject"],`+
+		`"Resource":["arn:aws:s3:::%s/%s/*"]}]}`, bucket, prefix)
+}
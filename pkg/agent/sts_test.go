@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssumeRole(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if r.Form.Get("Action") != "AssumeRole" || r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/upload" ||
+			r.Form.Get("DurationSeconds") != "3600" || r.Form.Get("Policy") != GetUploadPolicy("recordings", "ns/shell/id") {
+			t.Errorf("unexpected request %v", r.Form)
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/sts/aws4_request") {
+			t.Errorf("request is not signed for STS: %s", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIATEMP</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2019-11-09T13:34:41Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`))
+	}))
+	defer server.Close()
+
+	creds, expiration, err := AssumeRole(AssumeRoleOptions{
+		Endpoint:    server.URL,
+		Region:      "us-east-1",
+		Credentials: S3Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "key"},
+		RoleARN:     "arn:aws:iam::123456789012:role/upload",
+		SessionName: "cloudshell-id",
+		Policy:      GetUploadPolicy("recordings", "ns/shell/id"),
+		Duration:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := S3Credentials{AccessKeyID: "ASIATEMP", SecretAccessKey: "secret", SessionToken: "token"}
+	if creds != expected {
+		t.Errorf("expected %+v, got %+v", expected, creds)
+	}
+	if !expiration.Equal(time.Date(2019, 11, 9, 13, 34, 41, 0, time.UTC)) {
+		t.Errorf("unexpected expiration %s", expiration)
+	}
+}
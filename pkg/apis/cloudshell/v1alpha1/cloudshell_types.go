@@ -1,6 +1,9 @@
 package v1alpha1
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -8,6 +11,246 @@ import (
 // +k8s:openapi-gen=true
 type CloudShellSpec struct {
 	Image string `json:"image"`
+	// Network configures network access for the shell. If unset, operator defaults are used.
+	// +optional
+	Network *NetworkSpec `json:"network,omitempty"`
+	// Scheduling configures where the shell pod is scheduled. Operator defaults take precedence, and only settings
+	// allowed by the operator configuration may be requested.
+	// +optional
+	Scheduling *SchedulingSpec `json:"scheduling,omitempty"`
+	// Sidecars are additional containers added to the shell pod. Names must not collide with the containers managed
+	// by the operator (shell-host, machine-exec, oauth-proxy). Sidecars run with the operator's security profile and
+	// may not set a security context, so they cannot be granted capabilities such as NET_ADMIN.
+	// +optional
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+	// InitContainers are run before the shell starts, after any init containers managed by the operator. Like
+	// sidecars, they may not set a security context.
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// Volumes are additional volumes added to the shell pod, for use by VolumeMounts, sidecars and init containers.
+	// Only emptyDir, configMap, downwardAPI and persistentVolumeClaim volumes are allowed, and they may not refer to
+	// resources managed by the operator, whose names start with "cloudshell-". The user creating the CloudShell must be
+	// allowed to read the ConfigMaps and PersistentVolumeClaims used by volumes, and the ConfigMaps and Secrets used in
+	// the environment of sidecars and init containers.
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// VolumeMounts are added to the shell-host container
+	// +optional
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	// Projects are git repositories cloned into the shell's projects directory before the shell starts. Existing
+	// clones are left untouched. The user creating the CloudShell must be allowed to read their credentials Secrets.
+	// +optional
+	Projects []Project `json:"projects,omitempty"`
+	// Dotfiles are configuration files installed into the shell's home directory at startup. If unset, the owner's
+	// default dotfiles ConfigMap is used, if the operator is configured with one and it exists. The user creating the
+	// CloudShell must be allowed to read the ConfigMap or Secrets set here.
+	// +optional
+	Dotfiles *DotfilesSource `json:"dotfiles,omitempty"`
+	// Credentials are Secrets made available in the shell, at well-known paths in the home directory or as
+	// environment variables. The user creating the CloudShell must be allowed to read the Secrets. Secrets that do
+	// not exist are left out and reported in the CredentialsAvailable condition.
+	// +optional
+	Credentials []Credential `json:"credentials,omitempty"`
+	// DisableServiceAccountToken removes the ServiceAccount token and kubeconfig from the shell container, for
+	// shells that do not need API access. The operator's sidecars keep their token.
+	// +optional
+	DisableServiceAccountToken bool `json:"disableServiceAccountToken,omitempty"`
+	// Sessions enables named terminal sessions that survive reconnects, using tmux in the shell container. Terminals
+	// opened with the default shell attach to the session "main", so reconnecting reattaches to it; other sessions
+	// are attached to by running "/var/run/cloudshell/sessions/session <name>". If the shell image does not provide
+	// tmux, terminals fall back to a plain shell.
+	// +optional
+	Sessions *SessionsSpec `json:"sessions,omitempty"`
+	// Audit configures the recording of terminal sessions. Whether sessions are recorded is subject to the
+	// operator's audit policy, which may require recording for all shells or disallow it.
+	// +optional
+	Audit *AuditSpec `json:"audit,omitempty"`
+	// TTL is the maximum lifetime of the shell from its creation, such as "8h". It is capped by the operator's
+	// maximum lifetime. When the shell expires, it is deleted or stopped according to the operator's expiry policy.
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// ImageUpdatePolicy determines whether the shell follows the tag in Image. The tag is resolved to a digest,
+	// which the shell runs until: never (Never), the shell is stopped or restarted (OnRestart), or the shell is idle
+	// (Automatic). If unset, Image is used as written.
+	// +kubebuilder:validation:Enum=Never;OnRestart;Automatic
+	// +optional
+	ImageUpdatePolicy ImageUpdatePolicy `json:"imageUpdatePolicy,omitempty"`
+	// Storage configures snapshots of the shell's home directory, which must be persistent
+	// +optional
+	Storage *StorageSpec `json:"storage,omitempty"`
+}
+
+// StorageSpec configures snapshots of a shell's home directory
+type StorageSpec struct {
+	// FromSnapshot is the name of a ready CloudShellSnapshot, in the CloudShell's namespace, that the home directory
+	// is restored from when it is created. The snapshot must have been taken of a shell with the same owner.
+	// +optional
+	FromSnapshot string `json:"fromSnapshot,omitempty"`
+	// SnapshotInterval takes a CloudShellSnapshot of the home directory at this interval, such as "24h"
+	// +optional
+	SnapshotInterval *metav1.Duration `json:"snapshotInterval,omitempty"`
+	// SnapshotsToKeep is the number of scheduled snapshots kept; older ones are deleted. Defaults to 3.
+	// +optional
+	SnapshotsToKeep int32 `json:"snapshotsToKeep,omitempty"`
+}
+
+// ImageUpdatePolicy determines when a shell picks up a new image pushed to its tag
+type ImageUpdatePolicy string
+
+const (
+	// ImageUpdateNever runs the digest the tag resolved to when the shell was created, or when Image last changed
+	ImageUpdateNever ImageUpdatePolicy = "Never"
+	// ImageUpdateOnRestart resolves the tag again whenever the shell is not running, so that it starts with the
+	// newest image
+	ImageUpdateOnRestart ImageUpdatePolicy = "OnRestart"
+	// ImageUpdateAutomatic also restarts a running shell with the newest image once it is idle. It requires the
+	// operator to track terminal activity.
+	ImageUpdateAutomatic ImageUpdatePolicy = "Automatic"
+)
+
+// AuditSpec configures the recording of terminal sessions
+type AuditSpec struct {
+	// Enabled records the input and output of every terminal opened in the shell, along with the user who opened it
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// SessionsSpec configures named terminal sessions
+type SessionsSpec struct {
+	// MaxSessions is the maximum number of concurrent sessions; defaults to 5
+	// +optional
+	MaxSessions int32 `json:"maxSessions,omitempty"`
+	// Scrollback is the number of lines of history kept for each session; defaults to 10000
+	// +optional
+	Scrollback int32 `json:"scrollback,omitempty"`
+}
+
+// CredentialType determines how a credential is made available in the shell
+type CredentialType string
+
+const (
+	// KubeconfigCredential links the Secret's "config" key to ~/.kube/config
+	KubeconfigCredential CredentialType = "kubeconfig"
+	// DockerCredential links the Secret's ".dockerconfigjson" key to ~/.docker/config.json
+	DockerCredential CredentialType = "docker"
+	// AWSCredential links the Secret's "credentials" key to ~/.aws/credentials
+	AWSCredential CredentialType = "aws"
+	// FileCredential links a key of the Secret to Path
+	FileCredential CredentialType = "file"
+	// EnvCredential exposes each key of the Secret as an environment variable
+	EnvCredential CredentialType = "env"
+)
+
+// Credential is a Secret made available in the shell
+type Credential struct {
+	// Name identifies the credential
+	Name string `json:"name"`
+	// Secret is the name of a Secret in the namespace the shell runs in
+	Secret string `json:"secret"`
+	// Type is one of kubeconfig, docker, aws, file, or env
+	Type CredentialType `json:"type"`
+	// Key is the key in the Secret to use, overriding the default for the credential type. Required for file
+	// credentials; not used for env credentials.
+	// +optional
+	Key string `json:"key,omitempty"`
+	// Path is where the key is linked, relative to the home directory, overriding the default for the credential
+	// type. Required for file credentials; not used for env credentials.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// EnvPrefix is prepended to the names of environment variables for env credentials
+	// +optional
+	EnvPrefix string `json:"envPrefix,omitempty"`
+}
+
+// DotfilesSource is where a shell's dotfiles come from. Exactly one field must be set.
+type DotfilesSource struct {
+	// Git is a repository whose contents are copied into the home directory. If the repository contains an
+	// executable install.sh, it is run instead.
+	// +optional
+	Git *GitSource `json:"git,omitempty"`
+	// ConfigMap is the name of a ConfigMap in the namespace the shell runs in. Each key is linked into the home
+	// directory, so changes to existing keys are visible in running shells; adding or removing keys restarts the
+	// shell.
+	// +optional
+	ConfigMap string `json:"configMap,omitempty"`
+	// Secret is the name of a Secret in the namespace the shell runs in, used like ConfigMap for dotfiles that
+	// contain credentials
+	// +optional
+	Secret string `json:"secret,omitempty"`
+}
+
+// Project is a git repository cloned into a shell
+type Project struct {
+	// Name identifies the project
+	Name string `json:"name"`
+	// Path is the clone destination relative to the projects directory; defaults to Name
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Git is the repository to clone
+	Git GitSource `json:"git"`
+}
+
+// GitSource is a git repository to clone
+type GitSource struct {
+	// URL of the repository, using https or ssh
+	URL string `json:"url"`
+	// Ref is the branch, tag, or commit to check out; defaults to the repository's default branch
+	// +optional
+	Ref string `json:"ref,omitempty"`
+	// CredentialsSecret is the name of a Secret in the namespace the shell runs in, holding either "username" and
+	// "password" (or token) keys for https, or an "ssh-privatekey" key (and optionally "known_hosts") for ssh.
+	// +optional
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+// SchedulingSpec configures scheduling of the shell pod. Topology spread constraints are not supported, as they
+// are not available in the Kubernetes API version the operator is built against.
+type SchedulingSpec struct {
+	// NodeSelector is merged with the operator's default node selector. Keys set by the operator cannot be changed.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations are added to the operator's default tolerations. Only tolerations allowed by the operator
+	// configuration may be requested.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity is used if the operator sets no default affinity; it cannot be set otherwise
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// PriorityClassName replaces the operator's default priority class. Only the default and priority classes allowed
+	// by the operator configuration may be requested.
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// RuntimeClassName selects a container runtime (e.g. gVisor or Kata) for sandboxing the shell. It replaces the
+	// operator's default runtime class; only the default and runtime classes allowed by the operator configuration may
+	// be requested.
+	// +optional
+	RuntimeClassName *string `json:"runtimeClassName,omitempty"`
+}
+
+// NetworkSpec configures the NetworkPolicy generated for a CloudShell
+type NetworkSpec struct {
+	// Egress configures outbound traffic from the shell. Fields that are unset use operator defaults, which fields
+	// that are set can only narrow.
+	// +optional
+	Egress *EgressPolicy `json:"egress,omitempty"`
+}
+
+// EgressPolicy defines which destinations a shell may connect to
+type EgressPolicy struct {
+	// AllowDNS allows DNS lookups
+	// +optional
+	AllowDNS *bool `json:"allowDNS,omitempty"`
+	// AllowAPIServer allows connections to the Kubernetes API server
+	// +optional
+	AllowAPIServer *bool `json:"allowAPIServer,omitempty"`
+	// AllowedCIDRs lists destination CIDRs the shell may connect to. Use 0.0.0.0/0 to allow all destinations
+	// except those in DeniedCIDRs. In a CloudShell, each CIDR must be within the operator's allowed CIDRs.
+	// +optional
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// DeniedCIDRs lists destination CIDRs excluded from AllowedCIDRs, e.g. cloud metadata endpoints. In a
+	// CloudShell, they are denied in addition to the operator's denied CIDRs.
+	// +optional
+	DeniedCIDRs []string `json:"deniedCIDRs,omitempty"`
 }
 
 // CloudShellStatus defines the observed state of CloudShell
@@ -16,8 +259,176 @@ type CloudShellStatus struct {
 	Id    string `json:"id"`
 	Ready bool   `json:"ready"`
 	Url   string `json:"url"`
+	// Conditions describe the state of individual aspects of the shell
+	// +optional
+	Conditions []CloudShellCondition `json:"conditions,omitempty"`
+	// Sessions lists the active terminal sessions, if sessions are enabled
+	// +optional
+	Sessions []SessionStatus `json:"sessions,omitempty"`
+	// StartedAt is the time the shell last became ready. It is unset while the shell is not running.
+	// +optional
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
+	// RunningSeconds is the running time accumulated over previous runs of the shell, excluding the current run
+	// since StartedAt
+	// +optional
+	RunningSeconds int64 `json:"runningSeconds,omitempty"`
+	// Requests are the resources reserved for the shell's pod during the current run: the requests of its containers,
+	// or of its largest init container if that is larger
+	// +optional
+	Requests corev1.ResourceList `json:"requests,omitempty"`
+	// Usage is the resources reserved for the shell multiplied by the time they were reserved for, accumulated over
+	// previous runs of the shell, excluding the current run since StartedAt
+	// +optional
+	Usage ResourceUsage `json:"usage,omitempty"`
+	// LastActivityTime is the last time a user typed in a terminal of the shell, if the operator tracks activity
+	// +optional
+	LastActivityTime *metav1.Time `json:"lastActivityTime,omitempty"`
+	// ExpiresAt is the time the shell expires, if its lifetime is limited by spec.ttl or by the operator
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Image is the digest the shell's image was resolved to, if spec.imageUpdatePolicy is set
+	// +optional
+	Image *ImageStatus `json:"image,omitempty"`
+	// LastRestartRequest is the value of the restart-requested-at annotation the shell was last restarted for
+	// +optional
+	LastRestartRequest string `json:"lastRestartRequest,omitempty"`
+	// LastResetRequest is the value of the reset-requested-at annotation the shell's home directory was last reset
+	// for
+	// +optional
+	LastResetRequest string `json:"lastResetRequest,omitempty"`
+	// Pool is the name of the CloudShellPool the shell was claimed from, if any
+	// +optional
+	Pool string `json:"pool,omitempty"`
+	// LastScheduledSnapshot is the last CloudShellSnapshot taken on the schedule in spec.storage.snapshotInterval
+	// +optional
+	LastScheduledSnapshot *ScheduledSnapshotStatus `json:"lastScheduledSnapshot,omitempty"`
+}
+
+// GetRunningTime returns the total time the shell has been running, including the current run
+func (s *CloudShellStatus) GetRunningTime(now time.Time) time.Duration {
+	running := time.Duration(s.RunningSeconds) * time.Second
+	if s.StartedAt != nil && now.After(s.StartedAt.Time) {
+		running += now.Sub(s.StartedAt.Time)
+	}
+	return running
+}
+
+// GetUsage returns the resources reserved for the shell multiplied by its running time, including the current run
+func (s *CloudShellStatus) GetUsage(now time.Time) ResourceUsage {
+	usage := s.Usage
+	if s.StartedAt != nil && now.After(s.StartedAt.Time) {
+		usage.Add(s.Requests, int64(now.Sub(s.StartedAt.Time)/time.Second))
+	}
+	return usage
+}
+
+// ResourceUsage is the resources reserved for a shell multiplied by the time they were reserved for
+type ResourceUsage struct {
+	// CPUMillicoreSeconds is requested CPU in millicores multiplied by seconds
+	// +optional
+	CPUMillicoreSeconds int64 `json:"cpuMillicoreSeconds,omitempty"`
+	// MemoryMiBSeconds is requested memory in MiB multiplied by seconds
+	// +optional
+	MemoryMiBSeconds int64 `json:"memoryMiBSeconds,omitempty"`
+}
+
+// Add adds the usage of requests reserved for a number of seconds
+func (u *ResourceUsage) Add(requests corev1.ResourceList, seconds int64) {
+	u.CPUMillicoreSeconds += requests.Cpu().MilliValue() * seconds
+	u.MemoryMiBSeconds += requests.Memory().Value() / (1 << 20) * seconds
+}
+
+// ImageStatus describes the digest a shell's image tag was resolved to
+type ImageStatus struct {
+	// Reference is the image the digest was resolved from, as written in spec.image
+	Reference string `json:"reference"`
+	// Digest is the digest the shell runs. It is empty until the reference is first resolved, and the shell runs the
+	// image as written meanwhile.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+	// LatestDigest is the digest the tag pointed to when last checked, if the shell does not run it yet
+	// +optional
+	LatestDigest string `json:"latestDigest,omitempty"`
+	// CheckedAt is the last time the tag was resolved
+	// +optional
+	CheckedAt *metav1.Time `json:"checkedAt,omitempty"`
+}
+
+// ScheduledSnapshotStatus describes a CloudShellSnapshot taken on a shell's schedule
+type ScheduledSnapshotStatus struct {
+	// Name is the name of the CloudShellSnapshot
+	Name string `json:"name"`
+	// CreatedAt is the time the snapshot was created
+	CreatedAt metav1.Time `json:"createdAt"`
+}
+
+// SessionStatus describes an active terminal session
+type SessionStatus struct {
+	Name string `json:"name"`
+	// Attached is the number of terminals attached to the session
+	Attached int32 `json:"attached"`
+	// CreatedAt is the time the session was created
+	// +optional
+	CreatedAt metav1.Time `json:"createdAt,omitempty"`
+}
+
+// CloudShellConditionType is a type of condition reported in a CloudShell's status
+type CloudShellConditionType string
+
+const (
+	// Ready reports whether the shell's workload is available. Its reason is Starting until the shell is first
+	// ready, Unavailable if it stops being available afterwards, Stopped if the shell expired and was stopped,
+	// QuotaExceeded while the shell waits for a quota on running shells, Resetting while its home directory is
+	// recreated, WaitingForSnapshot while the snapshot in spec.storage.fromSnapshot cannot be restored from, and
+	// Restarting until a stopped shell is ready again.
+	Ready CloudShellConditionType = "Ready"
+	// ProjectsCloned reports whether the projects in spec.projects were cloned successfully
+	ProjectsCloned CloudShellConditionType = "ProjectsCloned"
+	// DotfilesInstalled reports whether the shell's dotfiles were installed successfully
+	DotfilesInstalled CloudShellConditionType = "DotfilesInstalled"
+	// CredentialsAvailable reports whether all Secrets in spec.credentials exist and may be read by the owner
+	CredentialsAvailable CloudShellConditionType = "CredentialsAvailable"
+	// Audited reports whether terminal sessions are recorded
+	Audited CloudShellConditionType = "Audited"
+	// Expiring is set when the shell is about to reach its maximum lifetime, with reason ExpiresSoon, and once the
+	// shell has expired and was stopped, with reason Expired
+	Expiring CloudShellConditionType = "Expiring"
+	// QuotaExceeded reports whether the shell is kept stopped because a quota on running shells is reached. It is
+	// only set when the operator enforces quotas.
+	QuotaExceeded CloudShellConditionType = "QuotaExceeded"
+	// ImageResolved reports whether the shell's image tag could be resolved to a digest, if spec.imageUpdatePolicy is
+	// set. While it is False, the shell keeps running the last resolved digest, or the image as written.
+	ImageResolved CloudShellConditionType = "ImageResolved"
+)
+
+// CloudShellCondition describes the state of an aspect of a CloudShell
+type CloudShellCondition struct {
+	Type   CloudShellConditionType `json:"type"`
+	Status corev1.ConditionStatus  `json:"status"`
+	// Reason is a machine-readable explanation for the condition's status
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message is a human-readable explanation for the condition's status
+	// +optional
+	Message string `json:"message,omitempty"`
+	// LastTransitionTime is the last time the condition's status changed
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
 }
 
+const (
+	// OwnerAnnotation holds the name of the user a CloudShell belongs to. It is set by the operator's owner webhook
+	// to the user who created the CloudShell, and cannot be changed.
+	OwnerAnnotation = "cloudshell.eclipse.org/owner"
+	// IDLabel holds the id of the CloudShell that a shell's resources belong to
+	IDLabel = "cloudshell.id"
+	// RestartRequestedAnnotation restarts the shell when it is set to a new value, such as the current time
+	RestartRequestedAnnotation = "cloudshell.eclipse.org/restart-requested-at"
+	// ResetRequestedAnnotation deletes the shell's home directory and restarts the shell when it is set to a new
+	// value, such as the current time
+	ResetRequestedAnnotation = "cloudshell.eclipse.org/reset-requested-at"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // CloudShell is the Schema for the cloudshells API
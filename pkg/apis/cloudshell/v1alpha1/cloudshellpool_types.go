@@ -0,0 +1,56 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PoolLabel is set on the CloudShells of a pool to the name of the pool
+const PoolLabel = "cloudshell.eclipse.org/pool"
+
+// CloudShellPoolSpec defines the desired state of CloudShellPool
+// +k8s:openapi-gen=true
+type CloudShellPoolSpec struct {
+	// Size is the number of unclaimed shells the pool keeps running, up to the operator's configured maximum
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	Size int32 `json:"size"`
+	// Template is the spec of the pool's shells. A CloudShell created in the pool's namespace with the same spec
+	// claims a running shell from the pool instead of starting its own.
+	Template CloudShellSpec `json:"template"`
+}
+
+// CloudShellPoolStatus defines the observed state of CloudShellPool
+// +k8s:openapi-gen=true
+type CloudShellPoolStatus struct {
+	// Ready is the number of unclaimed shells that are ready to be claimed
+	Ready int32 `json:"ready"`
+	// Starting is the number of unclaimed shells that are not ready yet
+	Starting int32 `json:"starting"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CloudShellPool keeps shells running ahead of time, so that new CloudShells start instantly
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=cloudshellpools,scope=Namespaced
+type CloudShellPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CloudShellPoolSpec   `json:"spec,omitempty"`
+	Status CloudShellPoolStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CloudShellPoolList contains a list of CloudShellPool
+type CloudShellPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CloudShellPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CloudShellPool{}, &CloudShellPoolList{})
+}
@@ -0,0 +1,75 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ScheduledSnapshotLabel is set on the CloudShellSnapshots taken on a CloudShell's schedule to the CloudShell's name
+const ScheduledSnapshotLabel = "cloudshell.eclipse.org/scheduled-for"
+
+// CloudShellSnapshotSpec defines the desired state of CloudShellSnapshot
+// +k8s:openapi-gen=true
+type CloudShellSnapshotSpec struct {
+	// Shell is the name of the CloudShell, in the snapshot's namespace, whose home directory is snapshotted. The
+	// shell must use persistent home directories and be owned by the user creating the snapshot. It cannot be
+	// changed.
+	Shell string `json:"shell"`
+	// VolumeSnapshotClassName is the class of the VolumeSnapshot taken; the cluster default is used if unset
+	// +optional
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// CloudShellSnapshotStatus defines the observed state of CloudShellSnapshot
+// +k8s:openapi-gen=true
+type CloudShellSnapshotStatus struct {
+	// Ready is true once the snapshot can be restored from
+	Ready bool `json:"ready"`
+	// VolumeSnapshot is the name of the VolumeSnapshot holding the snapshot
+	// +optional
+	VolumeSnapshot string `json:"volumeSnapshot,omitempty"`
+	// Namespace is the namespace of the VolumeSnapshot, which is the namespace the shell runs in
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Owner is the owner of the shell when it was snapshotted. Only shells with the same owner can be restored from
+	// the snapshot.
+	// +optional
+	Owner string `json:"owner,omitempty"`
+	// CreationTime is the time the snapshot was taken
+	// +optional
+	CreationTime *metav1.Time `json:"creationTime,omitempty"`
+	// RestoreSize is the minimum size of a volume restored from the snapshot
+	// +optional
+	RestoreSize *resource.Quantity `json:"restoreSize,omitempty"`
+	// Error describes why the snapshot could not be taken
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CloudShellSnapshot is a snapshot of a CloudShell's home directory, taken with a CSI VolumeSnapshot. New
+// CloudShells can start from it with spec.storage.fromSnapshot.
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=cloudshellsnapshots,scope=Namespaced
+type CloudShellSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CloudShellSnapshotSpec   `json:"spec,omitempty"`
+	Status CloudShellSnapshotStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CloudShellSnapshotList contains a list of CloudShellSnapshot
+type CloudShellSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CloudShellSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CloudShellSnapshot{}, &CloudShellSnapshotList{})
+}
@@ -11,9 +11,15 @@ import (
 
 func GetOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
 	return map[string]common.OpenAPIDefinition{
-		"./pkg/apis/cloudshell/v1alpha1.CloudShell":       schema_pkg_apis_cloudshell_v1alpha1_CloudShell(ref),
-		"./pkg/apis/cloudshell/v1alpha1.CloudShellSpec":   schema_pkg_apis_cloudshell_v1alpha1_CloudShellSpec(ref),
-		"./pkg/apis/cloudshell/v1alpha1.CloudShellStatus": schema_pkg_apis_cloudshell_v1alpha1_CloudShellStatus(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShell":               schema_pkg_apis_cloudshell_v1alpha1_CloudShell(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellPool":           schema_pkg_apis_cloudshell_v1alpha1_CloudShellPool(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellPoolSpec":       schema_pkg_apis_cloudshell_v1alpha1_CloudShellPoolSpec(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellPoolStatus":     schema_pkg_apis_cloudshell_v1alpha1_CloudShellPoolStatus(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshot":       schema_pkg_apis_cloudshell_v1alpha1_CloudShellSnapshot(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshotSpec":   schema_pkg_apis_cloudshell_v1alpha1_CloudShellSnapshotSpec(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshotStatus": schema_pkg_apis_cloudshell_v1alpha1_CloudShellSnapshotStatus(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellSpec":           schema_pkg_apis_cloudshell_v1alpha1_CloudShellSpec(ref),
+		"./pkg/apis/cloudshell/v1alpha1.CloudShellStatus":         schema_pkg_apis_cloudshell_v1alpha1_CloudShellStatus(ref),
 	}
 }
 
@@ -61,6 +67,242 @@ func schema_pkg_apis_cloudshell_v1alpha1_CloudShell(ref common.ReferenceCallback
 	}
 }
 
+func schema_pkg_apis_cloudshell_v1alpha1_CloudShellPool(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "CloudShellPool keeps shells running ahead of time, so that new CloudShells start instantly",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("./pkg/apis/cloudshell/v1alpha1.CloudShellPoolSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("./pkg/apis/cloudshell/v1alpha1.CloudShellPoolStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"./pkg/apis/cloudshell/v1alpha1.CloudShellPoolSpec", "./pkg/apis/cloudshell/v1alpha1.CloudShellPoolStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_cloudshell_v1alpha1_CloudShellPoolSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "CloudShellPoolSpec defines the desired state of CloudShellPool",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"size": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Size is the number of unclaimed shells the pool keeps running, up to the operator's configured maximum",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"template": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Template is the spec of the pool's shells. A CloudShell created in the pool's namespace with the same spec claims a running shell from the pool instead of starting its own.",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.CloudShellSpec"),
+						},
+					},
+				},
+				Required: []string{"size", "template"},
+			},
+		},
+		Dependencies: []string{
+			"./pkg/apis/cloudshell/v1alpha1.CloudShellSpec"},
+	}
+}
+
+func schema_pkg_apis_cloudshell_v1alpha1_CloudShellPoolStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "CloudShellPoolStatus defines the observed state of CloudShellPool",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"ready": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Ready is the number of unclaimed shells that are ready to be claimed",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"starting": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Starting is the number of unclaimed shells that are not ready yet",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+				},
+				Required: []string{"ready", "starting"},
+			},
+		},
+	}
+}
+
+func schema_pkg_apis_cloudshell_v1alpha1_CloudShellSnapshot(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "CloudShellSnapshot is a snapshot of a CloudShell's home directory, taken with a CSI VolumeSnapshot. New CloudShells can start from it with spec.storage.fromSnapshot.",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshotSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshotStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshotSpec", "./pkg/apis/cloudshell/v1alpha1.CloudShellSnapshotStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_cloudshell_v1alpha1_CloudShellSnapshotSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "CloudShellSnapshotSpec defines the desired state of CloudShellSnapshot",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"shell": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Shell is the name of the CloudShell, in the snapshot's namespace, whose home directory is snapshotted. The shell must use persistent home directories and be owned by the user creating the snapshot. It cannot be changed.",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"volumeSnapshotClassName": {
+						SchemaProps: spec.SchemaProps{
+							Description: "VolumeSnapshotClassName is the class of the VolumeSnapshot taken; the cluster default is used if unset",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"shell"},
+			},
+		},
+	}
+}
+
+func schema_pkg_apis_cloudshell_v1alpha1_CloudShellSnapshotStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "CloudShellSnapshotStatus defines the observed state of CloudShellSnapshot",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"ready": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Ready is true once the snapshot can be restored from",
+							Type:        []string{"boolean"},
+							Format:      "",
+						},
+					},
+					"volumeSnapshot": {
+						SchemaProps: spec.SchemaProps{
+							Description: "VolumeSnapshot is the name of the VolumeSnapshot holding the snapshot",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"namespace": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Namespace is the namespace of the VolumeSnapshot, which is the namespace the shell runs in",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"owner": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Owner is the owner of the shell when it was snapshotted. Only shells with the same owner can be restored from the snapshot.",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"creationTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "CreationTime is the time the snapshot was taken",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"restoreSize": {
+						SchemaProps: spec.SchemaProps{
+							Description: "RestoreSize is the minimum size of a volume restored from the snapshot",
+							Ref:         ref("k8s.io/apimachinery/pkg/api/resource.Quantity"),
+						},
+					},
+					"error": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Error describes why the snapshot could not be taken",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"ready"},
+			},
+		},
+		Dependencies: []string{
+			"k8s.io/apimachinery/pkg/api/resource.Quantity", "k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
+	}
+}
+
 func schema_pkg_apis_cloudshell_v1alpha1_CloudShellSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
 	return common.OpenAPIDefinition{
 		Schema: spec.Schema{
@@ -74,10 +316,146 @@ func schema_pkg_apis_cloudshell_v1alpha1_CloudShellSpec(ref common.ReferenceCall
 							Format: "",
 						},
 					},
+					"network": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Network configures network access for the shell. If unset, operator defaults are used.",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.NetworkSpec"),
+						},
+					},
+					"scheduling": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Scheduling configures where the shell pod is scheduled. Operator defaults take precedence, and only settings allowed by the operator configuration may be requested.",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.SchedulingSpec"),
+						},
+					},
+					"sidecars": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Sidecars are additional containers added to the shell pod. Names must not collide with the containers managed by the operator (shell-host, machine-exec, oauth-proxy). Sidecars run with the operator's security profile and may not set a security context, so they cannot be granted capabilities such as NET_ADMIN.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("k8s.io/api/core/v1.Container"),
+									},
+								},
+							},
+						},
+					},
+					"initContainers": {
+						SchemaProps: spec.SchemaProps{
+							Description: "InitContainers are run before the shell starts, after any init containers managed by the operator. Like sidecars, they may not set a security context.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("k8s.io/api/core/v1.Container"),
+									},
+								},
+							},
+						},
+					},
+					"volumes": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Volumes are additional volumes added to the shell pod, for use by VolumeMounts, sidecars and init containers. Only emptyDir, configMap, downwardAPI and persistentVolumeClaim volumes are allowed, and they may not refer to resources managed by the operator, whose names start with \"cloudshell-\". The user creating the CloudShell must be allowed to read the ConfigMaps and PersistentVolumeClaims used by volumes, and the ConfigMaps and Secrets used in the environment of sidecars and init containers.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("k8s.io/api/core/v1.Volume"),
+									},
+								},
+							},
+						},
+					},
+					"volumeMounts": {
+						SchemaProps: spec.SchemaProps{
+							Description: "VolumeMounts are added to the shell-host container",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("k8s.io/api/core/v1.VolumeMount"),
+									},
+								},
+							},
+						},
+					},
+					"projects": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Projects are git repositories cloned into the shell's projects directory before the shell starts. Existing clones are left untouched. The user creating the CloudShell must be allowed to read their credentials Secrets.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("./pkg/apis/cloudshell/v1alpha1.Project"),
+									},
+								},
+							},
+						},
+					},
+					"dotfiles": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Dotfiles are configuration files installed into the shell's home directory at startup. If unset, the owner's default dotfiles ConfigMap is used, if the operator is configured with one and it exists. The user creating the CloudShell must be allowed to read the ConfigMap or Secrets set here.",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.DotfilesSource"),
+						},
+					},
+					"credentials": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Credentials are Secrets made available in the shell, at well-known paths in the home directory or as environment variables. The user creating the CloudShell must be allowed to read the Secrets. Secrets that do not exist are left out and reported in the CredentialsAvailable condition.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("./pkg/apis/cloudshell/v1alpha1.Credential"),
+									},
+								},
+							},
+						},
+					},
+					"disableServiceAccountToken": {
+						SchemaProps: spec.SchemaProps{
+							Description: "DisableServiceAccountToken removes the ServiceAccount token and kubeconfig from the shell container, for shells that do not need API access. The operator's sidecars keep their token.",
+							Type:        []string{"boolean"},
+							Format:      "",
+						},
+					},
+					"sessions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Sessions enables named terminal sessions that survive reconnects, using tmux in the shell container. Terminals opened with the default shell attach to the session \"main\", so reconnecting reattaches to it; other sessions are attached to by running \"/var/run/cloudshell/sessions/session <name>\". If the shell image does not provide tmux, terminals fall back to a plain shell.",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.SessionsSpec"),
+						},
+					},
+					"audit": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Audit configures the recording of terminal sessions. Whether sessions are recorded is subject to the operator's audit policy, which may require recording for all shells or disallow it.",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.AuditSpec"),
+						},
+					},
+					"ttl": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TTL is the maximum lifetime of the shell from its creation, such as \"8h\". It is capped by the operator's maximum lifetime. When the shell expires, it is deleted or stopped according to the operator's expiry policy.",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Duration"),
+						},
+					},
+					"imageUpdatePolicy": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ImageUpdatePolicy determines whether the shell follows the tag in Image. The tag is resolved to a digest, which the shell runs until: never (Never), the shell is stopped or restarted (OnRestart), or the shell is idle (Automatic). If unset, Image is used as written.",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"storage": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Storage configures snapshots of the shell's home directory, which must be persistent",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.StorageSpec"),
+						},
+					},
 				},
 				Required: []string{"image"},
 			},
 		},
+		Dependencies: []string{
+			"./pkg/apis/cloudshell/v1alpha1.AuditSpec", "./pkg/apis/cloudshell/v1alpha1.Credential", "./pkg/apis/cloudshell/v1alpha1.DotfilesSource", "./pkg/apis/cloudshell/v1alpha1.NetworkSpec", "./pkg/apis/cloudshell/v1alpha1.Project", "./pkg/apis/cloudshell/v1alpha1.SchedulingSpec", "./pkg/apis/cloudshell/v1alpha1.SessionsSpec", "./pkg/apis/cloudshell/v1alpha1.StorageSpec", "k8s.io/api/core/v1.Container", "k8s.io/api/core/v1.Volume", "k8s.io/api/core/v1.VolumeMount", "k8s.io/apimachinery/pkg/apis/meta/v1.Duration"},
 	}
 }
 
@@ -106,9 +484,115 @@ func schema_pkg_apis_cloudshell_v1alpha1_CloudShellStatus(ref common.ReferenceCa
 							Format: "",
 						},
 					},
+					"conditions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Conditions describe the state of individual aspects of the shell",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("./pkg/apis/cloudshell/v1alpha1.CloudShellCondition"),
+									},
+								},
+							},
+						},
+					},
+					"sessions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Sessions lists the active terminal sessions, if sessions are enabled",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("./pkg/apis/cloudshell/v1alpha1.SessionStatus"),
+									},
+								},
+							},
+						},
+					},
+					"startedAt": {
+						SchemaProps: spec.SchemaProps{
+							Description: "StartedAt is the time the shell last became ready. It is unset while the shell is not running.",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"runningSeconds": {
+						SchemaProps: spec.SchemaProps{
+							Description: "RunningSeconds is the running time accumulated over previous runs of the shell, excluding the current run since StartedAt",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"requests": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Requests are the resources reserved for the shell's pod during the current run: the requests of its containers, or of its largest init container if that is larger",
+							Type:        []string{"object"},
+							AdditionalProperties: &spec.SchemaOrBool{
+								Allows: true,
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("k8s.io/apimachinery/pkg/api/resource.Quantity"),
+									},
+								},
+							},
+						},
+					},
+					"usage": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Usage is the resources reserved for the shell multiplied by the time they were reserved for, accumulated over previous runs of the shell, excluding the current run since StartedAt",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.ResourceUsage"),
+						},
+					},
+					"lastActivityTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastActivityTime is the last time a user typed in a terminal of the shell, if the operator tracks activity",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"expiresAt": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ExpiresAt is the time the shell expires, if its lifetime is limited by spec.ttl or by the operator",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"image": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Image is the digest the shell's image was resolved to, if spec.imageUpdatePolicy is set",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.ImageStatus"),
+						},
+					},
+					"lastRestartRequest": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastRestartRequest is the value of the restart-requested-at annotation the shell was last restarted for",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"lastResetRequest": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastResetRequest is the value of the reset-requested-at annotation the shell's home directory was last reset for",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"pool": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Pool is the name of the CloudShellPool the shell was claimed from, if any",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"lastScheduledSnapshot": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastScheduledSnapshot is the last CloudShellSnapshot taken on the schedule in spec.storage.snapshotInterval",
+							Ref:         ref("./pkg/apis/cloudshell/v1alpha1.ScheduledSnapshotStatus"),
+						},
+					},
 				},
 				Required: []string{"id", "ready", "url"},
 			},
 		},
+		Dependencies: []string{
+			"./pkg/apis/cloudshell/v1alpha1.CloudShellCondition", "./pkg/apis/cloudshell/v1alpha1.ImageStatus", "./pkg/apis/cloudshell/v1alpha1.ResourceUsage", "./pkg/apis/cloudshell/v1alpha1.ScheduledSnapshotStatus", "./pkg/apis/cloudshell/v1alpha1.SessionStatus", "k8s.io/apimachinery/pkg/api/resource.Quantity", "k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
 	}
 }
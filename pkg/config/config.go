@@ -0,0 +1,997 @@
+// Package config holds operator-level configuration for the cloudshell controller. Configuration is read once at
+// startup from a ConfigMap in the operator's namespace; changes to the ConfigMap require an operator restart.
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// ConfigMapNameEnvVar is the environment variable used to override the name of the controller ConfigMap
+	ConfigMapNameEnvVar = "CONTROLLER_CONFIG_MAP_NAME"
+	// OperatorImageEnvVar is the environment variable holding the operator's image, used by default for the agent
+	OperatorImageEnvVar = "OPERATOR_IMAGE"
+	// ServiceAccountEnvVar is the environment variable holding the name of the operator's ServiceAccount, which
+	// identifies the operator's own requests in admission webhooks
+	ServiceAccountEnvVar  = "OPERATOR_SERVICE_ACCOUNT"
+	defaultConfigMapName  = "cloudshell-operator-config"
+	defaultServiceAccount = "cloudshell-operator"
+
+	routingSuffixKey      = "cloudshell.routing.suffix"
+	ingressClassKey       = "cloudshell.routing.ingress.class"
+	ingressAnnotationsKey = "cloudshell.routing.ingress.annotations"
+	tlsProviderKey        = "cloudshell.tls.provider"
+	certIssuerNameKey     = "cloudshell.tls.certmanager.issuer.name"
+	certIssuerKindKey     = "cloudshell.tls.certmanager.issuer.kind"
+	namespaceSelectorKey  = "cloudshell.namespace.selector"
+	namespaceModeKey      = "cloudshell.namespace.mode"
+	namespaceFormatKey    = "cloudshell.namespace.format"
+	namespaceQuotaKey     = "cloudshell.namespace.quota.hard"
+	localQuotaKey         = "cloudshell.namespace.quota.local"
+	namespaceLimitKey     = "cloudshell.namespace.limits.default"
+	namespaceRequestKey   = "cloudshell.namespace.limits.defaultRequest"
+	routerSelectorKey     = "cloudshell.network.router.namespaceSelector"
+	operatorSelectorKey   = "cloudshell.network.operator.namespaceSelector"
+	egressDefaultKey      = "cloudshell.network.egress.default"
+	apiServerCIDRsKey     = "cloudshell.network.apiserver.cidrs"
+	securityProfileKey    = "cloudshell.security.profile"
+	schedulingDefaultKey  = "cloudshell.scheduling.default"
+	schedulingAllowedKey  = "cloudshell.scheduling.allowed"
+	gitImageKey           = "cloudshell.git.image"
+	dotfilesDefaultKey    = "cloudshell.dotfiles.default.configMap"
+	tokenExpirationKey    = "cloudshell.token.expirationSeconds"
+	tokenAudienceKey      = "cloudshell.token.audience"
+	agentImageKey         = "cloudshell.agent.image"
+	auditPolicyKey        = "cloudshell.audit.policy"
+	auditSinkKey          = "cloudshell.audit.sink"
+	auditClaimKey         = "cloudshell.audit.pvc.claimName"
+	auditS3EndpointKey    = "cloudshell.audit.s3.endpoint"
+	auditS3BucketKey      = "cloudshell.audit.s3.bucket"
+	auditS3RegionKey      = "cloudshell.audit.s3.region"
+	auditS3SecretKey      = "cloudshell.audit.s3.credentialsSecret"
+	auditS3RoleKey        = "cloudshell.audit.s3.roleARN"
+	auditS3STSKey         = "cloudshell.audit.s3.stsEndpoint"
+	activityTrackingKey   = "cloudshell.activity.tracking"
+	lifetimeMaxKey        = "cloudshell.lifetime.max"
+	lifetimeWarningKey    = "cloudshell.lifetime.warningPeriod"
+	expiryPolicyKey       = "cloudshell.lifetime.expiryPolicy"
+	quotaUserKey          = "cloudshell.quota.maxRunningPerUser"
+	quotaNamespaceKey     = "cloudshell.quota.maxRunningPerNamespace"
+	quotaClusterKey       = "cloudshell.quota.maxRunning"
+	quotaAdmissionKey     = "cloudshell.quota.admission"
+	poolMaxSizeKey        = "cloudshell.pool.maxSize"
+	machineExecImageKey   = "cloudshell.machineExec.image"
+	oauthProxyImageKey    = "cloudshell.oauthProxy.image"
+	prePullEnabledKey     = "cloudshell.prepull.enabled"
+	prePullSelectorKey    = "cloudshell.prepull.nodeSelector"
+	prePullImagesKey      = "cloudshell.prepull.images"
+	prePullAllowedKey     = "cloudshell.prepull.allowedImages"
+	prePullSecretKey      = "cloudshell.prepull.pullSecret"
+	workloadKindKey       = "cloudshell.workload.kind"
+	homeStorageSizeKey    = "cloudshell.home.storage.size"
+	homeStorageClassKey   = "cloudshell.home.storage.className"
+	imageCheckKey         = "cloudshell.imageUpdate.checkInterval"
+	imageIdleKey          = "cloudshell.imageUpdate.idlePeriod"
+	imagePullSecretKey    = "cloudshell.imageUpdate.pullSecret"
+	imageInsecureKey      = "cloudshell.imageUpdate.insecureRegistries"
+	imageAllowedKey       = "cloudshell.imageUpdate.allowedRegistries"
+	imageInternalKey      = "cloudshell.imageUpdate.internalRegistries"
+	defaultEgress         = `{"allowDNS": true, "allowAPIServer": true, "allowedCIDRs": ["0.0.0.0/0"], "deniedCIDRs": ["169.254.169.254/32"]}`
+	defaultNamespaceFmt   = "%s-cloudshell"
+	defaultQuota          = "pods=10,limits.memory=4Gi,limits.cpu=4"
+	defaultLimit          = "memory=512Mi,cpu=500m"
+	defaultRequest        = "memory=128Mi,cpu=100m"
+	openShiftRouterLabels = "network.openshift.io/policy-group=ingress"
+	// namespaceNameLabel is set to the name of every namespace by Kubernetes 1.21 and later
+	namespaceNameLabel    = "kubernetes.io/metadata.name"
+	defaultRoutingSuffix  = "192.168.42.191.nip.io"
+	defaultIngressClass   = "nginx"
+	defaultIngressAnns    = `{"nginx.ingress.kubernetes.io/backend-protocol": "HTTPS", "nginx.ingress.kubernetes.io/ssl-redirect": "true"}`
+	defaultCertIssuerKind = "ClusterIssuer"
+	defaultGitImage       = "docker.io/alpine/git:latest"
+	defaultTokenExpiry    = "3600"
+	defaultS3Region       = "us-east-1"
+	defaultLifetimeWarn   = "1h"
+	defaultMachineExec    = "docker.io/amisevsk/che-machine-exec:dev"
+	defaultOAuthProxy     = "openshift/oauth-proxy:latest"
+	defaultImageCheck     = "15m"
+	defaultImageIdle      = "30m"
+	defaultRegistries     = "docker.io,quay.io,ghcr.io,gcr.io,registry.k8s.io"
+	defaultPoolMaxSize    = "10"
+	// minTokenExpiry is the shortest expiration the API server accepts for projected tokens
+	minTokenExpiry = 600
+)
+
+// namespaceNameLabelVersion is the first Kubernetes version setting namespaceNameLabel
+var namespaceNameLabelVersion = version.MustParseGeneric("v1.21.0")
+
+// TLSProvider determines what issues the TLS certificates used by the auth proxy and external routing.
+type TLSProvider string
+
+const (
+	// TLSProviderAuto uses the OpenShift service CA on OpenShift and cert-manager elsewhere
+	TLSProviderAuto TLSProvider = "auto"
+	// TLSProviderOpenShift uses the OpenShift service CA via the serving-cert-secret-name annotation
+	TLSProviderOpenShift TLSProvider = "openshift"
+	// TLSProviderCertManager uses cert-manager Certificates issued by the configured Issuer/ClusterIssuer
+	TLSProviderCertManager TLSProvider = "cert-manager"
+)
+
+// NamespaceMode determines where the resources for a CloudShell are created.
+type NamespaceMode string
+
+const (
+	// NamespaceModeLocal creates shell resources in the CloudShell's own namespace
+	NamespaceModeLocal NamespaceMode = "local"
+	// NamespaceModePerUser creates shell resources in a dedicated namespace for the CloudShell's owner
+	NamespaceModePerUser NamespaceMode = "per-user"
+)
+
+// SecurityProfile is a preset of security settings applied to shell pods
+type SecurityProfile string
+
+const (
+	// SecurityProfileRestricted matches the Pod Security Standards "restricted" profile
+	SecurityProfileRestricted SecurityProfile = "restricted"
+	// SecurityProfileBaseline matches the Pod Security Standards "baseline" profile
+	SecurityProfileBaseline SecurityProfile = "baseline"
+	// SecurityProfileNone applies no security settings; pods run with the image and cluster defaults
+	SecurityProfileNone SecurityProfile = "none"
+)
+
+// AuditPolicy determines which CloudShells have their terminal sessions recorded
+type AuditPolicy string
+
+const (
+	// AuditPolicyDisabled records no sessions; CloudShells requesting audit are rejected
+	AuditPolicyDisabled AuditPolicy = "disabled"
+	// AuditPolicyOptional records the sessions of CloudShells that enable audit in their spec
+	AuditPolicyOptional AuditPolicy = "optional"
+	// AuditPolicyRequired records the sessions of all CloudShells
+	AuditPolicyRequired AuditPolicy = "required"
+)
+
+// AuditSink determines where session recordings are stored
+type AuditSink string
+
+const (
+	// AuditSinkStdout writes recordings to the agent's standard output, for cluster log collection
+	AuditSinkStdout AuditSink = "stdout"
+	// AuditSinkPVC writes recordings to a PersistentVolumeClaim in the shell's namespace
+	AuditSinkPVC AuditSink = "pvc"
+	// AuditSinkS3 uploads recordings to an S3-compatible object store when each session ends
+	AuditSinkS3 AuditSink = "s3"
+)
+
+// ExpiryPolicy determines what happens to a CloudShell when it reaches its maximum lifetime
+type ExpiryPolicy string
+
+const (
+	// ExpiryPolicyDelete deletes expired CloudShells
+	ExpiryPolicyDelete ExpiryPolicy = "delete"
+	// ExpiryPolicyStop scales expired shells down, keeping the CloudShell and its resources
+	ExpiryPolicyStop ExpiryPolicy = "stop"
+)
+
+// QuotaAdmission determines what happens to CloudShells created when a quota on running shells is reached
+type QuotaAdmission string
+
+const (
+	// QuotaAdmissionQueue accepts the CloudShell and keeps it stopped until the quota allows it to run
+	QuotaAdmissionQueue QuotaAdmission = "queue"
+	// QuotaAdmissionReject rejects the CloudShell in the operator's validating webhook
+	QuotaAdmissionReject QuotaAdmission = "reject"
+)
+
+// WorkloadKind is the kind of workload that runs shell pods
+type WorkloadKind string
+
+const (
+	// WorkloadKindDeployment runs shells in Deployments using the Recreate strategy, so that the old pod is stopped
+	// before a new one starts
+	WorkloadKindDeployment WorkloadKind = "Deployment"
+	// WorkloadKindStatefulSet runs shells in StatefulSets, which never run two pods for the same shell
+	WorkloadKindStatefulSet WorkloadKind = "StatefulSet"
+)
+
+// SchedulingAllowlist lists the scheduling settings that CloudShells may request in addition to the operator's
+// defaults
+type SchedulingAllowlist struct {
+	PriorityClassNames []string            `json:"priorityClassNames,omitempty"`
+	RuntimeClassNames  []string            `json:"runtimeClassNames,omitempty"`
+	Tolerations        []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+// ShellQuotas limit the number of CloudShells running at once. Zero means unlimited.
+type ShellQuotas struct {
+	PerUser      int
+	PerNamespace int
+	Total        int
+}
+
+var log = logf.Log.WithName("config")
+
+// ControllerCfg is the configuration used by controllers; it is populated by LoadControllerConfig
+var ControllerCfg = ControllerConfig{}
+
+type ControllerConfig struct {
+	configMap         *corev1.ConfigMap
+	operatorNamespace string
+	isOpenShift       bool
+	hasCertManager    bool
+	hasSnapshots      bool
+	hasNamespaceNames bool
+	tlsProvider       TLSProvider
+	ingressAnns       map[string]string
+	namespaceSelector labels.Selector
+	routerSelector    labels.Selector
+	operatorSelector  labels.Selector
+	watchNamespaces   []string
+	namespaceQuota    corev1.ResourceList
+	namespaceLimit    corev1.ResourceList
+	namespaceRequest  corev1.ResourceList
+	defaultEgress     v1alpha1.EgressPolicy
+	defaultScheduling v1alpha1.SchedulingSpec
+	allowedScheduling SchedulingAllowlist
+	tokenExpiration   int64
+	maxLifetime       time.Duration
+	lifetimeWarning   time.Duration
+	shellQuotas       ShellQuotas
+	poolMaxSize       int
+	prePullSelector   map[string]string
+	homeStorageSize   *resource.Quantity
+	imageCheck        time.Duration
+	imageIdle         time.Duration
+}
+
+// LoadControllerConfig reads the controller ConfigMap and detects optional cluster features (OpenShift routes,
+// cert-manager). A missing ConfigMap is not an error; defaults are used instead.
+func LoadControllerConfig(cfg *rest.Config) error {
+	if err := ControllerCfg.detectClusterFeatures(cfg); err != nil {
+		return err
+	}
+	if err := ControllerCfg.readConfigMap(cfg); err != nil {
+		return err
+	}
+	return ControllerCfg.validate()
+}
+
+func (c *ControllerConfig) readConfigMap(cfg *rest.Config) error {
+	namespace, err := k8sutil.GetOperatorNamespace()
+	if err != nil {
+		log.Info("Could not determine operator namespace; using default configuration", "error", err.Error())
+		return nil
+	}
+	c.operatorNamespace = namespace
+	name := os.Getenv(ConfigMapNameEnvVar)
+	if name == "" {
+		name = defaultConfigMapName
+	}
+	cl, err := client.New(cfg, client.Options{})
+	if err != nil {
+		return err
+	}
+	configMap := &corev1.ConfigMap{}
+	err = cl.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, configMap)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("Controller ConfigMap not found; using default configuration", "name", name)
+			return nil
+		}
+		return err
+	}
+	c.configMap = configMap
+	return nil
+}
+
+func (c *ControllerConfig) detectClusterFeatures(cfg *rest.Config) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	c.isOpenShift, err = hasGroupVersion(discoveryClient, "route.openshift.io/v1")
+	if err != nil {
+		return err
+	}
+	c.hasCertManager, err = hasGroupVersion(discoveryClient, "cert-manager.io/v1alpha2")
+	if err != nil {
+		return err
+	}
+	c.hasSnapshots, err = hasGroupVersion(discoveryClient, "snapshot.storage.k8s.io/v1beta1")
+	if err != nil {
+		return err
+	}
+	info, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return err
+	}
+	serverVersion, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return fmt.Errorf("invalid server version %q: %s", info.GitVersion, err)
+	}
+	c.hasNamespaceNames = serverVersion.AtLeast(namespaceNameLabelVersion)
+	log.Info("Detected cluster features", "openshift", c.isOpenShift, "cert-manager", c.hasCertManager,
+		"volume-snapshots", c.hasSnapshots, "version", info.GitVersion)
+	return nil
+}
+
+func hasGroupVersion(discoveryClient discovery.DiscoveryInterface, groupVersion string) (bool, error) {
+	_, err := discoveryClient.ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *ControllerConfig) validate() error {
+	selector, err := labels.Parse(c.getPropertyOrDefault(namespaceSelectorKey, ""))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", namespaceSelectorKey, err)
+	}
+	c.namespaceSelector = selector
+
+	defaultRouterSelector := ""
+	if c.isOpenShift {
+		defaultRouterSelector = openShiftRouterLabels
+	}
+	c.routerSelector, err = labels.Parse(c.getPropertyOrDefault(routerSelectorKey, defaultRouterSelector))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", routerSelectorKey, err)
+	}
+	// Namespaces are only labelled with their name from Kubernetes 1.21 on. On older clusters, the selector must be
+	// set, as no namespace would match the default and the operator could not reach the agent.
+	defaultOperatorSelector := ""
+	if c.operatorNamespace != "" {
+		if !c.hasNamespaceNames && c.getPropertyOrDefault(operatorSelectorKey, "") == "" {
+			return fmt.Errorf("%s must be set on clusters older than Kubernetes %s, which do not label namespaces with %s",
+				operatorSelectorKey, namespaceNameLabelVersion, namespaceNameLabel)
+		}
+		defaultOperatorSelector = namespaceNameLabel + "=" + c.operatorNamespace
+	}
+	c.operatorSelector, err = labels.Parse(c.getPropertyOrDefault(operatorSelectorKey, defaultOperatorSelector))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", operatorSelectorKey, err)
+	}
+
+	switch c.GetNamespaceMode() {
+	case NamespaceModeLocal:
+	case NamespaceModePerUser:
+		if len(c.watchNamespaces) > 0 {
+			return fmt.Errorf("%s %q requires watching all namespaces", namespaceModeKey, NamespaceModePerUser)
+		}
+		if !strings.Contains(c.getPropertyOrDefault(namespaceFormatKey, defaultNamespaceFmt), "%s") {
+			return fmt.Errorf("%s must contain %%s", namespaceFormatKey)
+		}
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", namespaceModeKey, c.GetNamespaceMode())
+	}
+	if format := c.GetDefaultDotfilesFormat(); format != "" && !strings.Contains(format, "%s") {
+		return fmt.Errorf("%s must contain %%s", dotfilesDefaultKey)
+	}
+	c.tokenExpiration, err = strconv.ParseInt(c.getPropertyOrDefault(tokenExpirationKey, defaultTokenExpiry), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", tokenExpirationKey, err)
+	}
+	if c.tokenExpiration < minTokenExpiry {
+		return fmt.Errorf("%s must be at least %d", tokenExpirationKey, minTokenExpiry)
+	}
+	switch c.GetAuditPolicy() {
+	case AuditPolicyDisabled, AuditPolicyOptional, AuditPolicyRequired:
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", auditPolicyKey, c.GetAuditPolicy())
+	}
+	switch c.GetAuditSink() {
+	case AuditSinkStdout:
+	case AuditSinkPVC:
+		if c.GetAuditClaimName() == "" {
+			return fmt.Errorf("%s must be set when the audit sink is %q", auditClaimKey, AuditSinkPVC)
+		}
+	case AuditSinkS3:
+		if c.GetAuditS3Endpoint() == "" || c.GetAuditS3Bucket() == "" || c.GetAuditS3CredentialsSecret() == "" ||
+			c.GetAuditS3RoleARN() == "" {
+			return fmt.Errorf("%s, %s, %s and %s must be set when the audit sink is %q",
+				auditS3EndpointKey, auditS3BucketKey, auditS3SecretKey, auditS3RoleKey, AuditSinkS3)
+		}
+		if c.operatorNamespace == "" {
+			return fmt.Errorf("the audit sink %q requires the operator namespace to be known", AuditSinkS3)
+		}
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", auditSinkKey, c.GetAuditSink())
+	}
+	if _, err := strconv.ParseBool(c.getPropertyOrDefault(activityTrackingKey, "false")); err != nil {
+		return fmt.Errorf("invalid %s: %s", activityTrackingKey, err)
+	}
+	if lifetime := c.getPropertyOrDefault(lifetimeMaxKey, ""); lifetime != "" {
+		if c.maxLifetime, err = time.ParseDuration(lifetime); err != nil || c.maxLifetime <= 0 {
+			return fmt.Errorf("invalid %s: must be a positive duration", lifetimeMaxKey)
+		}
+	}
+	if c.lifetimeWarning, err = time.ParseDuration(c.getPropertyOrDefault(lifetimeWarningKey, defaultLifetimeWarn)); err != nil {
+		return fmt.Errorf("invalid %s: %s", lifetimeWarningKey, err)
+	}
+	switch c.GetExpiryPolicy() {
+	case ExpiryPolicyDelete, ExpiryPolicyStop:
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", expiryPolicyKey, c.GetExpiryPolicy())
+	}
+	for key, quota := range map[string]*int{
+		quotaUserKey:      &c.shellQuotas.PerUser,
+		quotaNamespaceKey: &c.shellQuotas.PerNamespace,
+		quotaClusterKey:   &c.shellQuotas.Total,
+	} {
+		if *quota, err = strconv.Atoi(c.getPropertyOrDefault(key, "0")); err != nil || *quota < 0 {
+			return fmt.Errorf("invalid %s: must be a non-negative integer", key)
+		}
+	}
+	switch c.GetQuotaAdmission() {
+	case QuotaAdmissionQueue, QuotaAdmissionReject:
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", quotaAdmissionKey, c.GetQuotaAdmission())
+	}
+	if c.poolMaxSize, err = strconv.Atoi(c.getPropertyOrDefault(poolMaxSizeKey, defaultPoolMaxSize)); err != nil || c.poolMaxSize < 0 {
+		return fmt.Errorf("invalid %s: must be a non-negative integer", poolMaxSizeKey)
+	}
+	if _, err := strconv.ParseBool(c.getPropertyOrDefault(prePullEnabledKey, "false")); err != nil {
+		return fmt.Errorf("invalid %s: %s", prePullEnabledKey, err)
+	}
+	if c.prePullSelector, err = labels.ConvertSelectorToLabelsMap(c.getPropertyOrDefault(prePullSelectorKey, "")); err != nil {
+		return fmt.Errorf("invalid %s: %s", prePullSelectorKey, err)
+	}
+	if c.IsPrePullEnabled() && (c.operatorNamespace == "" || c.GetAgentImage() == "") {
+		return fmt.Errorf("%s requires the operator namespace and the agent image to be known", prePullEnabledKey)
+	}
+	switch c.GetWorkloadKind() {
+	case WorkloadKindDeployment, WorkloadKindStatefulSet:
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", workloadKindKey, c.GetWorkloadKind())
+	}
+	if size := c.getPropertyOrDefault(homeStorageSizeKey, ""); size != "" {
+		quantity, err := resource.ParseQuantity(size)
+		if err != nil || quantity.Sign() <= 0 {
+			return fmt.Errorf("invalid %s: must be a positive quantity", homeStorageSizeKey)
+		}
+		c.homeStorageSize = &quantity
+	}
+	if c.imageCheck, err = time.ParseDuration(c.getPropertyOrDefault(imageCheckKey, defaultImageCheck)); err != nil || c.imageCheck <= 0 {
+		return fmt.Errorf("invalid %s: must be a positive duration", imageCheckKey)
+	}
+	if c.imageIdle, err = time.ParseDuration(c.getPropertyOrDefault(imageIdleKey, defaultImageIdle)); err != nil || c.imageIdle <= 0 {
+		return fmt.Errorf("invalid %s: must be a positive duration", imageIdleKey)
+	}
+	if c.GetImagePullSecret() != "" && c.operatorNamespace == "" {
+		return fmt.Errorf("%s requires the operator namespace to be known", imagePullSecretKey)
+	}
+	switch c.GetSecurityProfile() {
+	case SecurityProfileRestricted, SecurityProfileBaseline, SecurityProfileNone:
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", securityProfileKey, c.GetSecurityProfile())
+	}
+	if _, err := strconv.ParseBool(c.getPropertyOrDefault(localQuotaKey, "false")); err != nil {
+		return fmt.Errorf("invalid %s: %s", localQuotaKey, err)
+	}
+	if c.namespaceQuota, err = parseResourceList(c.getPropertyOrDefault(namespaceQuotaKey, defaultQuota)); err != nil {
+		return fmt.Errorf("invalid %s: %s", namespaceQuotaKey, err)
+	}
+	if c.namespaceLimit, err = parseResourceList(c.getPropertyOrDefault(namespaceLimitKey, defaultLimit)); err != nil {
+		return fmt.Errorf("invalid %s: %s", namespaceLimitKey, err)
+	}
+	if c.namespaceRequest, err = parseResourceList(c.getPropertyOrDefault(namespaceRequestKey, defaultRequest)); err != nil {
+		return fmt.Errorf("invalid %s: %s", namespaceRequestKey, err)
+	}
+	if err := json.Unmarshal([]byte(c.getPropertyOrDefault(egressDefaultKey, defaultEgress)), &c.defaultEgress); err != nil {
+		return fmt.Errorf("invalid %s: %s", egressDefaultKey, err)
+	}
+	if err := json.Unmarshal([]byte(c.getPropertyOrDefault(schedulingDefaultKey, "{}")), &c.defaultScheduling); err != nil {
+		return fmt.Errorf("invalid %s: %s", schedulingDefaultKey, err)
+	}
+	if err := json.Unmarshal([]byte(c.getPropertyOrDefault(schedulingAllowedKey, "{}")), &c.allowedScheduling); err != nil {
+		return fmt.Errorf("invalid %s: %s", schedulingAllowedKey, err)
+	}
+
+	if err := json.Unmarshal([]byte(c.getPropertyOrDefault(ingressAnnotationsKey, defaultIngressAnns)), &c.ingressAnns); err != nil {
+		return fmt.Errorf("invalid %s: %s", ingressAnnotationsKey, err)
+	}
+
+	switch provider := TLSProvider(c.getPropertyOrDefault(tlsProviderKey, string(TLSProviderAuto))); provider {
+	case TLSProviderAuto:
+		if c.tlsProvider, err = c.resolveAutoTLSProvider(); err != nil {
+			return err
+		}
+	case TLSProviderOpenShift:
+		if !c.isOpenShift {
+			return fmt.Errorf("%s is %q but cluster is not OpenShift", tlsProviderKey, TLSProviderOpenShift)
+		}
+		c.tlsProvider = provider
+	case TLSProviderCertManager:
+		if !c.hasCertManager {
+			return fmt.Errorf("%s is %q but cert-manager CRDs are not installed", tlsProviderKey, TLSProviderCertManager)
+		}
+		if c.GetCertIssuerName() == "" {
+			return fmt.Errorf("%s must be set when using cert-manager", certIssuerNameKey)
+		}
+		c.tlsProvider = provider
+	default:
+		return fmt.Errorf("unsupported value for %s: %q", tlsProviderKey, provider)
+	}
+	return nil
+}
+
+// resolveAutoTLSProvider resolves TLSProviderAuto: the OpenShift service CA on OpenShift, and cert-manager elsewhere.
+// Outside OpenShift, cert-manager must be installed and an issuer configured, as nothing else issues the proxy's
+// certificate and shell pods would wait for it forever.
+func (c *ControllerConfig) resolveAutoTLSProvider() (TLSProvider, error) {
+	if c.isOpenShift {
+		return TLSProviderOpenShift, nil
+	}
+	if !c.hasCertManager {
+		return "", fmt.Errorf("%s is %q but the cluster is not OpenShift and cert-manager CRDs are not installed; "+
+			"no TLS provider is available", tlsProviderKey, TLSProviderAuto)
+	}
+	if c.GetCertIssuerName() == "" {
+		return "", fmt.Errorf("%s must be set to use cert-manager outside OpenShift", certIssuerNameKey)
+	}
+	return TLSProviderCertManager, nil
+}
+
+func (c *ControllerConfig) getPropertyOrDefault(key, defaultValue string) string {
+	if c.configMap == nil {
+		return defaultValue
+	}
+	if value, ok := c.configMap.Data[key]; ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// IsOpenShift returns whether the cluster serves OpenShift routes
+func (c *ControllerConfig) IsOpenShift() bool {
+	return c.isOpenShift
+}
+
+// GetRoutingSuffix returns the base domain used for shell hostnames
+func (c *ControllerConfig) GetRoutingSuffix() string {
+	return c.getPropertyOrDefault(routingSuffixKey, defaultRoutingSuffix)
+}
+
+// GetIngressClass returns the ingress class used for Ingresses on non-OpenShift clusters
+func (c *ControllerConfig) GetIngressClass() string {
+	return c.getPropertyOrDefault(ingressClassKey, defaultIngressClass)
+}
+
+// GetIngressAnnotations returns the annotations set on Ingresses, besides the ingress class. They default to the
+// nginx ingress controller's, to re-encrypt to the proxy and redirect plain HTTP.
+func (c *ControllerConfig) GetIngressAnnotations() map[string]string {
+	annotations := map[string]string{}
+	for key, value := range c.ingressAnns {
+		annotations[key] = value
+	}
+	return annotations
+}
+
+// GetTLSProvider returns the TLS provider in use; TLSProviderAuto is resolved from detected cluster features when the
+// configuration is loaded.
+func (c *ControllerConfig) GetTLSProvider() TLSProvider {
+	return c.tlsProvider
+}
+
+// UseCertManager returns whether cert-manager Certificates should be created for shells
+func (c *ControllerConfig) UseCertManager() bool {
+	return c.GetTLSProvider() == TLSProviderCertManager
+}
+
+// HasVolumeSnapshots returns whether the cluster serves CSI VolumeSnapshots, which CloudShellSnapshots are taken with
+func (c *ControllerConfig) HasVolumeSnapshots() bool {
+	return c.hasSnapshots
+}
+
+// GetCertIssuerName returns the name of the cert-manager Issuer or ClusterIssuer used for shell certificates
+func (c *ControllerConfig) GetCertIssuerName() string {
+	return c.getPropertyOrDefault(certIssuerNameKey, "")
+}
+
+// GetCertIssuerKind returns the kind (Issuer or ClusterIssuer) of the cert-manager issuer
+func (c *ControllerConfig) GetCertIssuerKind() string {
+	return c.getPropertyOrDefault(certIssuerKindKey, defaultCertIssuerKind)
+}
+
+// GetNamespaceSelector returns the label selector namespaces must match for their CloudShells to be served. An empty
+// selector matches all namespaces.
+func (c *ControllerConfig) GetNamespaceSelector() labels.Selector {
+	if c.namespaceSelector == nil {
+		return labels.Everything()
+	}
+	return c.namespaceSelector
+}
+
+// SetWatchNamespaces records the namespaces watched by the manager. An empty list means all namespaces.
+func (c *ControllerConfig) SetWatchNamespaces(namespaces []string) {
+	c.watchNamespaces = namespaces
+}
+
+// GetWatchNamespaces returns the namespaces watched by the manager. An empty list means all namespaces.
+func (c *ControllerConfig) GetWatchNamespaces() []string {
+	return c.watchNamespaces
+}
+
+// IsClusterWide returns whether the operator watches all namespaces
+func (c *ControllerConfig) IsClusterWide() bool {
+	return len(c.watchNamespaces) == 0
+}
+
+// GetNamespaceMode returns where shell resources are created
+func (c *ControllerConfig) GetNamespaceMode() NamespaceMode {
+	return NamespaceMode(c.getPropertyOrDefault(namespaceModeKey, string(NamespaceModeLocal)))
+}
+
+// GetNamespaceFormat returns the format string used to compute per-user namespace names from the owner's name
+func (c *ControllerConfig) GetNamespaceFormat() string {
+	return c.getPropertyOrDefault(namespaceFormatKey, defaultNamespaceFmt)
+}
+
+// GetNamespaceQuota returns the hard limits of the ResourceQuota created in per-user namespaces, and in local mode
+// if HasLocalNamespaceQuota is true
+func (c *ControllerConfig) GetNamespaceQuota() corev1.ResourceList {
+	return c.namespaceQuota
+}
+
+// HasLocalNamespaceQuota returns whether the ResourceQuota and LimitRange of per-user namespaces are also created in
+// each namespace served in local mode, while it contains CloudShells
+func (c *ControllerConfig) HasLocalNamespaceQuota() bool {
+	enabled, _ := strconv.ParseBool(c.getPropertyOrDefault(localQuotaKey, "false"))
+	return enabled && c.GetNamespaceMode() == NamespaceModeLocal
+}
+
+// GetNamespaceLimits returns the default container limits and requests of the LimitRange created in per-user
+// namespaces, and in local mode if HasLocalNamespaceQuota is true
+func (c *ControllerConfig) GetNamespaceLimits() (limits, requests corev1.ResourceList) {
+	return c.namespaceLimit, c.namespaceRequest
+}
+
+// GetRouterNamespaceSelector returns the label selector matching namespaces that run the cluster router or ingress
+// controller. An empty selector matches all namespaces.
+func (c *ControllerConfig) GetRouterNamespaceSelector() labels.Selector {
+	if c.routerSelector == nil {
+		return labels.Everything()
+	}
+	return c.routerSelector
+}
+
+// GetOperatorNamespaceSelector returns the label selector matching the namespace the operator runs in. Only the
+// operator's pods in this namespace may connect to the agent in shell pods; none may if the selector is empty.
+func (c *ControllerConfig) GetOperatorNamespaceSelector() labels.Selector {
+	if c.operatorSelector == nil {
+		return labels.Everything()
+	}
+	return c.operatorSelector
+}
+
+// parseResourceList parses a comma-separated list of name=quantity pairs, e.g. "cpu=1,memory=1Gi"
+func parseResourceList(value string) (corev1.ResourceList, error) {
+	resources := corev1.ResourceList{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected name=quantity, got %q", pair)
+		}
+		quantity, err := resource.ParseQuantity(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity for %s: %s", parts[0], err)
+		}
+		resources[corev1.ResourceName(strings.TrimSpace(parts[0]))] = quantity
+	}
+	return resources, nil
+}
+
+// GetDefaultEgressPolicy returns the egress policy applied to shells for fields not set in the CloudShell's spec
+func (c *ControllerConfig) GetDefaultEgressPolicy() v1alpha1.EgressPolicy {
+	return *c.defaultEgress.DeepCopy()
+}
+
+// GetAPIServerCIDRs returns the CIDRs of the API server endpoints, if configured. When empty, the endpoints of the
+// default/kubernetes service are used.
+func (c *ControllerConfig) GetAPIServerCIDRs() []string {
+	var cidrs []string
+	for _, cidr := range strings.Split(c.getPropertyOrDefault(apiServerCIDRsKey, ""), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+// GetSecurityProfile returns the security profile applied to shell pods
+func (c *ControllerConfig) GetSecurityProfile() SecurityProfile {
+	return SecurityProfile(c.getPropertyOrDefault(securityProfileKey, string(SecurityProfileBaseline)))
+}
+
+// GetDefaultScheduling returns the scheduling settings applied to all shells. They take precedence over the
+// scheduling settings of a CloudShell.
+func (c *ControllerConfig) GetDefaultScheduling() v1alpha1.SchedulingSpec {
+	return *c.defaultScheduling.DeepCopy()
+}
+
+// GetAllowedScheduling returns the priority classes, runtime classes and tolerations CloudShells may request
+func (c *ControllerConfig) GetAllowedScheduling() SchedulingAllowlist {
+	return c.allowedScheduling
+}
+
+// GetGitImage returns the image used to clone git repositories into shells. It must provide git, ssh and sh.
+func (c *ControllerConfig) GetGitImage() string {
+	return c.getPropertyOrDefault(gitImageKey, defaultGitImage)
+}
+
+// GetDefaultDotfilesFormat returns the format string used to compute the name of the owner's default dotfiles
+// ConfigMap from the owner's name, or an empty string if there is no default
+func (c *ControllerConfig) GetDefaultDotfilesFormat() string {
+	return c.getPropertyOrDefault(dotfilesDefaultKey, "")
+}
+
+// GetTokenExpiration returns the lifetime in seconds of the projected ServiceAccount tokens mounted in shell pods
+func (c *ControllerConfig) GetTokenExpiration() int64 {
+	return c.tokenExpiration
+}
+
+// GetTokenAudience returns the audience of the projected ServiceAccount tokens mounted in shell pods. An empty
+// audience means the API server's.
+func (c *ControllerConfig) GetTokenAudience() string {
+	return c.getPropertyOrDefault(tokenAudienceKey, "")
+}
+
+// GetAgentImage returns the image of the agent sidecar, which defaults to the operator's own image. It is empty if
+// neither is known.
+func (c *ControllerConfig) GetAgentImage() string {
+	return c.getPropertyOrDefault(agentImageKey, os.Getenv(OperatorImageEnvVar))
+}
+
+// GetOperatorNamespace returns the namespace the operator runs in, or an empty string if it is not known
+func (c *ControllerConfig) GetOperatorNamespace() string {
+	return c.operatorNamespace
+}
+
+// GetOperatorUsername returns the name the operator authenticates to the API server as, or an empty string if the
+// operator namespace is not known
+func (c *ControllerConfig) GetOperatorUsername() string {
+	if c.operatorNamespace == "" {
+		return ""
+	}
+	serviceAccount := os.Getenv(ServiceAccountEnvVar)
+	if serviceAccount == "" {
+		serviceAccount = defaultServiceAccount
+	}
+	return fmt.Sprintf("system:serviceaccount:%s:%s", c.operatorNamespace, serviceAccount)
+}
+
+// GetAuditPolicy returns which CloudShells have their terminal sessions recorded
+func (c *ControllerConfig) GetAuditPolicy() AuditPolicy {
+	return AuditPolicy(c.getPropertyOrDefault(auditPolicyKey, string(AuditPolicyOptional)))
+}
+
+// GetAuditSink returns where session recordings are stored
+func (c *ControllerConfig) GetAuditSink() AuditSink {
+	return AuditSink(c.getPropertyOrDefault(auditSinkKey, string(AuditSinkStdout)))
+}
+
+// GetAuditClaimName returns the name of the PersistentVolumeClaim recordings are written to when using the pvc sink.
+// The claim is looked up in the namespace the shell runs in.
+func (c *ControllerConfig) GetAuditClaimName() string {
+	return c.getPropertyOrDefault(auditClaimKey, "")
+}
+
+// GetAuditS3Endpoint returns the URL of the S3-compatible endpoint recordings are uploaded to
+func (c *ControllerConfig) GetAuditS3Endpoint() string {
+	return c.getPropertyOrDefault(auditS3EndpointKey, "")
+}
+
+// GetAuditS3Bucket returns the bucket recordings are uploaded to
+func (c *ControllerConfig) GetAuditS3Bucket() string {
+	return c.getPropertyOrDefault(auditS3BucketKey, "")
+}
+
+// GetAuditS3Region returns the region used to sign requests to the S3 endpoint
+func (c *ControllerConfig) GetAuditS3Region() string {
+	return c.getPropertyOrDefault(auditS3RegionKey, defaultS3Region)
+}
+
+// GetAuditS3CredentialsSecret returns the name of the Secret in the operator's namespace holding the access key the
+// operator assumes the upload role with
+func (c *ControllerConfig) GetAuditS3CredentialsSecret() string {
+	return c.getPropertyOrDefault(auditS3SecretKey, "")
+}
+
+// GetAuditS3RoleARN returns the role assumed to issue each shell credentials that can only upload its own recordings
+func (c *ControllerConfig) GetAuditS3RoleARN() string {
+	return c.getPropertyOrDefault(auditS3RoleKey, "")
+}
+
+// GetAuditS3STSEndpoint returns the URL of the STS endpoint issuing upload credentials, which defaults to the S3
+// endpoint as for S3-compatible stores such as MinIO
+func (c *ControllerConfig) GetAuditS3STSEndpoint() string {
+	return c.getPropertyOrDefault(auditS3STSKey, c.GetAuditS3Endpoint())
+}
+
+// GetActivityTracking returns whether terminal activity in shells is tracked by routing terminals through the agent,
+// to report when each shell was last used
+func (c *ControllerConfig) GetActivityTracking() bool {
+	tracking, _ := strconv.ParseBool(c.getPropertyOrDefault(activityTrackingKey, "false"))
+	return tracking
+}
+
+// GetMaxLifetime returns the maximum lifetime of CloudShells from their creation, or zero if it is unlimited
+func (c *ControllerConfig) GetMaxLifetime() time.Duration {
+	return c.maxLifetime
+}
+
+// GetLifetimeWarningPeriod returns how long before a CloudShell expires its users are warned
+func (c *ControllerConfig) GetLifetimeWarningPeriod() time.Duration {
+	return c.lifetimeWarning
+}
+
+// GetExpiryPolicy returns what happens to CloudShells that reach their maximum lifetime
+func (c *ControllerConfig) GetExpiryPolicy() ExpiryPolicy {
+	return ExpiryPolicy(c.getPropertyOrDefault(expiryPolicyKey, string(ExpiryPolicyDelete)))
+}
+
+// GetShellQuotas returns the limits on the number of CloudShells running at once
+func (c *ControllerConfig) GetShellQuotas() ShellQuotas {
+	return c.shellQuotas
+}
+
+// GetQuotaAdmission returns what happens to CloudShells created when a quota on running shells is reached
+func (c *ControllerConfig) GetQuotaAdmission() QuotaAdmission {
+	return QuotaAdmission(c.getPropertyOrDefault(quotaAdmissionKey, string(QuotaAdmissionQueue)))
+}
+
+// GetPoolMaxSize returns the largest number of unclaimed shells a CloudShellPool may keep running; larger pools
+// are kept at this size
+func (c *ControllerConfig) GetPoolMaxSize() int {
+	return c.poolMaxSize
+}
+
+// GetMachineExecImage returns the image of the machine-exec sidecar, which serves terminals
+func (c *ControllerConfig) GetMachineExecImage() string {
+	return c.getPropertyOrDefault(machineExecImageKey, defaultMachineExec)
+}
+
+// GetOAuthProxyImage returns the image of the authenticating proxy sidecar
+func (c *ControllerConfig) GetOAuthProxyImage() string {
+	return c.getPropertyOrDefault(oauthProxyImageKey, defaultOAuthProxy)
+}
+
+// IsPrePullEnabled returns whether the operator runs a DaemonSet caching shell images on nodes
+func (c *ControllerConfig) IsPrePullEnabled() bool {
+	enabled, _ := strconv.ParseBool(c.getPropertyOrDefault(prePullEnabledKey, "false"))
+	return enabled
+}
+
+// GetPrePullNodeSelector returns the labels of the nodes images are cached on. An empty selector means all nodes.
+func (c *ControllerConfig) GetPrePullNodeSelector() map[string]string {
+	return c.prePullSelector
+}
+
+// GetPrePullImages returns additional images cached on nodes, besides the images of shells and their sidecars
+func (c *ControllerConfig) GetPrePullImages() []string {
+	var images []string
+	for _, image := range strings.Split(c.getPropertyOrDefault(prePullImagesKey, ""), ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+func (c *ControllerConfig) getPrePullAllowedImages() []string {
+	var allowed []string
+	for _, image := range strings.Split(c.getPropertyOrDefault(prePullAllowedKey, ""), ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			allowed = append(allowed, image)
+		}
+	}
+	return allowed
+}
+
+// IsPrePullAllowed returns whether an image of a CloudShellPool template may be cached on nodes. Pool templates are
+// written by users, so their images are only cached if the administrator allows them: an allowed entry ending in "/"
+// allows the images under it, such as "quay.io/org/"; any other entry allows that image with any tag or digest.
+func (c *ControllerConfig) IsPrePullAllowed(image string) bool {
+	for _, allowed := range c.getPrePullAllowedImages() {
+		if strings.HasSuffix(allowed, "/") {
+			if strings.HasPrefix(image, allowed) {
+				return true
+			}
+		} else if image == allowed || strings.HasPrefix(image, allowed+":") || strings.HasPrefix(image, allowed+"@") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPrePullSecret returns the name of a Secret in the operator's namespace, of type kubernetes.io/dockerconfigjson,
+// used by the pre-puller to pull images from private registries. Empty means images are pulled anonymously.
+func (c *ControllerConfig) GetPrePullSecret() string {
+	return c.getPropertyOrDefault(prePullSecretKey, "")
+}
+
+// GetWorkloadKind returns the kind of workload that runs shell pods
+func (c *ControllerConfig) GetWorkloadKind() WorkloadKind {
+	return WorkloadKind(c.getPropertyOrDefault(workloadKindKey, string(WorkloadKindDeployment)))
+}
+
+// GetHomeStorageSize returns the size of the PersistentVolumeClaim holding each shell's home directory, or nil if
+// home directories are ephemeral
+func (c *ControllerConfig) GetHomeStorageSize() *resource.Quantity {
+	return c.homeStorageSize
+}
+
+// GetHomeStorageClassName returns the storage class of home directory claims; empty means the cluster default
+func (c *ControllerConfig) GetHomeStorageClassName() string {
+	return c.getPropertyOrDefault(homeStorageClassKey, "")
+}
+
+// GetImageCheckInterval returns how often the image tags of shells that follow them are resolved again
+func (c *ControllerConfig) GetImageCheckInterval() time.Duration {
+	return c.imageCheck
+}
+
+// GetImageIdlePeriod returns how long a shell must have had no terminal activity to be restarted with a new image
+func (c *ControllerConfig) GetImageIdlePeriod() time.Duration {
+	return c.imageIdle
+}
+
+// GetImagePullSecret returns the name of a Secret in the operator's namespace, of type kubernetes.io/dockerconfigjson,
+// holding credentials for resolving image tags. Empty means registries are accessed anonymously.
+func (c *ControllerConfig) GetImagePullSecret() string {
+	return c.getPropertyOrDefault(imagePullSecretKey, "")
+}
+
+// GetInsecureRegistries returns the registries accessed over plain HTTP when resolving image tags
+func (c *ControllerConfig) GetInsecureRegistries() []string {
+	return c.getRegistries(imageInsecureKey, "")
+}
+
+// GetAllowedRegistries returns the registries the operator may resolve image tags from. Images in CloudShells are
+// written by users, so the operator does not contact other registries for them.
+func (c *ControllerConfig) GetAllowedRegistries() []string {
+	return c.getRegistries(imageAllowedKey, defaultRegistries)
+}
+
+// GetInternalRegistries returns the registries that may be on private addresses, such as the cluster's registry.
+// Image tags are not resolved from other hosts on private, loopback or link-local addresses.
+func (c *ControllerConfig) GetInternalRegistries() []string {
+	return c.getRegistries(imageInternalKey, "")
+}
+
+func (c *ControllerConfig) getRegistries(key, defaultValue string) []string {
+	var registries []string
+	for _, registry := range strings.Split(c.getPropertyOrDefault(key, defaultValue), ",") {
+		if registry = strings.TrimSpace(registry); registry != "" {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
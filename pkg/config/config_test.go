@@ -0,0 +1,302 @@
+package config
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateDefaults(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           ControllerConfig
+		tlsProvider      TLSProvider
+		routerSelector   string
+		operatorSelector string
+	}{
+		{
+			name:             "OpenShift",
+			config:           ControllerConfig{isOpenShift: true, hasNamespaceNames: true},
+			tlsProvider:      TLSProviderOpenShift,
+			routerSelector:   openShiftRouterLabels,
+			operatorSelector: "",
+		},
+		{
+			name: "Kubernetes with cert-manager",
+			config: ControllerConfig{
+				configMap:      &corev1.ConfigMap{Data: map[string]string{certIssuerNameKey: "issuer"}},
+				hasCertManager: true,
+			},
+			tlsProvider: TLSProviderCertManager,
+		},
+		{
+			name: "operator namespace",
+			config: ControllerConfig{
+				operatorNamespace: "cloudshell",
+				isOpenShift:       true,
+				hasNamespaceNames: true,
+			},
+			tlsProvider:      TLSProviderOpenShift,
+			routerSelector:   openShiftRouterLabels,
+			operatorSelector: namespaceNameLabel + "=cloudshell",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := test.config
+			if err := c.validate(); err != nil {
+				t.Fatalf("expected config to be valid, got %s", err)
+			}
+			if provider := c.GetTLSProvider(); provider != test.tlsProvider {
+				t.Errorf("expected TLS provider %q, got %q", test.tlsProvider, provider)
+			}
+			if selector := c.GetRouterNamespaceSelector().String(); selector != test.routerSelector {
+				t.Errorf("expected router namespace selector %q, got %q", test.routerSelector, selector)
+			}
+			if selector := c.GetOperatorNamespaceSelector().String(); selector != test.operatorSelector {
+				t.Errorf("expected operator namespace selector %q, got %q", test.operatorSelector, selector)
+			}
+			if mode := c.GetNamespaceMode(); mode != NamespaceModeLocal {
+				t.Errorf("expected namespace mode %q, got %q", NamespaceModeLocal, mode)
+			}
+			if c.GetTokenExpiration() != 3600 {
+				t.Errorf("expected token expiration 3600, got %d", c.GetTokenExpiration())
+			}
+			if c.GetAuditPolicy() != AuditPolicyOptional || c.GetAuditSink() != AuditSinkStdout {
+				t.Errorf("expected optional audit to stdout, got %q with sink %q", c.GetAuditPolicy(), c.GetAuditSink())
+			}
+			if c.GetWorkloadKind() != WorkloadKindDeployment {
+				t.Errorf("expected workload kind %q, got %q", WorkloadKindDeployment, c.GetWorkloadKind())
+			}
+			if c.GetShellQuotas() != (ShellQuotas{}) {
+				t.Errorf("expected no shell quotas, got %+v", c.GetShellQuotas())
+			}
+			if c.HasLocalNamespaceQuota() {
+				t.Errorf("expected no quota in local namespaces")
+			}
+			quota := c.GetNamespaceQuota()
+			if pods := quota[corev1.ResourcePods]; pods.String() != "10" {
+				t.Errorf("expected a quota of 10 pods, got %s", pods.String())
+			}
+			egress := c.GetDefaultEgressPolicy()
+			if egress.AllowDNS == nil || !*egress.AllowDNS || egress.AllowAPIServer == nil || !*egress.AllowAPIServer {
+				t.Errorf("expected DNS and the API server to be allowed by default")
+			}
+			if len(egress.AllowedCIDRs) != 1 || egress.AllowedCIDRs[0] != "0.0.0.0/0" {
+				t.Errorf("expected all destinations to be allowed by default, got %v", egress.AllowedCIDRs)
+			}
+			if len(egress.DeniedCIDRs) != 1 || egress.DeniedCIDRs[0] != "169.254.169.254/32" {
+				t.Errorf("expected the metadata endpoint to be denied by default, got %v", egress.DeniedCIDRs)
+			}
+		})
+	}
+}
+
+func TestValidateTLSProvider(t *testing.T) {
+	tests := []struct {
+		name           string
+		isOpenShift    bool
+		hasCertManager bool
+		data           map[string]string
+		expected       TLSProvider
+		valid          bool
+	}{
+		{
+			name:        "auto on OpenShift",
+			isOpenShift: true,
+			expected:    TLSProviderOpenShift,
+			valid:       true,
+		},
+		{
+			name:           "auto on OpenShift with cert-manager",
+			isOpenShift:    true,
+			hasCertManager: true,
+			data:           map[string]string{certIssuerNameKey: "issuer"},
+			expected:       TLSProviderOpenShift,
+			valid:          true,
+		},
+		{
+			name:           "auto with cert-manager",
+			hasCertManager: true,
+			data:           map[string]string{certIssuerNameKey: "issuer"},
+			expected:       TLSProviderCertManager,
+			valid:          true,
+		},
+		{
+			name:           "auto with cert-manager without issuer",
+			hasCertManager: true,
+		},
+		{
+			name: "auto without cert-manager",
+			data: map[string]string{certIssuerNameKey: "issuer"},
+		},
+		{
+			name:        "openshift",
+			isOpenShift: true,
+			data:        map[string]string{tlsProviderKey: "openshift"},
+			expected:    TLSProviderOpenShift,
+			valid:       true,
+		},
+		{
+			name:           "openshift outside OpenShift",
+			hasCertManager: true,
+			data:           map[string]string{tlsProviderKey: "openshift", certIssuerNameKey: "issuer"},
+		},
+		{
+			name:           "cert-manager on OpenShift",
+			isOpenShift:    true,
+			hasCertManager: true,
+			data:           map[string]string{tlsProviderKey: "cert-manager", certIssuerNameKey: "issuer"},
+			expected:       TLSProviderCertManager,
+			valid:          true,
+		},
+		{
+			name:           "cert-manager without issuer",
+			isOpenShift:    true,
+			hasCertManager: true,
+			data:           map[string]string{tlsProviderKey: "cert-manager"},
+		},
+		{
+			name:        "cert-manager not installed",
+			isOpenShift: true,
+			data:        map[string]string{tlsProviderKey: "cert-manager", certIssuerNameKey: "issuer"},
+		},
+		{
+			name:        "unsupported",
+			isOpenShift: true,
+			data:        map[string]string{tlsProviderKey: "letsencrypt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &ControllerConfig{
+				configMap:      &corev1.ConfigMap{Data: test.data},
+				isOpenShift:    test.isOpenShift,
+				hasCertManager: test.hasCertManager,
+			}
+			err := c.validate()
+			if test.valid && err != nil {
+				t.Fatalf("expected config to be valid, got %s", err)
+			}
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected config to be invalid, got TLS provider %q", c.GetTLSProvider())
+				}
+				return
+			}
+			if provider := c.GetTLSProvider(); provider != test.expected {
+				t.Errorf("expected TLS provider %q, got %q", test.expected, provider)
+			}
+		})
+	}
+}
+
+func TestValidateOperatorNamespaceSelector(t *testing.T) {
+	tests := []struct {
+		name              string
+		operatorNamespace string
+		hasNamespaceNames bool
+		data              map[string]string
+		expected          string
+		valid             bool
+	}{
+		{
+			name:     "operator namespace unknown",
+			expected: "",
+			valid:    true,
+		},
+		{
+			name:              "namespace name label",
+			operatorNamespace: "cloudshell",
+			hasNamespaceNames: true,
+			expected:          namespaceNameLabel + "=cloudshell",
+			valid:             true,
+		},
+		{
+			name:              "configured selector",
+			operatorNamespace: "cloudshell",
+			hasNamespaceNames: true,
+			data:              map[string]string{operatorSelectorKey: "cloudshell.eclipse.org/operator=true"},
+			expected:          "cloudshell.eclipse.org/operator=true",
+			valid:             true,
+		},
+		{
+			name:              "configured selector without namespace name label",
+			operatorNamespace: "cloudshell",
+			data:              map[string]string{operatorSelectorKey: "cloudshell.eclipse.org/operator=true"},
+			expected:          "cloudshell.eclipse.org/operator=true",
+			valid:             true,
+		},
+		{
+			name:              "no selector without namespace name label",
+			operatorNamespace: "cloudshell",
+		},
+		{
+			name:              "invalid selector",
+			operatorNamespace: "cloudshell",
+			hasNamespaceNames: true,
+			data:              map[string]string{operatorSelectorKey: "operator in ("},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &ControllerConfig{
+				configMap:         &corev1.ConfigMap{Data: test.data},
+				operatorNamespace: test.operatorNamespace,
+				isOpenShift:       true,
+				hasNamespaceNames: test.hasNamespaceNames,
+			}
+			err := c.validate()
+			if test.valid && err != nil {
+				t.Fatalf("expected config to be valid, got %s", err)
+			}
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected config to be invalid")
+				}
+				return
+			}
+			if selector := c.GetOperatorNamespaceSelector().String(); selector != test.expected {
+				t.Errorf("expected operator namespace selector %q, got %q", test.expected, selector)
+			}
+		})
+	}
+}
+
+func TestValidateEgressDefault(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{
+			name:  "deny all",
+			value: `{}`,
+			valid: true,
+		},
+		{
+			name:  "allowed CIDRs",
+			value: `{"allowDNS": true, "allowedCIDRs": ["10.0.0.0/8"]}`,
+			valid: true,
+		},
+		{
+			name:  "invalid JSON",
+			value: `{"allowDNS": "yes"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &ControllerConfig{
+				configMap:   &corev1.ConfigMap{Data: map[string]string{egressDefaultKey: test.value}},
+				isOpenShift: true,
+			}
+			err := c.validate()
+			if test.valid && err != nil {
+				t.Errorf("expected config to be valid, got %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected config to be invalid")
+			}
+		})
+	}
+}
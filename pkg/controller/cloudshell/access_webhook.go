@@ -0,0 +1,235 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// accessWebhookPath is the path the access webhook is served on; see deploy/webhook.yaml
+	accessWebhookPath = "/validate-cloudshell-access"
+	// accessCacheTTL is how long the result of an access check is reused for the same user and resource
+	accessCacheTTL = time.Minute
+)
+
+// resourceReference is a Secret, ConfigMap or PersistentVolumeClaim a CloudShell refers to by name in its shell
+// namespace
+type resourceReference struct {
+	resource string
+	name     string
+}
+
+// getResourceReferences returns the resources a CloudShell's spec refers to and mounts in the shell, without
+// duplicates
+func getResourceReferences(spec *v1alpha1.CloudShellSpec) []resourceReference {
+	seen := map[resourceReference]bool{}
+	var refs []resourceReference
+	add := func(resource, name string) {
+		ref := resourceReference{resource: resource, name: name}
+		if name != "" && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	for _, project := range spec.Projects {
+		add("secrets", project.Git.CredentialsSecret)
+	}
+	if dotfiles := spec.Dotfiles; dotfiles != nil {
+		if dotfiles.Git != nil {
+			add("secrets", dotfiles.Git.CredentialsSecret)
+		}
+		add("configmaps", dotfiles.ConfigMap)
+		add("secrets", dotfiles.Secret)
+	}
+	for _, credential := range spec.Credentials {
+		add("secrets", credential.Secret)
+	}
+	for _, volume := range spec.Volumes {
+		switch {
+		case volume.ConfigMap != nil:
+			add("configmaps", volume.ConfigMap.Name)
+		case volume.Secret != nil:
+			add("secrets", volume.Secret.SecretName)
+		case volume.PersistentVolumeClaim != nil:
+			add("persistentvolumeclaims", volume.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	containers := append([]corev1.Container{}, spec.Sidecars...)
+	containers = append(containers, spec.InitContainers...)
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				add("configmaps", envFrom.ConfigMapRef.Name)
+			}
+			if envFrom.SecretRef != nil {
+				add("secrets", envFrom.SecretRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				add("configmaps", env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				add("secrets", env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+	return refs
+}
+
+// accessValidator rejects CloudShells referring to resources that the user creating or updating them may not read.
+// The operator mounts these resources in the shell, so that without this check a CloudShell could be used to read
+// any Secret, ConfigMap or PersistentVolumeClaim in its shell namespace. The owner's default dotfiles ConfigMap is not checked, as it is
+// chosen by the operator configuration rather than the user. Only references added by an update are checked, so that
+// users sharing a shell can edit it without having access to everything it refers to.
+type accessValidator struct {
+	client  client.Client
+	decoder *admission.Decoder
+	cache   *accessCache
+}
+
+var _ admission.DecoderInjector = &accessValidator{}
+
+func (v *accessValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+func (v *accessValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if isOperator(req.UserInfo) {
+		return admission.Allowed("")
+	}
+	instance := &v1alpha1.CloudShell{}
+	if err := v.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	refs := getResourceReferences(&instance.Spec)
+	if req.Operation == v1beta1.Update {
+		old := &v1alpha1.CloudShell{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		existing := map[resourceReference]bool{}
+		for _, ref := range getResourceReferences(&old.Spec) {
+			existing[ref] = true
+		}
+		var added []resourceReference
+		for _, ref := range refs {
+			if !existing[ref] {
+				added = append(added, ref)
+			}
+		}
+		refs = added
+	}
+	namespace := getShellNamespace(instance)
+	for _, ref := range refs {
+		allowed, err := v.canRead(ctx, req.UserInfo, namespace, ref)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if !allowed {
+			return admission.Denied(fmt.Sprintf("%s may not read %s %s in namespace %s",
+				req.UserInfo.Username, ref.resource, ref.name, namespace))
+		}
+	}
+	return admission.Allowed("")
+}
+
+// canRead returns whether a user may get a resource, using a SubjectAccessReview for the user's identity as
+// authenticated by the API server
+func (v *accessValidator) canRead(ctx context.Context, user authenticationv1.UserInfo, namespace string, ref resourceReference) (bool, error) {
+	key := getAccessCacheKey(user, namespace, ref)
+	if allowed, ok := v.cache.get(key); ok {
+		return allowed, nil
+	}
+	extra := map[string]authorizationv1.ExtraValue{}
+	for name, values := range user.Extra {
+		extra[name] = authorizationv1.ExtraValue(values)
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "get",
+				Resource:  ref.resource,
+				Name:      ref.name,
+			},
+		},
+	}
+	if err := v.client.Create(ctx, review); err != nil {
+		return false, err
+	}
+	v.cache.set(key, review.Status.Allowed)
+	return review.Status.Allowed, nil
+}
+
+// getAccessCacheKey identifies an access check by the full identity of the user and the resource checked
+func getAccessCacheKey(user authenticationv1.UserInfo, namespace string, ref resourceReference) string {
+	groups := append([]string{}, user.Groups...)
+	sort.Strings(groups)
+	var extra []string
+	for name, values := range user.Extra {
+		extra = append(extra, name+"="+strings.Join(values, ","))
+	}
+	sort.Strings(extra)
+	return strings.Join([]string{user.Username, user.UID, strings.Join(groups, ","), strings.Join(extra, ";"),
+		namespace, ref.resource, ref.name}, "\n")
+}
+
+// accessCache holds the results of access checks for accessCacheTTL, so that repeated updates of a CloudShell do not
+// each issue SubjectAccessReviews
+type accessCache struct {
+	mu      sync.Mutex
+	entries map[string]accessCacheEntry
+}
+
+type accessCacheEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+func newAccessCache() *accessCache {
+	return &accessCache{entries: map[string]accessCacheEntry{}}
+}
+
+func (c *accessCache) get(key string) (allowed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.allowed, true
+}
+
+func (c *accessCache) set(key string, allowed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = accessCacheEntry{allowed: allowed, expires: now.Add(accessCacheTTL)}
+}
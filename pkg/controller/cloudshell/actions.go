@@ -0,0 +1,121 @@
+package cloudshell
+
+import (
+	"context"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// restartedAtAnnotation and resetAtAnnotation are set on the shell pod template to the last handled restart
+	// and reset requests, so that handling a request rolls out a new pod
+	restartedAtAnnotation = "cloudshell.eclipse.org/restarted-at"
+	resetAtAnnotation     = "cloudshell.eclipse.org/reset-at"
+)
+
+// getRestartRequest returns the restart request that has not been handled yet, if any
+func getRestartRequest(instance *v1alpha1.CloudShell) string {
+	request := instance.Annotations[v1alpha1.RestartRequestedAnnotation]
+	if request == instance.Status.LastRestartRequest {
+		return ""
+	}
+	return request
+}
+
+// getResetRequest returns the home directory reset request that has not been handled yet, if any
+func getResetRequest(instance *v1alpha1.CloudShell) string {
+	request := instance.Annotations[v1alpha1.ResetRequestedAnnotation]
+	if request == instance.Status.LastResetRequest {
+		return ""
+	}
+	return request
+}
+
+// isResetting returns whether the shell is kept stopped while its home directory claim is recreated. Ephemeral home
+// directories are reset by restarting the shell instead.
+func isResetting(instance *v1alpha1.CloudShell) bool {
+	return getResetRequest(instance) != "" && config.ControllerCfg.GetHomeStorageSize() != nil
+}
+
+// getActionAnnotations returns the pod template annotations recording the handled restart and reset requests
+func getActionAnnotations(instance *v1alpha1.CloudShell) map[string]string {
+	annotations := map[string]string{}
+	if request := instance.Status.LastRestartRequest; request != "" {
+		annotations[restartedAtAnnotation] = request
+	}
+	if request := instance.Status.LastResetRequest; request != "" {
+		annotations[resetAtAnnotation] = request
+	}
+	return annotations
+}
+
+// reconcileActions handles the restart and reset requests made through annotations. A request is handled once, when
+// its value differs from the last handled one recorded in the status. Restarting rolls out a new pod; resetting
+// also deletes the home directory claim while the shell is stopped, so that it is recreated empty.
+func (r *ReconcileCloudShell) reconcileActions(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if request := getRestartRequest(instance); request != "" {
+		ctx.log.Info("Restarting shell", "request", request)
+		r.recorder.Event(instance, corev1.EventTypeNormal, "Restarting", "Restart requested")
+		instance.Status.LastRestartRequest = request
+		if image := instance.Status.Image; image != nil {
+			// Look for a new image now, so that the shell restarts once with the newest digest
+			image.CheckedAt = nil
+		}
+		return r.updateStatusIf(ctx, true)
+	}
+
+	request := getResetRequest(instance)
+	if request == "" {
+		return deployStatus{Continue: true}
+	}
+	if isResetting(instance) {
+		running, err := r.hasShellPods(instance)
+		if err != nil || running {
+			// The workload is scaled down while resetting; wait for the pod to terminate
+			return deployStatus{Continue: err == nil, Error: err}
+		}
+		deleted, err := r.deleteHomeVolume(ctx)
+		if err != nil || !deleted {
+			return deployStatus{Requeue: true, Error: err}
+		}
+	}
+	ctx.log.Info("Reset shell home directory", "request", request)
+	r.recorder.Event(instance, corev1.EventTypeNormal, "Reset", "Home directory reset")
+	instance.Status.LastResetRequest = request
+	return r.updateStatusIf(ctx, true)
+}
+
+// hasShellPods returns whether any pod of the shell exists, including terminating pods
+func (r *ReconcileCloudShell) hasShellPods(instance *v1alpha1.CloudShell) (bool, error) {
+	pods := &corev1.PodList{}
+	err := r.client.List(context.TODO(), pods,
+		client.InNamespace(getShellNamespace(instance)),
+		client.MatchingLabels(getLabelsForID(instance.Status.Id)))
+	return len(pods.Items) > 0, err
+}
+
+// deleteHomeVolume deletes the shell's home directory claim and returns whether it is gone
+func (r *ReconcileCloudShell) deleteHomeVolume(ctx reconcileContext) (bool, error) {
+	claim := &corev1.PersistentVolumeClaim{}
+	namespacedName := types.NamespacedName{Name: getHomeClaimName(ctx.instance), Namespace: getShellNamespace(ctx.instance)}
+	err := r.client.Get(context.TODO(), namespacedName, claim)
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if claim.DeletionTimestamp == nil {
+		ctx.log.Info("Deleting home volume claim")
+		if err := r.client.Delete(context.TODO(), claim); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,338 @@
+package cloudshell
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/agent"
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// terminalProxyAddress is where the agent's terminal proxy listens; when terminals are recorded or tracked, the
+	// auth proxy forwards to it instead of machine-exec
+	terminalProxyAddress = "127.0.0.1:4446"
+	// agentPollInterval is how often the state of a shell's sessions and activity is read from its agent
+	agentPollInterval = time.Minute
+	// agentTokenKey holds the token the operator authenticates to a shell's agent with
+	agentTokenKey = "token"
+)
+
+var agentClient = &http.Client{Timeout: 5 * time.Second}
+
+// needsAgent returns whether a shell pod runs the agent sidecar, which serves named sessions, records terminals and
+// tracks activity
+func needsAgent(instance *v1alpha1.CloudShell) bool {
+	return instance.Spec.Sessions != nil || needsTerminalProxy(instance) || usesRuntimeDotfiles(instance)
+}
+
+// needsTerminalProxy returns whether terminals are routed through the agent, to record them, track activity, or
+// attach them to named sessions
+func needsTerminalProxy(instance *v1alpha1.CloudShell) bool {
+	return isAuditEnabled(instance) || config.ControllerCfg.GetActivityTracking() || instance.Spec.Sessions != nil
+}
+
+// needsAgentConfig returns whether the operator sets configuration depending on the CloudShell through its agent: the
+// shell's identity in recordings, and the owner's default dotfiles for pooled shells
+func needsAgentConfig(instance *v1alpha1.CloudShell) bool {
+	return needsTerminalProxy(instance) || usesRuntimeDotfiles(instance)
+}
+
+// needsPolling returns whether the controller periodically reads the state of a shell from its agent. The agent's
+// configuration is kept in memory, so it is checked periodically in case the agent restarted.
+func needsPolling(instance *v1alpha1.CloudShell) bool {
+	return instance.Spec.Sessions != nil || config.ControllerCfg.GetActivityTracking() || needsAgentConfig(instance)
+}
+
+// validateAgent checks that the agent image is known if the agent is needed
+func validateAgent(instance *v1alpha1.CloudShell) error {
+	if needsAgent(instance) && config.ControllerCfg.GetAgentImage() == "" {
+		return fmt.Errorf("sessions, audit and activity tracking require the agent image; set it in the operator configuration")
+	}
+	return nil
+}
+
+// getTerminalProxyArgs returns the agent arguments enabling the terminal proxy. The shell's identity in recordings is
+// set through the config endpoint rather than an argument, so that the pod of a pooled shell does not change when it
+// is claimed.
+func getTerminalProxyArgs(instance *v1alpha1.CloudShell) []string {
+	if !needsTerminalProxy(instance) {
+		return nil
+	}
+	return []string{
+		"--proxy-listen=" + terminalProxyAddress,
+		"--proxy-upstream=http://" + machineExecAddress,
+	}
+}
+
+// applyAgent adds the agent sidecar to shell pods that need it, along with the volumes used by its features
+func applyAgent(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	if !needsAgent(instance) {
+		return
+	}
+	args := []string{"agent", fmt.Sprintf("--listen=:%d", agentPort)}
+	args = append(args, getSessionsArgs(instance)...)
+	args = append(args, getTerminalProxyArgs(instance)...)
+	args = append(args, getAuditArgs(instance)...)
+	var volumeMounts []corev1.VolumeMount
+	if usesRuntimeDotfiles(instance) {
+		args = append(args, "--home-dir="+homeDir)
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      homeVolumeName,
+			MountPath: homeDir,
+		})
+	}
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Name:                     agentContainerName,
+		Image:                    config.ControllerCfg.GetAgentImage(),
+		ImagePullPolicy:          corev1.PullIfNotPresent,
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		Args:                     args,
+		VolumeMounts:             volumeMounts,
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "agent",
+				ContainerPort: agentPort,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
+		Env: []corev1.EnvVar{
+			{
+				Name: "CLOUDSHELL_AGENT_TOKEN",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: getAgentSecretName(instance)},
+						Key:                  agentTokenKey,
+					},
+				},
+			},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+		},
+	})
+	if needsTerminalProxy(instance) {
+		for i := range podSpec.Containers {
+			container := &podSpec.Containers[i]
+			if container.Name != oauthProxyContainerName {
+				continue
+			}
+			for j, arg := range container.Args {
+				if strings.HasPrefix(arg, "--upstream=") {
+					container.Args[j] = "--upstream=http://" + terminalProxyAddress
+				}
+			}
+		}
+	}
+	applySessions(podSpec, instance)
+	applyAudit(podSpec, instance)
+}
+
+// reconcileAgentSecret creates the Secret holding the token the operator authenticates to a shell's agent with, and
+// deletes it when the shell no longer runs the agent. The token is generated once and kept for the life of the shell.
+// Secrets are read through the uncached reader, to avoid caching every Secret the operator can read.
+func (r *ReconcileCloudShell) reconcileAgentSecret(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	cluster := &corev1.Secret{}
+	namespacedName := types.NamespacedName{Name: getAgentSecretName(instance), Namespace: getShellNamespace(instance)}
+	err := r.apiReader.Get(context.TODO(), namespacedName, cluster)
+	if errors.IsNotFound(err) {
+		if !needsAgent(instance) {
+			return deployStatus{Continue: true}
+		}
+		token, err := generateAgentToken()
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      namespacedName.Name,
+				Namespace: namespacedName.Namespace,
+				Labels:    getLabelsForID(instance.Status.Id),
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{agentTokenKey: token},
+		}
+		if err := r.setOwner(instance, secret); err != nil {
+			return deployStatus{Error: err}
+		}
+		ctx.log.Info("Creating agent secret")
+		err = r.client.Create(context.TODO(), secret)
+		return deployStatus{Requeue: true, Error: err}
+	} else if err != nil {
+		return deployStatus{Error: err}
+	}
+	if !needsAgent(instance) {
+		ctx.log.Info("Deleting agent secret")
+		err = r.client.Delete(context.TODO(), cluster)
+		if errors.IsNotFound(err) {
+			err = nil
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	if len(cluster.Data[agentTokenKey]) == 0 {
+		token, err := generateAgentToken()
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		ctx.log.Info("Updating agent secret")
+		cluster.Data = map[string][]byte{agentTokenKey: token}
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	return deployStatus{Continue: true}
+}
+
+func generateAgentToken() ([]byte, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(token)), nil
+}
+
+// getAgentToken returns the token the operator authenticates to a shell's agent with
+func (r *ReconcileCloudShell) getAgentToken(instance *v1alpha1.CloudShell) (string, error) {
+	secret := &corev1.Secret{}
+	namespacedName := types.NamespacedName{Name: getAgentSecretName(instance), Namespace: getShellNamespace(instance)}
+	if err := r.apiReader.Get(context.TODO(), namespacedName, secret); err != nil {
+		return "", err
+	}
+	return string(secret.Data[agentTokenKey]), nil
+}
+
+// agentRequest sends a request to the agent in a shell pod, authenticated with the shell's agent token
+func (r *ReconcileCloudShell) agentRequest(instance *v1alpha1.CloudShell, pod *corev1.Pod, method, path string, body []byte) (*http.Response, error) {
+	token, err := r.getAgentToken(instance)
+	if err != nil {
+		return nil, err
+	}
+	url := "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(agentPort)) + path
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return agentClient.Do(req)
+}
+
+// getFromAgent reads the JSON document served at path by the agent in a shell pod into out
+func (r *ReconcileCloudShell) getFromAgent(instance *v1alpha1.CloudShell, pod *corev1.Pod, path string, out interface{}) error {
+	resp, err := r.agentRequest(instance, pod, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("agent returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// putToAgent sends in as a JSON document to path on the agent in a shell pod
+func (r *ReconcileCloudShell) putToAgent(instance *v1alpha1.CloudShell, pod *corev1.Pod, path string, in interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := r.agentRequest(instance, pod, http.MethodPut, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("agent returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// reconcileAgentConfig sets the configuration of a shell that depends on the CloudShell rather than on its pod
+// through the shell's agent, once the pod runs: the shell's identity in recordings and, for shells claimed from a
+// pool, the owner's default dotfiles. Applying it at runtime keeps the pod of a pooled shell unchanged when it is
+// claimed, so that it is not restarted. For such shells, the DotfilesInstalled condition is set here.
+func (r *ReconcileCloudShell) reconcileAgentConfig(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if !needsAgentConfig(instance) {
+		return deployStatus{Continue: true}
+	}
+	desired := agent.Config{}
+	if needsTerminalProxy(instance) {
+		desired.Shell = instance.Namespace + "/" + instance.Name
+	}
+	// The owner's default dotfiles are not required to exist
+	foundDotfiles := false
+	if source, _ := getDotfilesSource(instance); source != nil && usesRuntimeDotfiles(instance) {
+		dotfiles, found, err := r.getDotfilesContents(instance, source)
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		desired.Dotfiles, foundDotfiles = dotfiles, found
+	}
+
+	pod, err := r.getRunningShellPod(instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	condition := v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.DotfilesInstalled,
+		Status:  corev1.ConditionUnknown,
+		Reason:  "Pending",
+		Message: "Waiting for the shell to start",
+	}
+	if pod != nil {
+		current := agent.Config{}
+		err := r.getFromAgent(instance, pod, agent.ConfigPath, &current)
+		if err != nil {
+			// The agent may not be listening yet; it is polled again
+			ctx.log.Info("Could not read agent config", "error", err.Error())
+		} else {
+			if current.Shell != desired.Shell || current.DotfilesHash != agent.HashDotfiles(desired.Dotfiles) {
+				ctx.log.Info("Setting agent config")
+				err = r.putToAgent(instance, pod, agent.ConfigPath, desired)
+			}
+			if err != nil {
+				ctx.log.Info("Could not set agent config", "error", err.Error())
+				condition.Status, condition.Reason, condition.Message = corev1.ConditionFalse, "InstallFailed", err.Error()
+			} else {
+				condition.Status, condition.Reason, condition.Message = corev1.ConditionTrue, "Installed", "Dotfiles were installed"
+			}
+		}
+	}
+	switch {
+	case !usesRuntimeDotfiles(instance):
+		return deployStatus{Continue: true}
+	case !foundDotfiles:
+		return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.DotfilesInstalled))
+	default:
+		return r.updateStatusIf(ctx, setCondition(&instance.Status, condition))
+	}
+}
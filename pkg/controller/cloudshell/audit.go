@@ -0,0 +1,278 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/agent"
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	recordingsVolumeName = "cloudshell-recordings"
+	recordingsDir        = "/var/run/cloudshell/recordings"
+	// The shell's upload credentials are mounted rather than passed in the environment, so that refreshed
+	// credentials reach the running agent
+	auditCredentialsVolumeName = "cloudshell-audit-credentials"
+	auditCredentialsDir        = "/var/run/cloudshell/audit"
+	// Keys of the access key in the operator's S3 credentials Secret
+	auditAccessKeyIDKey     = "accessKeyId"
+	auditSecretAccessKeyKey = "secretAccessKey"
+	// auditExpirationKey holds when the shell's upload credentials expire, in RFC 3339 format
+	auditExpirationKey = "expiration"
+	// auditCredentialsDuration is how long the upload credentials issued to a shell are valid; they are refreshed
+	// when less than auditCredentialsRefresh remains. Shells are reconciled at least every auditRequeueInterval so
+	// that this happens in time, allowing for the delay before kubelet updates the mounted Secret.
+	auditCredentialsDuration = time.Hour
+	auditCredentialsRefresh  = 30 * time.Minute
+	auditRequeueInterval     = 10 * time.Minute
+)
+
+// isAuditEnabled returns whether a shell's terminal sessions are recorded, according to the operator's audit policy
+// and the CloudShell's spec
+func isAuditEnabled(instance *v1alpha1.CloudShell) bool {
+	switch config.ControllerCfg.GetAuditPolicy() {
+	case config.AuditPolicyRequired:
+		return true
+	case config.AuditPolicyOptional:
+		return instance.Spec.Audit != nil && instance.Spec.Audit.Enabled
+	default:
+		return false
+	}
+}
+
+// validateAudit rejects CloudShells that enable audit when the operator's policy disables it, rather than silently
+// not recording them
+func validateAudit(instance *v1alpha1.CloudShell) error {
+	if instance.Spec.Audit != nil && instance.Spec.Audit.Enabled && config.ControllerCfg.GetAuditPolicy() == config.AuditPolicyDisabled {
+		return fmt.Errorf("audit is disabled by the operator's policy")
+	}
+	return nil
+}
+
+// getAuditArgs returns the agent arguments enabling recording in the terminal proxy
+func getAuditArgs(instance *v1alpha1.CloudShell) []string {
+	if !isAuditEnabled(instance) {
+		return nil
+	}
+	return []string{
+		"--sink=" + string(config.ControllerCfg.GetAuditSink()),
+		"--recordings-dir=" + recordingsDir,
+	}
+}
+
+// applyAudit gives the agent access to the sink recordings are stored in
+func applyAudit(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	if !isAuditEnabled(instance) {
+		return
+	}
+	var mounts []corev1.VolumeMount
+	var env []corev1.EnvVar
+	switch config.ControllerCfg.GetAuditSink() {
+	case config.AuditSinkPVC:
+		// Each shell writes to its own directory of the claim
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      recordingsVolumeName,
+			MountPath: recordingsDir,
+			SubPath:   instance.Status.Id,
+		})
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: recordingsVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: config.ControllerCfg.GetAuditClaimName(),
+				},
+			},
+		})
+	case config.AuditSinkS3:
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      recordingsVolumeName,
+			MountPath: recordingsDir,
+		})
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: recordingsVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      auditCredentialsVolumeName,
+			MountPath: auditCredentialsDir,
+			ReadOnly:  true,
+		})
+		var volumeDefaultMode int32 = 420
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: auditCredentialsVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  getAuditSecretName(instance),
+					DefaultMode: &volumeDefaultMode,
+				},
+			},
+		})
+		env = []corev1.EnvVar{
+			{Name: "CLOUDSHELL_S3_ENDPOINT", Value: config.ControllerCfg.GetAuditS3Endpoint()},
+			{Name: "CLOUDSHELL_S3_BUCKET", Value: config.ControllerCfg.GetAuditS3Bucket()},
+			{Name: "CLOUDSHELL_S3_REGION", Value: config.ControllerCfg.GetAuditS3Region()},
+			{Name: "CLOUDSHELL_S3_CREDENTIALS_DIR", Value: auditCredentialsDir},
+		}
+	}
+
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name == agentContainerName {
+			container.VolumeMounts = append(container.VolumeMounts, mounts...)
+			container.Env = append(container.Env, env...)
+		}
+	}
+}
+
+// usesS3Audit returns whether a shell uploads its recordings to S3
+func usesS3Audit(instance *v1alpha1.CloudShell) bool {
+	return isAuditEnabled(instance) && config.ControllerCfg.GetAuditSink() == config.AuditSinkS3
+}
+
+// getAuditPrefix returns the key prefix a shell uploads its recordings to. It includes the shell's id, so that a
+// shell recreated with the same name cannot overwrite the recordings of its predecessor.
+func getAuditPrefix(instance *v1alpha1.CloudShell) string {
+	return path.Join(instance.Namespace, instance.Name, instance.Status.Id)
+}
+
+// getAuditRequeue returns when a shell uploading to S3 must be reconciled to refresh its upload credentials, or zero
+func getAuditRequeue(instance *v1alpha1.CloudShell) time.Duration {
+	if !usesS3Audit(instance) {
+		return 0
+	}
+	return auditRequeueInterval
+}
+
+// getSpecAuditSecret issues temporary credentials for a shell to upload its recordings with. The operator's access
+// key never leaves its namespace: it is only used to assume the upload role, with a session policy restricting the
+// credentials to putting objects below the shell's prefix. Users who can read the shell's Secret therefore cannot
+// read, delete or overwrite the recordings of other shells.
+func (r *ReconcileCloudShell) getSpecAuditSecret(instance *v1alpha1.CloudShell) (*corev1.Secret, error) {
+	source := &corev1.Secret{}
+	name := config.ControllerCfg.GetAuditS3CredentialsSecret()
+	namespace := config.ControllerCfg.GetOperatorNamespace()
+	err := r.apiReader.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit credentials %s/%s: %s", namespace, name, err)
+	}
+	for _, key := range []string{auditAccessKeyIDKey, auditSecretAccessKeyKey} {
+		if len(source.Data[key]) == 0 {
+			return nil, fmt.Errorf("audit credentials %s/%s have no %s", namespace, name, key)
+		}
+	}
+	prefix := getAuditPrefix(instance)
+	creds, expiration, err := agent.AssumeRole(agent.AssumeRoleOptions{
+		Endpoint: config.ControllerCfg.GetAuditS3STSEndpoint(),
+		Region:   config.ControllerCfg.GetAuditS3Region(),
+		Credentials: agent.S3Credentials{
+			AccessKeyID:     string(source.Data[auditAccessKeyIDKey]),
+			SecretAccessKey: string(source.Data[auditSecretAccessKeyKey]),
+		},
+		RoleARN:     config.ControllerCfg.GetAuditS3RoleARN(),
+		SessionName: "cloudshell-" + instance.Status.Id,
+		Policy:      agent.GetUploadPolicy(config.ControllerCfg.GetAuditS3Bucket(), prefix),
+		Duration:    auditCredentialsDuration,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue audit credentials: %s", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getAuditSecretName(instance),
+			Namespace: getShellNamespace(instance),
+			Labels:    getLabelsForID(instance.Status.Id),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			agent.S3AccessKeyIDKey:     []byte(creds.AccessKeyID),
+			agent.S3SecretAccessKeyKey: []byte(creds.SecretAccessKey),
+			agent.S3SessionTokenKey:    []byte(creds.SessionToken),
+			agent.S3PrefixKey:          []byte(prefix),
+			auditExpirationKey:         []byte(expiration.UTC().Format(time.RFC3339)),
+		},
+	}
+	err = r.setOwner(instance, secret)
+	return secret, err
+}
+
+// needsNewAuditCredentials returns whether a shell's upload credentials are for another prefix, or about to expire
+func needsNewAuditCredentials(instance *v1alpha1.CloudShell, secret *corev1.Secret, now time.Time) bool {
+	if string(secret.Data[agent.S3PrefixKey]) != getAuditPrefix(instance) {
+		return true
+	}
+	expiration, err := time.Parse(time.RFC3339, string(secret.Data[auditExpirationKey]))
+	return err != nil || expiration.Sub(now) < auditCredentialsRefresh
+}
+
+// reconcileAuditSecret keeps the temporary credentials a shell uploads recordings to S3 with current, and deletes
+// them when they are no longer needed. Secrets are read through the uncached reader, to avoid caching every Secret
+// the operator can read.
+func (r *ReconcileCloudShell) reconcileAuditSecret(ctx reconcileContext) deployStatus {
+	cluster := &corev1.Secret{}
+	namespacedName := types.NamespacedName{Name: getAuditSecretName(ctx.instance), Namespace: getShellNamespace(ctx.instance)}
+	err := r.apiReader.Get(context.TODO(), namespacedName, cluster)
+	if errors.IsNotFound(err) {
+		if !usesS3Audit(ctx.instance) {
+			return deployStatus{Continue: true}
+		}
+		spec, err := r.getSpecAuditSecret(ctx.instance)
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		ctx.log.Info("Creating audit secret")
+		err = r.client.Create(context.TODO(), spec)
+		return deployStatus{Requeue: true, Error: err}
+	} else if err != nil {
+		return deployStatus{Error: err}
+	}
+	if !usesS3Audit(ctx.instance) {
+		ctx.log.Info("Deleting audit secret")
+		err = r.client.Delete(context.TODO(), cluster)
+		if errors.IsNotFound(err) {
+			err = nil
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	if needsNewAuditCredentials(ctx.instance, cluster, time.Now()) {
+		spec, err := r.getSpecAuditSecret(ctx.instance)
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		ctx.log.Info("Refreshing audit credentials")
+		cluster.Data = spec.Data
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	return deployStatus{Continue: true}
+}
+
+// reconcileAuditStatus sets the Audited condition, so that users of a shell can tell that their sessions are recorded
+func (r *ReconcileCloudShell) reconcileAuditStatus(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if !isAuditEnabled(instance) {
+		return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.Audited))
+	}
+	reason := "Requested"
+	if config.ControllerCfg.GetAuditPolicy() == config.AuditPolicyRequired {
+		reason = "RequiredByPolicy"
+	}
+	return r.updateStatusIf(ctx, setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.Audited,
+		Status:  corev1.ConditionTrue,
+		Reason:  reason,
+		Message: fmt.Sprintf("Terminal sessions are recorded to %s", config.ControllerCfg.GetAuditSink()),
+	}))
+}
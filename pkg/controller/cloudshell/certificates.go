@@ -0,0 +1,141 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var certificateGVK = schema.GroupVersionKind{
+	Group:   "cert-manager.io",
+	Version: "v1alpha2",
+	Kind:    "Certificate",
+}
+
+func (r *ReconcileCloudShell) reconcileCertificates(ctx reconcileContext) deployStatus {
+	if !config.ControllerCfg.UseCertManager() {
+		return deployStatus{Continue: true}
+	}
+	certs, err := r.getSpecCertificates(ctx.instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	for _, cert := range certs {
+		ok, err := r.reconcileCertificate(cert, ctx.log)
+		if err != nil || !ok {
+			return deployStatus{Requeue: true, Error: err}
+		}
+	}
+	return deployStatus{Continue: true}
+}
+
+// getSpecCertificates returns the cert-manager Certificates for a shell: one for the in-cluster service, used by the
+// proxy for re-encrypt, and one for the external hostname, used by the Ingress.
+func (r *ReconcileCloudShell) getSpecCertificates(instance *v1alpha1.CloudShell) ([]*unstructured.Unstructured, error) {
+	serviceName := getServiceName(instance)
+	serviceCert, err := r.getSpecCertificate(instance, getProxySecretName(instance), []string{
+		fmt.Sprintf("%s.%s.svc", serviceName, getShellNamespace(instance)),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, getShellNamespace(instance)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	externalCert, err := r.getSpecCertificate(instance, getExternalTLSSecretName(instance), []string{getHostname(instance)})
+	if err != nil {
+		return nil, err
+	}
+	return []*unstructured.Unstructured{serviceCert, externalCert}, nil
+}
+
+func (r *ReconcileCloudShell) getSpecCertificate(instance *v1alpha1.CloudShell, secretName string, dnsNames []string) (*unstructured.Unstructured, error) {
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetName(secretName)
+	cert.SetNamespace(getShellNamespace(instance))
+	cert.SetLabels(getLabelsForID(instance.Status.Id))
+
+	fields := map[string]interface{}{
+		"secretName": secretName,
+		"dnsNames":   toInterfaceSlice(dnsNames),
+		"issuerRef": map[string]interface{}{
+			"name":  config.ControllerCfg.GetCertIssuerName(),
+			"kind":  config.ControllerCfg.GetCertIssuerKind(),
+			"group": certificateGVK.Group,
+		},
+	}
+	if err := unstructured.SetNestedMap(cert.Object, fields, "spec"); err != nil {
+		return nil, err
+	}
+	err := r.setOwner(instance, cert)
+	return cert, err
+}
+
+func (r *ReconcileCloudShell) reconcileCertificate(spec *unstructured.Unstructured, log logr.Logger) (ok bool, err error) {
+	cluster, err := r.getClusterCertificate(spec)
+	if err != nil {
+		return false, err
+	}
+	if cluster == nil {
+		log.Info("Creating certificate", "name", spec.GetName())
+		err = r.client.Create(context.TODO(), spec)
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !certificateSpecMatches(spec, cluster) {
+		log.Info("Updating certificate", "name", spec.GetName())
+		cluster.Object["spec"] = spec.Object["spec"]
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// certificateSpecMatches compares only the spec fields set by the operator, as cert-manager may default others.
+func certificateSpecMatches(spec, cluster *unstructured.Unstructured) bool {
+	specFields, _, _ := unstructured.NestedMap(spec.Object, "spec")
+	clusterFields, _, _ := unstructured.NestedMap(cluster.Object, "spec")
+	for key, value := range specFields {
+		if !reflect.DeepEqual(value, clusterFields[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ReconcileCloudShell) getClusterCertificate(spec *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	found := &unstructured.Unstructured{}
+	found.SetGroupVersionKind(certificateGVK)
+	namespacedName := types.NamespacedName{
+		Name:      spec.GetName(),
+		Namespace: spec.GetNamespace(),
+	}
+	err := r.client.Get(context.TODO(), namespacedName, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return found, nil
+}
+
+func toInterfaceSlice(in []string) []interface{} {
+	out := make([]interface{}, len(in))
+	for i, s := range in {
+		out[i] = s
+	}
+	return out
+}
@@ -2,14 +2,21 @@ package cloudshell
 
 import (
 	"context"
+	"time"
+
 	"github.com/go-logr/logr"
 	routeV1 "github.com/openshift/api/route/v1"
 
 	cloudshellv1alpha1 "github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
@@ -35,12 +42,33 @@ var log = logf.Log.WithName("controller_cloudshell")
 // Add creates a new CloudShell Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	r, err := newReconciler(mgr)
+	if err != nil {
+		return err
+	}
+	if err := add(mgr, r); err != nil {
+		return err
+	}
+	if err := registerMetrics(mgr.GetClient()); err != nil {
+		return err
+	}
+	addWebhooks(mgr)
+	return addPrereqs(mgr)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
-	return &ReconcileCloudShell{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+func newReconciler(mgr manager.Manager) (reconcile.Reconciler, error) {
+	clusterCA, err := loadClusterCA(mgr.GetConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &ReconcileCloudShell{
+		client:    mgr.GetClient(),
+		apiReader: mgr.GetAPIReader(),
+		scheme:    mgr.GetScheme(),
+		clusterCA: clusterCA,
+		recorder:  mgr.GetEventRecorderFor("cloudshell-controller"),
+	}, nil
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
@@ -57,39 +85,79 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
-	// Watch for changes to secondary resources
-	err = c.Watch(&source.Kind{Type: &corev1.Service{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &cloudshellv1alpha1.CloudShell{},
-	})
-	if err != nil {
-		return err
+	// Re-check CloudShells when namespace labels change, if serving is restricted by a namespace selector. Namespaces
+	// are cluster-scoped, so this is only possible when the manager watches all namespaces.
+	if !config.ControllerCfg.GetNamespaceSelector().Empty() && config.ControllerCfg.IsClusterWide() {
+		err = c.Watch(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+				return getRequestsForNamespace(mgr.GetClient(), obj.Meta.GetName())
+			}),
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	err = c.Watch(&source.Kind{Type: &routeV1.Route{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &cloudshellv1alpha1.CloudShell{},
-	})
+	// Re-check CloudShells when the ConfigMaps holding their dotfiles change
+	err = mgr.GetFieldIndexer().IndexField(&cloudshellv1alpha1.CloudShell{}, dotfilesConfigMapIndex, indexDotfilesConfigMap)
 	if err != nil {
 		return err
 	}
-
-	err = c.Watch(&source.Kind{Type: &appsv1.Deployment{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &cloudshellv1alpha1.CloudShell{},
+	err = c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+			return getRequestsForDotfiles(mgr.GetClient(), obj.Meta.GetNamespace(), obj.Meta.GetName())
+		}),
 	})
 	if err != nil {
 		return err
 	}
 
-	err = c.Watch(&source.Kind{Type: &corev1.ServiceAccount{}}, &handler.EnqueueRequestForOwner{
+	// Restore home directories once the CloudShellSnapshots they are restored from become ready
+	if config.ControllerCfg.HasVolumeSnapshots() {
+		err = c.Watch(&source.Kind{Type: &cloudshellv1alpha1.CloudShellSnapshot{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+				return getRequestsForSnapshot(mgr.GetClient(), obj.Meta.GetNamespace(), obj.Meta.GetName())
+			}),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Watch for changes to secondary resources
+	secondary := []runtime.Object{&corev1.Service{}, &appsv1.Deployment{}, &appsv1.StatefulSet{}, &corev1.ServiceAccount{}, &networkingv1.NetworkPolicy{}}
+	if config.ControllerCfg.IsOpenShift() {
+		secondary = append(secondary, &routeV1.Route{})
+	} else {
+		secondary = append(secondary, &networkingv1beta1.Ingress{})
+	}
+	if config.ControllerCfg.UseCertManager() {
+		certificate := &unstructured.Unstructured{}
+		certificate.SetGroupVersionKind(certificateGVK)
+		secondary = append(secondary, certificate)
+	}
+	for _, obj := range secondary {
+		if err := watchOwned(c, obj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watchOwned watches objects of obj's type created for CloudShells, whether they are owned through a controller
+// reference or, for objects in per-user namespaces, through the marks set by setOwner.
+func watchOwned(c controller.Controller, obj runtime.Object) error {
+	err := c.Watch(&source.Kind{Type: obj}, &handler.EnqueueRequestForOwner{
 		IsController: true,
 		OwnerType:    &cloudshellv1alpha1.CloudShell{},
 	})
 	if err != nil {
 		return err
 	}
-
+	if config.ControllerCfg.GetNamespaceMode() == config.NamespaceModePerUser {
+		return c.Watch(&source.Kind{Type: obj}, enqueueForOwnerLabels)
+	}
 	return nil
 }
 
@@ -101,7 +169,13 @@ type ReconcileCloudShell struct {
 	// This client, initialized using mgr.Client() above, is a split client
 	// that reads objects from the cache and writes to the apiserver
 	client client.Client
-	scheme *runtime.Scheme
+	// apiReader reads directly from the apiserver, for objects outside the manager's cache (e.g. namespaces)
+	apiReader client.Reader
+	scheme    *runtime.Scheme
+	// clusterCA is the CA bundle for the API server, written to shell kubeconfigs
+	clusterCA []byte
+	// recorder emits events about CloudShells, such as warnings before they expire
+	recorder record.EventRecorder
 }
 
 func (r *ReconcileCloudShell) Reconcile(request reconcile.Request) (reconcile.Result, error) {
@@ -122,7 +196,41 @@ func (r *ReconcileCloudShell) Reconcile(request reconcile.Request) (reconcile.Re
 		return reconcile.Result{}, err
 	}
 
+	allowed, err := namespaceAllowed(r.apiReader, request.Namespace)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !allowed {
+		reqLogger.Info("Namespace does not match namespace selector; ignoring CloudShell")
+		return reconcile.Result{}, nil
+	}
+
+	if instance.DeletionTimestamp != nil {
+		return r.finalize(reconcileContext{instance: instance, log: reqLogger})
+	}
+
+	if err := validateShellNamespace(instance); err != nil {
+		// Cannot proceed until the CloudShell is updated
+		reqLogger.Error(err, "Invalid CloudShell")
+		return reconcile.Result{}, nil
+	}
+
+	if needsCleanupFinalizer(instance) && !hasFinalizer(instance, cleanupFinalizer) {
+		instance.Finalizers = append(instance.Finalizers, cleanupFinalizer)
+		err = r.client.Update(context.TODO(), instance)
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	if instance.Annotations[claimedByAnnotation] != "" {
+		// The shell's resources are being handed over to the CloudShell claiming it from its pool
+		return reconcile.Result{}, nil
+	}
+
 	if instance.Status.Id == "" {
+		claimed, err := r.claimPooledShell(reqLogger, instance)
+		if err != nil || claimed {
+			return reconcile.Result{Requeue: claimed}, err
+		}
 		id, err := getID(instance)
 		if err != nil {
 			// TODO: Fail
@@ -139,25 +247,128 @@ func (r *ReconcileCloudShell) Reconcile(request reconcile.Request) (reconcile.Re
 		log:      reqLogger,
 	}
 
-	prereqStatus := r.reconcilePrereqs(ctx)
-	if !prereqStatus.Continue {
-		return reconcile.Result{}, prereqStatus.Error
+	lifetimeStatus := runStep("lifetime", ctx, r.reconcileLifetime)
+	if !lifetimeStatus.Continue {
+		return reconcile.Result{Requeue: lifetimeStatus.Requeue}, lifetimeStatus.Error
+	}
+
+	quotaStatus := runStep("quota", ctx, r.reconcileQuota)
+	if !quotaStatus.Continue {
+		return reconcile.Result{Requeue: quotaStatus.Requeue}, quotaStatus.Error
 	}
 
-	networkStatus := r.reconcileRouting(ctx)
+	namespaceStatus := runStep("shellNamespace", ctx, r.reconcileShellNamespace)
+	if !namespaceStatus.Continue {
+		return reconcile.Result{Requeue: namespaceStatus.Requeue}, namespaceStatus.Error
+	}
+
+	certificateStatus := runStep("certificates", ctx, r.reconcileCertificates)
+	if !certificateStatus.Continue {
+		return reconcile.Result{Requeue: certificateStatus.Requeue}, certificateStatus.Error
+	}
+
+	networkPolicyStatus := runStep("networkPolicy", ctx, r.reconcileNetworkPolicy)
+	if !networkPolicyStatus.Continue {
+		return reconcile.Result{Requeue: networkPolicyStatus.Requeue}, networkPolicyStatus.Error
+	}
+
+	networkStatus := runStep("routing", ctx, r.reconcileRouting)
 	if !networkStatus.Continue {
 		return reconcile.Result{Requeue: networkStatus.Requeue}, networkStatus.Error
 	}
 
-	serviceAcctStatus := r.reconcileServiceAcct(ctx)
+	serviceAcctStatus := runStep("serviceAcct", ctx, r.reconcileServiceAcct)
 	if !serviceAcctStatus.Continue {
 		return reconcile.Result{Requeue: serviceAcctStatus.Requeue}, serviceAcctStatus.Error
 	}
 
-	deploymentStatus := r.reconcileDeployment(ctx)
-	if !deploymentStatus.Continue {
-		return reconcile.Result{Requeue: deploymentStatus.Requeue}, deploymentStatus.Error
+	kubeconfigStatus := runStep("kubeconfig", ctx, r.reconcileKubeconfig)
+	if !kubeconfigStatus.Continue {
+		return reconcile.Result{Requeue: kubeconfigStatus.Requeue}, kubeconfigStatus.Error
+	}
+
+	agentSecretStatus := runStep("agentSecret", ctx, r.reconcileAgentSecret)
+	if !agentSecretStatus.Continue {
+		return reconcile.Result{Requeue: agentSecretStatus.Requeue}, agentSecretStatus.Error
+	}
+
+	auditSecretStatus := runStep("auditSecret", ctx, r.reconcileAuditSecret)
+	if !auditSecretStatus.Continue {
+		return reconcile.Result{Requeue: auditSecretStatus.Requeue}, auditSecretStatus.Error
+	}
+
+	actionsStatus := runStep("actions", ctx, r.reconcileActions)
+	if !actionsStatus.Continue {
+		return reconcile.Result{Requeue: actionsStatus.Requeue}, actionsStatus.Error
+	}
+
+	imageStatus := runStep("image", ctx, r.reconcileImage)
+	if !imageStatus.Continue {
+		return reconcile.Result{Requeue: imageStatus.Requeue}, imageStatus.Error
 	}
 
-	return reconcile.Result{}, nil
+	homeVolumeStatus := runStep("homeVolume", ctx, r.reconcileHomeVolume)
+	if !homeVolumeStatus.Continue {
+		return reconcile.Result{Requeue: homeVolumeStatus.Requeue}, homeVolumeStatus.Error
+	}
+
+	workloadStatus := runStep("workload", ctx, r.reconcileWorkload)
+	if !workloadStatus.Continue {
+		return reconcile.Result{Requeue: workloadStatus.Requeue}, workloadStatus.Error
+	}
+
+	projectsStatus := runStep("projectsStatus", ctx, r.reconcileProjectsStatus)
+	if !projectsStatus.Continue {
+		return reconcile.Result{Requeue: projectsStatus.Requeue}, projectsStatus.Error
+	}
+
+	agentConfigStatus := runStep("agentConfig", ctx, r.reconcileAgentConfig)
+	if !agentConfigStatus.Continue {
+		return reconcile.Result{Requeue: agentConfigStatus.Requeue}, agentConfigStatus.Error
+	}
+
+	dotfilesStatus := runStep("dotfilesStatus", ctx, r.reconcileDotfilesStatus)
+	if !dotfilesStatus.Continue {
+		return reconcile.Result{Requeue: dotfilesStatus.Requeue}, dotfilesStatus.Error
+	}
+
+	credentialsStatus := runStep("credentialsStatus", ctx, r.reconcileCredentialsStatus)
+	if !credentialsStatus.Continue {
+		return reconcile.Result{Requeue: credentialsStatus.Requeue}, credentialsStatus.Error
+	}
+
+	sessionsStatus := runStep("sessionsStatus", ctx, r.reconcileSessionsStatus)
+	if !sessionsStatus.Continue {
+		return reconcile.Result{Requeue: sessionsStatus.Requeue}, sessionsStatus.Error
+	}
+
+	auditStatus := runStep("auditStatus", ctx, r.reconcileAuditStatus)
+	if !auditStatus.Continue {
+		return reconcile.Result{Requeue: auditStatus.Requeue}, auditStatus.Error
+	}
+
+	activityStatus := runStep("activityStatus", ctx, r.reconcileActivityStatus)
+	if !activityStatus.Continue {
+		return reconcile.Result{Requeue: activityStatus.Requeue}, activityStatus.Error
+	}
+
+	snapshots := runStep("snapshots", ctx, r.reconcileSnapshotSchedule)
+	if !snapshots.Continue {
+		return reconcile.Result{Requeue: snapshots.Requeue}, snapshots.Error
+	}
+
+	result := reconcile.Result{}
+	if needsPolling(instance) {
+		// Sessions and activity are not watched; poll the agent for changes
+		result.RequeueAfter = agentPollInterval
+	}
+	for _, next := range []time.Duration{
+		getLifetimeRequeue(instance, time.Now()), getQuotaRequeue(instance), getImageRequeue(instance, time.Now()),
+		r.getSnapshotRequeue(instance, time.Now()), getAuditRequeue(instance),
+	} {
+		if next > 0 && (result.RequeueAfter == 0 || next < result.RequeueAfter) {
+			result.RequeueAfter = next
+		}
+	}
+	return result, nil
 }
@@ -3,10 +3,40 @@ package cloudshell
 import (
 	"fmt"
 	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
 	"github.com/google/uuid"
 	"strings"
 )
 
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "cloudshell-operator"
+)
+
+// Names of the containers managed by the operator
+const (
+	shellHostContainerName   = "shell-host"
+	machineExecContainerName = "machine-exec"
+	oauthProxyContainerName  = "oauth-proxy"
+	agentContainerName       = "cloudshell-agent"
+)
+
+// The home directory of the shell and the volume mounted there
+const (
+	homeVolumeName = "cloudshell-home"
+	homeDir        = "/home/user"
+)
+
+// proxyPort is the port the authenticating proxy listens on; it is the only port exposed by shell pods
+const proxyPort = 8443
+
+// agentPort is the port the agent sidecar serves on. It is not exposed through the shell's service, is only reachable
+// from the operator's pods, and requires the token from the shell's agent Secret.
+const agentPort = 4445
+
+// operatorPodLabels select the operator's pods, which are allowed to reach the agent in shell pods
+var operatorPodLabels = map[string]string{"name": "cloudshell-operator"}
+
 func getID(instance *v1alpha1.CloudShell) (string, error) {
 	uid, err := uuid.Parse(string(instance.UID))
 	if err != nil {
@@ -17,11 +47,19 @@ func getID(instance *v1alpha1.CloudShell) (string, error) {
 
 func getLabelsForID(id string) map[string]string {
 	return map[string]string{
-		"cloudshell.id": id,
+		v1alpha1.IDLabel:   id,
 		"che.workspace_id": id,
 	}
 }
 
+func getWorkloadName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s", instance.Status.Id)
+}
+
+func getHomeClaimName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s-home", instance.Status.Id)
+}
+
 func getServiceAccountName(instance *v1alpha1.CloudShell) string {
 	return fmt.Sprintf("cloudshell-%s", instance.Status.Id)
 }
@@ -37,3 +75,31 @@ func getRouteName(instance *v1alpha1.CloudShell) string {
 func getServiceName(instance *v1alpha1.CloudShell) string {
 	return fmt.Sprintf("cloudshell-%s", instance.Status.Id)
 }
+
+func getIngressName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s", instance.Status.Id)
+}
+
+func getExternalTLSSecretName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s-tls", instance.Status.Id)
+}
+
+func getHostname(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("%s-%s.%s", "cloudshell", instance.Status.Id, config.ControllerCfg.GetRoutingSuffix())
+}
+
+func getNetworkPolicyName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s", instance.Status.Id)
+}
+
+func getAuditSecretName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s-audit", instance.Status.Id)
+}
+
+func getKubeconfigSecretName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s-kubeconfig", instance.Status.Id)
+}
+
+func getAgentSecretName(instance *v1alpha1.CloudShell) string {
+	return fmt.Sprintf("cloudshell-%s-agent", instance.Status.Id)
+}
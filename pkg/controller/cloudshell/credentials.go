@@ -0,0 +1,258 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	credentialsContainerName = "credentials"
+	// credentialsMountDir is where credential Secrets are mounted; their keys are linked into the home directory
+	credentialsMountDir = "/var/run/cloudshell/credentials"
+)
+
+// linkFunction is the shell function used by the credentials container to link a file into the home directory
+const linkFunction = `link() {
+  mkdir -p "${2%/*}" && ln -sfn "$1" "$2" || echo "credentials: failed to link $2" >> /dev/termination-log
+}
+`
+
+// credentialDefaults are the default Secret key and path relative to the home directory for each credential type
+var credentialDefaults = map[v1alpha1.CredentialType]struct{ key, path string }{
+	v1alpha1.KubeconfigCredential: {"config", ".kube/config"},
+	v1alpha1.DockerCredential:     {".dockerconfigjson", ".docker/config.json"},
+	v1alpha1.AWSCredential:        {"credentials", ".aws/credentials"},
+	v1alpha1.FileCredential:       {},
+}
+
+// getCredentialKeyAndPath returns the Secret key for a file credential and the absolute path it is linked to
+func getCredentialKeyAndPath(credential v1alpha1.Credential) (key, linkPath string) {
+	defaults := credentialDefaults[credential.Type]
+	key, linkPath = credential.Key, credential.Path
+	if key == "" {
+		key = defaults.key
+	}
+	if linkPath == "" {
+		linkPath = defaults.path
+	}
+	return key, path.Join(homeDir, linkPath)
+}
+
+func getCredentialVolumeName(index int) string {
+	return fmt.Sprintf("credentials-%d", index)
+}
+
+// validateCredentials checks that credentials have unique names and valid types, and that file credentials are
+// linked to distinct paths within the home directory
+func validateCredentials(instance *v1alpha1.CloudShell) error {
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	for _, credential := range instance.Spec.Credentials {
+		if credential.Name == "" {
+			return fmt.Errorf("credentials must have a name")
+		}
+		if names[credential.Name] {
+			return fmt.Errorf("credential name %s is duplicated", credential.Name)
+		}
+		names[credential.Name] = true
+		if credential.Secret == "" {
+			return fmt.Errorf("credential %s must have a secret", credential.Name)
+		}
+		if credential.Type == v1alpha1.EnvCredential {
+			if credential.Key != "" || credential.Path != "" {
+				return fmt.Errorf("credential %s: key and path are not used for env credentials", credential.Name)
+			}
+			continue
+		}
+		if _, ok := credentialDefaults[credential.Type]; !ok {
+			return fmt.Errorf("credential %s has unsupported type %q", credential.Name, credential.Type)
+		}
+		if credential.Type == v1alpha1.FileCredential && (credential.Key == "" || credential.Path == "") {
+			return fmt.Errorf("credential %s: key and path are required for file credentials", credential.Name)
+		}
+		if relPath := credential.Path; relPath != "" {
+			if path.IsAbs(relPath) || path.Clean(relPath) != relPath || relPath == "." || strings.HasPrefix(relPath, "..") {
+				return fmt.Errorf("credential %s: path %s must be a relative path within the home directory", credential.Name, relPath)
+			}
+		}
+		_, linkPath := getCredentialKeyAndPath(credential)
+		if paths[linkPath] {
+			return fmt.Errorf("credential %s: path %s is duplicated", credential.Name, linkPath)
+		}
+		paths[linkPath] = true
+	}
+	return nil
+}
+
+// applyCredentials mounts a CloudShell's credential Secrets. Env credentials are added to the shell's environment;
+// the keys of other credentials are linked into the home directory by an init container, so that the directories
+// they are linked in are owned by the shell's user. Secrets are optional, so that a Secret deleted after it was
+// checked does not prevent the shell from starting.
+func applyCredentials(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	var volumeDefaultMode int32 = 420
+	optional := true
+	var script strings.Builder
+	var mounts []corev1.VolumeMount
+	for idx, credential := range instance.Spec.Credentials {
+		if credential.Type == v1alpha1.EnvCredential {
+			for i := range podSpec.Containers {
+				if podSpec.Containers[i].Name == shellHostContainerName {
+					podSpec.Containers[i].EnvFrom = append(podSpec.Containers[i].EnvFrom, corev1.EnvFromSource{
+						Prefix: credential.EnvPrefix,
+						SecretRef: &corev1.SecretEnvSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: credential.Secret},
+							Optional:             &optional,
+						},
+					})
+				}
+			}
+			continue
+		}
+		volumeName := getCredentialVolumeName(idx)
+		mountPath := path.Join(credentialsMountDir, volumeName)
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  credential.Secret,
+					DefaultMode: &volumeDefaultMode,
+					Optional:    &optional,
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: mountPath,
+			ReadOnly:  true,
+		})
+		key, linkPath := getCredentialKeyAndPath(credential)
+		script.WriteString("link " + shellQuote(path.Join(mountPath, key)) + " " + shellQuote(linkPath) + "\n")
+	}
+	if len(mounts) == 0 {
+		return
+	}
+
+	podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+		Name:                     credentialsContainerName,
+		Image:                    config.ControllerCfg.GetGitImage(),
+		ImagePullPolicy:          corev1.PullIfNotPresent,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		Command:                  []string{"/bin/sh", "-c", linkFunction + script.String()},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      homeVolumeName,
+				MountPath: homeDir,
+			},
+		},
+	})
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == shellHostContainerName {
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, mounts...)
+		}
+	}
+}
+
+// getUnavailableCredentials returns a message for each credential whose Secret does not exist, keyed by credential
+// name. Access to the Secrets is checked by the access webhook when the CloudShell is created or updated, for the
+// user making the request.
+func (r *ReconcileCloudShell) getUnavailableCredentials(instance *v1alpha1.CloudShell) (map[string]string, error) {
+	unavailable := map[string]string{}
+	namespace := getShellNamespace(instance)
+	checked := map[string]string{}
+	for _, credential := range instance.Spec.Credentials {
+		message, ok := checked[credential.Secret]
+		if !ok {
+			var err error
+			message, err = r.checkCredentialSecret(namespace, credential.Secret)
+			if err != nil {
+				return nil, err
+			}
+			checked[credential.Secret] = message
+		}
+		if message != "" {
+			unavailable[credential.Name] = message
+		}
+	}
+	return unavailable, nil
+}
+
+// checkCredentialSecret returns a message describing why a Secret may not be used for a shell's credentials, or an
+// empty string if it may be used
+func (r *ReconcileCloudShell) checkCredentialSecret(namespace, name string) (string, error) {
+	secret := &corev1.Secret{}
+	err := r.apiReader.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, secret)
+	if errors.IsNotFound(err) {
+		return fmt.Sprintf("Secret %s not found in namespace %s", name, namespace), nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// withoutCredentials returns a copy of instance without the credentials named in unavailable
+func withoutCredentials(instance *v1alpha1.CloudShell, unavailable map[string]string) *v1alpha1.CloudShell {
+	filtered := instance.DeepCopy()
+	filtered.Spec.Credentials = nil
+	for _, credential := range instance.Spec.Credentials {
+		if _, ok := unavailable[credential.Name]; !ok {
+			filtered.Spec.Credentials = append(filtered.Spec.Credentials, credential)
+		}
+	}
+	return filtered
+}
+
+// reconcileCredentialsStatus sets the CredentialsAvailable condition. Unavailable credentials are rechecked
+// periodically, as Secrets are not watched.
+func (r *ReconcileCloudShell) reconcileCredentialsStatus(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if len(instance.Spec.Credentials) == 0 {
+		return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.CredentialsAvailable))
+	}
+	unavailable, err := r.getUnavailableCredentials(instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	if len(unavailable) > 0 {
+		var messages []string
+		for name, message := range unavailable {
+			messages = append(messages, fmt.Sprintf("%s: %s", name, message))
+		}
+		sort.Strings(messages)
+		status := r.updateStatusIf(ctx, setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+			Type:    v1alpha1.CredentialsAvailable,
+			Status:  corev1.ConditionFalse,
+			Reason:  "Unavailable",
+			Message: strings.Join(messages, "; "),
+		}))
+		status.Continue = false
+		status.Requeue = true
+		return status
+	}
+
+	condition := v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.CredentialsAvailable,
+		Status:  corev1.ConditionTrue,
+		Reason:  "Available",
+		Message: "All credentials are available",
+	}
+	for _, credential := range instance.Spec.Credentials {
+		if credential.Type != v1alpha1.EnvCredential {
+			state, err := r.getInitContainerState(instance, credentialsContainerName)
+			if err != nil {
+				return deployStatus{Error: err}
+			}
+			condition = getInitContainerCondition(v1alpha1.CredentialsAvailable, state, condition.Reason, condition.Message, "LinkFailed")
+			break
+		}
+	}
+	return r.updateStatusIf(ctx, setCondition(&instance.Status, condition))
+}
@@ -1,141 +1,19 @@
 package cloudshell
 
 import (
-	"context"
 	"fmt"
 	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
-	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
-	appsv1 "k8s.io/api/apps/v1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
-	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"strings"
 )
 
 const openShiftProxySARFmt = `{"namespace": "%s", "resource": "pods", "name": "%s", "verb": "exec"}`
 
-var deploymentDiffOpts = cmp.Options{
-	cmpopts.IgnoreFields(appsv1.Deployment{}, "TypeMeta", "ObjectMeta", "Status"),
-	cmpopts.IgnoreFields(appsv1.DeploymentSpec{}, "RevisionHistoryLimit", "ProgressDeadlineSeconds"),
-	cmpopts.IgnoreFields(corev1.PodSpec{}, "DNSPolicy", "SchedulerName", "DeprecatedServiceAccount", "RestartPolicy", "SecurityContext"),
-	cmpopts.IgnoreFields(corev1.Container{}, "TerminationMessagePath", "TerminationMessagePolicy", "ImagePullPolicy"),
-	cmpopts.SortSlices(func(a, b corev1.Container) bool {
-		return strings.Compare(a.Name, b.Name) > 0
-	}),
-	cmpopts.SortSlices(func(a, b corev1.Volume) bool {
-		return strings.Compare(a.Name, b.Name) > 0
-	}),
-}
-
-func (r *ReconcileCloudShell) reconcileDeployment(ctx reconcileContext) deployStatus {
-	spec, err := r.getSpecDeployment(ctx.instance)
-	if err != nil {
-		return deployStatus{Error: err}
-	}
-
-	cluster, err := r.getClusterDeployment(spec)
-	if err != nil {
-		return deployStatus{Error: err}
-	}
-	if cluster == nil {
-		ctx.log.Info("Creating deployment")
-		err = r.client.Create(context.TODO(), spec)
-		if errors.IsAlreadyExists(err) {
-			return deployStatus{Requeue: true}
-		}
-		return deployStatus{Requeue: true, Error: err}
-	}
-	if !cmp.Equal(spec, cluster, deploymentDiffOpts) {
-		ctx.log.Info("Patching deployment")
-		patch := client.MergeFrom(spec)
-		err = r.client.Patch(context.TODO(), cluster, patch)
-		if errors.IsConflict(err) {
-			// Modified since we started, requeue
-			return deployStatus{Requeue: true}
-		}
-		return deployStatus{Requeue: true, Error: err}
-	}
-
-	if !deploymentReady(cluster) {
-		ctx.log.Info("Deployment not ready")
-		return deployStatus{}
-	}
-
-	return deployStatus{
-		Continue: true,
-	}
-}
-
-func deploymentReady(deployment *appsv1.Deployment) (ready bool) {
-	// TODO: available doesn't mean what you might think
-	for _, condition := range deployment.Status.Conditions {
-		if condition.Type != appsv1.DeploymentAvailable || condition.Status != corev1.ConditionTrue {
-			return true
-		}
-	}
-	return false
-}
-
-func (r *ReconcileCloudShell) getClusterDeployment(spec *appsv1.Deployment) (*appsv1.Deployment, error) {
-	deployment := &appsv1.Deployment{}
-	namespacedName := types.NamespacedName{
-		Namespace: spec.Namespace,
-		Name:      spec.Name,
-	}
-	err := r.client.Get(context.TODO(), namespacedName, deployment)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return deployment, nil
-}
-
-func (r *ReconcileCloudShell) getSpecDeployment(instance *v1alpha1.CloudShell) (*appsv1.Deployment, error) {
-	id := instance.Status.Id
-	labels := getLabelsForID(id)
-	replicas := int32(1)
-	rollingUpdateParam := intstr.FromInt(1)
-
-	deployment := &appsv1.Deployment{
-		ObjectMeta: v1.ObjectMeta{
-			Name:      "cloudshell-" + id,
-			Namespace: instance.Namespace,
-			Labels:    labels,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: labels,
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: v1.ObjectMeta{
-					Name:      instance.Status.Id,
-					Namespace: instance.Namespace,
-					Labels:    labels,
-				},
-				Spec: getSpecPod(instance),
-			},
-			Strategy: appsv1.DeploymentStrategy{
-				Type: "RollingUpdate",
-				RollingUpdate: &appsv1.RollingUpdateDeployment{
-					MaxSurge:       &rollingUpdateParam,
-					MaxUnavailable: &rollingUpdateParam,
-				},
-			},
-		},
-	}
-	err := controllerutil.SetControllerReference(instance, deployment, r.scheme)
-	return deployment, err
-}
+// machineExecAddress is the address machine-exec listens on. It is bound to loopback so that exec sessions can only
+// be opened through the authenticating proxy in the same pod.
+const machineExecAddress = "127.0.0.1:4444"
 
 func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 	terminationGracePeriod := int64(1)
@@ -150,7 +28,7 @@ func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 		},
 	}
 
-	return corev1.PodSpec{
+	podSpec := corev1.PodSpec{
 		Volumes: []corev1.Volume{
 			{
 				Name: proxySecretName,
@@ -161,12 +39,16 @@ func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 					},
 				},
 			},
+			{
+				Name:         homeVolumeName,
+				VolumeSource: getHomeVolumeSource(instance),
+			},
 		},
 		Containers: []corev1.Container{
 			{
-				Name:                     "shell-host",
-				Image:                    instance.Spec.Image,
-				ImagePullPolicy:          corev1.PullAlways,
+				Name:                     shellHostContainerName,
+				Image:                    getShellImage(instance),
+				ImagePullPolicy:          getPullPolicy(getShellImage(instance)),
 				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
 				Resources:                resources,
 				Args:                     []string{"tail", "-f", "/dev/null"}, // TODO: make configurable
@@ -175,20 +57,25 @@ func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 						Name:  "CHE_MACHINE_NAME",
 						Value: "cloud-shell",
 					},
+					{
+						Name:  "HOME",
+						Value: homeDir,
+					},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      homeVolumeName,
+						MountPath: homeDir,
+					},
 				},
 			},
 			{
-				Name:                     "machine-exec",
-				Image:                    "docker.io/amisevsk/che-machine-exec:dev",
+				Name:                     machineExecContainerName,
+				Image:                    config.ControllerCfg.GetMachineExecImage(),
 				Resources:                resources,
-				ImagePullPolicy:          corev1.PullAlways,
+				ImagePullPolicy:          getPullPolicy(config.ControllerCfg.GetMachineExecImage()),
 				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
-				Ports: []corev1.ContainerPort{
-					{
-						ContainerPort: 4444,
-						Protocol:      corev1.ProtocolTCP,
-					},
-				},
+				Args:                     []string{"--url=" + machineExecAddress},
 				Env: []corev1.EnvVar{
 					{
 						Name:  "CHE_WORKSPACE_ID",
@@ -197,11 +84,11 @@ func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 				},
 			},
 			{
-				Name:  "oauth-proxy",
-				Image: "openshift/oauth-proxy:latest",
+				Name:  oauthProxyContainerName,
+				Image: config.ControllerCfg.GetOAuthProxyImage(),
 				Ports: []corev1.ContainerPort{
 					{
-						ContainerPort: 8443,
+						ContainerPort: proxyPort,
 						Protocol:      corev1.ProtocolTCP,
 					},
 				},
@@ -211,16 +98,16 @@ func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 						MountPath: "/etc/tls/private",
 					},
 				},
-				ImagePullPolicy:          corev1.PullAlways,
+				ImagePullPolicy:          getPullPolicy(config.ControllerCfg.GetOAuthProxyImage()),
 				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
 				Resources:                resources,
 				Args: []string{
-					"--https-address=:8443",
+					fmt.Sprintf("--https-address=:%d", proxyPort),
 					"--http-address=127.0.0.1:8080",
 					"--provider=openshift",
 					// TODO:
 					"--openshift-service-account=" + getServiceAccountName(instance),
-					"--upstream=http://localhost:4444",
+					"--upstream=http://" + machineExecAddress,
 					"--tls-cert=/etc/tls/private/tls.crt",
 					"--tls-key=/etc/tls/private/tls.key",
 					"--cookie-secret=SECRET_TODO", // TODO
@@ -232,4 +119,79 @@ func getSpecPod(instance *v1alpha1.CloudShell) corev1.PodSpec {
 		TerminationGracePeriodSeconds: &terminationGracePeriod,
 		ServiceAccountName:            getServiceAccountName(instance),
 	}
+	applyDotfiles(&podSpec, instance)
+	applyProjects(&podSpec, instance)
+	applyCredentials(&podSpec, instance)
+	applyKubeconfig(&podSpec, instance)
+	applyAPIToken(&podSpec, instance)
+	applyAgent(&podSpec, instance)
+	applyPodExtensions(&podSpec, instance)
+	applySecurityProfile(&podSpec, getSecurityProfile())
+	applyScheduling(&podSpec, getScheduling(instance))
+	return podSpec
+}
+
+// getPullPolicy returns the pull policy for an image. Images pinned by digest never change, so they are only pulled
+// if they are missing from the node; tags are checked against the registry on every start.
+func getPullPolicy(image string) corev1.PullPolicy {
+	if strings.Contains(image, "@") {
+		return corev1.PullIfNotPresent
+	}
+	return corev1.PullAlways
+}
+
+// getPodAnnotations returns the annotations for the shell pod template
+func getPodAnnotations() map[string]string {
+	return getSecurityProfile().podAnnotations
+}
+
+// applySecurityProfile sets the security contexts of the pod and its containers
+func applySecurityProfile(podSpec *corev1.PodSpec, profile securityProfile) {
+	podSpec.SecurityContext = profile.pod
+	for i := range podSpec.InitContainers {
+		podSpec.InitContainers[i].SecurityContext = profile.shell.DeepCopy()
+	}
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if !isOperatorSidecar(container.Name) {
+			container.SecurityContext = profile.shell.DeepCopy()
+			continue
+		}
+		container.SecurityContext = profile.sidecar.DeepCopy()
+		if profile.sidecarTmp {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      tmpVolumeName,
+				MountPath: "/tmp",
+			})
+		}
+	}
+	if profile.sidecarTmp {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: tmpVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+}
+
+// validatePodSpec checks that the only ports exposed by a shell pod are the proxy port and the agent port, which
+// requires a token only known to the operator. Any other exposed port would allow connecting to the shell without
+// going through the authenticating proxy.
+func validatePodSpec(podSpec corev1.PodSpec) error {
+	containers := append([]corev1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			if !(container.Name == oauthProxyContainerName && port.ContainerPort == proxyPort) &&
+				!(container.Name == agentContainerName && port.ContainerPort == agentPort) {
+				return fmt.Errorf("container %s exposes port %d; only the proxy port %d and agent port %d may be exposed",
+					container.Name, port.ContainerPort, proxyPort, agentPort)
+			}
+		}
+	}
+	if podSpec.HostNetwork {
+		return fmt.Errorf("shell pods must not use the host network")
+	}
+	return nil
 }
@@ -0,0 +1,185 @@
+package cloudshell
+
+import (
+	"testing"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestValidatePodSpec(t *testing.T) {
+	proxy := corev1.Container{
+		Name:  oauthProxyContainerName,
+		Ports: []corev1.ContainerPort{{ContainerPort: proxyPort}},
+	}
+	tests := []struct {
+		name    string
+		podSpec corev1.PodSpec
+		valid   bool
+	}{
+		{
+			name:    "proxy port only",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{proxy, {Name: shellHostContainerName}}},
+			valid:   true,
+		},
+		{
+			name: "machine-exec port",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{proxy, {
+				Name:  machineExecContainerName,
+				Ports: []corev1.ContainerPort{{ContainerPort: 4444}},
+			}}},
+		},
+		{
+			name: "proxy port on another container",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:  "sidecar",
+				Ports: []corev1.ContainerPort{{ContainerPort: proxyPort}},
+			}}},
+		},
+		{
+			name: "other port on the proxy",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:  oauthProxyContainerName,
+				Ports: []corev1.ContainerPort{{ContainerPort: proxyPort}, {ContainerPort: 8080}},
+			}}},
+		},
+		{
+			name: "port on an init container",
+			podSpec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", Ports: []corev1.ContainerPort{{ContainerPort: 80}}}},
+				Containers:     []corev1.Container{proxy},
+			},
+		},
+		{
+			name: "probe on an unexposed port",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{proxy, {
+				Name: "sidecar",
+				ReadinessProbe: &corev1.Probe{Handler: corev1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(4444)},
+				}},
+			}}},
+			valid: true,
+		},
+		{
+			name: "agent port",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{proxy, {
+				Name:  agentContainerName,
+				Ports: []corev1.ContainerPort{{ContainerPort: agentPort}},
+			}}},
+			valid: true,
+		},
+		{
+			name: "agent port on another container",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{proxy, {
+				Name:  "sidecar",
+				Ports: []corev1.ContainerPort{{ContainerPort: agentPort}},
+			}}},
+		},
+		{
+			name:    "host network",
+			podSpec: corev1.PodSpec{HostNetwork: true, Containers: []corev1.Container{proxy}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validatePodSpec(test.podSpec)
+			if test.valid && err != nil {
+				t.Errorf("expected pod spec to be valid, got %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected pod spec to be invalid")
+			}
+		})
+	}
+}
+
+func TestValidatePodExtensions(t *testing.T) {
+	data := corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+	mount := func(name string) []corev1.VolumeMount {
+		return []corev1.VolumeMount{{Name: name, MountPath: "/mnt"}}
+	}
+	tests := []struct {
+		name  string
+		spec  v1alpha1.CloudShellSpec
+		valid bool
+	}{
+		{
+			name:  "shell mounts a user volume",
+			spec:  v1alpha1.CloudShellSpec{Volumes: []corev1.Volume{data}, VolumeMounts: mount("data")},
+			valid: true,
+		},
+		{
+			name: "sidecar mounts a user volume",
+			spec: v1alpha1.CloudShellSpec{
+				Volumes:  []corev1.Volume{data},
+				Sidecars: []corev1.Container{{Name: "sidecar", VolumeMounts: mount("data")}},
+			},
+			valid: true,
+		},
+		{
+			name: "shell mounts an undeclared volume",
+			spec: v1alpha1.CloudShellSpec{VolumeMounts: mount("data")},
+		},
+		{
+			name: "sidecar mounts the home volume",
+			spec: v1alpha1.CloudShellSpec{
+				Sidecars: []corev1.Container{{Name: "sidecar", VolumeMounts: mount(homeVolumeName)}},
+			},
+		},
+		{
+			name: "sidecar mounts the recordings volume",
+			spec: v1alpha1.CloudShellSpec{
+				Sidecars: []corev1.Container{{Name: "sidecar", VolumeMounts: mount(recordingsVolumeName)}},
+			},
+		},
+		{
+			name: "init container mounts the audit credentials",
+			spec: v1alpha1.CloudShellSpec{
+				InitContainers: []corev1.Container{{Name: "init", VolumeMounts: mount(auditCredentialsVolumeName)}},
+			},
+		},
+		{
+			name: "user volume named like an operator volume",
+			spec: v1alpha1.CloudShellSpec{
+				Volumes: []corev1.Volume{{
+					Name:         recordingsVolumeName,
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				}},
+				Sidecars: []corev1.Container{{Name: "sidecar", VolumeMounts: mount(recordingsVolumeName)}},
+			},
+		},
+		{
+			name: "host path volume",
+			spec: v1alpha1.CloudShellSpec{Volumes: []corev1.Volume{{
+				Name:         "host",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}},
+			}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := &v1alpha1.CloudShell{Spec: test.spec, Status: v1alpha1.CloudShellStatus{Id: "test"}}
+			err := validatePodExtensions(instance)
+			if test.valid && err != nil {
+				t.Errorf("expected pod extensions to be valid, got %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected pod extensions to be invalid")
+			}
+		})
+	}
+}
+
+func TestGetSpecPodExposesOnlyProxyPort(t *testing.T) {
+	instance := &v1alpha1.CloudShell{Status: v1alpha1.CloudShellStatus{Id: "test"}}
+	podSpec := getSpecPod(instance)
+	if err := validatePodSpec(podSpec); err != nil {
+		t.Fatalf("generated pod spec is invalid: %s", err)
+	}
+	for _, container := range podSpec.Containers {
+		if container.Name == machineExecContainerName && len(container.Ports) > 0 {
+			t.Errorf("machine-exec must not expose ports, got %v", container.Ports)
+		}
+	}
+}
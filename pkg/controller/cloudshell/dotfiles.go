@@ -0,0 +1,343 @@
+package cloudshell
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	dotfilesContainerName = "dotfiles"
+	dotfilesVolumeName    = "cloudshell-dotfiles"
+	// dotfilesMountDir is where a dotfiles ConfigMap or Secret is mounted; its files are linked into the home directory
+	dotfilesMountDir              = "/var/run/cloudshell/dotfiles"
+	dotfilesCredentialsVolumeName = "dotfiles-git-credentials"
+	// dotfilesHashAnnotation holds a hash of the file names in a dotfiles ConfigMap or Secret, so that the shell is
+	// restarted to relink its dotfiles when files are added or removed
+	dotfilesHashAnnotation = "cloudshell.eclipse.org/dotfiles-hash"
+	// dotfilesConfigMapIndex indexes CloudShells by the namespace and name of their dotfiles ConfigMap
+	dotfilesConfigMapIndex = "dotfilesConfigMap"
+)
+
+// linkDotfilesScript links each file of a mounted dotfiles ConfigMap or Secret into the home directory. Kubernetes
+// updates mounted files in place, so links stay current as the ConfigMap or Secret changes.
+const linkDotfilesScript = `for file in ` + dotfilesMountDir + `/* ` + dotfilesMountDir + `/.[!.]*; do
+  [ -e "$file" ] || continue
+  ln -sfn "$file" "$HOME/${file##*/}" || echo "dotfiles: failed to link ${file##*/}" >> /dev/termination-log
+done
+`
+
+// installDotfilesScript installs dotfiles cloned into /tmp/dotfiles, running the repository's install.sh if it has
+// one and copying its contents into the home directory otherwise
+const installDotfilesScript = `[ -d /tmp/dotfiles ] || exit 0
+cd /tmp/dotfiles
+log=$(mktemp)
+if [ -x install.sh ]; then
+  ./install.sh >"$log" 2>&1 || echo "dotfiles: install.sh failed: $(tail -n 1 "$log")" >> /dev/termination-log
+else
+  for file in * .[!.]*; do
+    [ -e "$file" ] && [ "$file" != .git ] || continue
+    cp -R "$file" "$HOME/" 2>>"$log" || echo "dotfiles: failed to install $file: $(tail -n 1 "$log")" >> /dev/termination-log
+  done
+fi
+cat "$log"
+`
+
+// getDotfilesSource returns where a CloudShell's dotfiles come from: its spec or, if unset, the owner's default
+// dotfiles ConfigMap. It returns nil if the CloudShell has no dotfiles.
+func getDotfilesSource(instance *v1alpha1.CloudShell) (source *v1alpha1.DotfilesSource, isDefault bool) {
+	if instance.Spec.Dotfiles != nil {
+		return instance.Spec.Dotfiles, false
+	}
+	format := config.ControllerCfg.GetDefaultDotfilesFormat()
+	owner := sanitizeName(getOwner(instance))
+	if format == "" || owner == "" {
+		return nil, false
+	}
+	return &v1alpha1.DotfilesSource{ConfigMap: fmt.Sprintf(format, owner)}, true
+}
+
+// usesRuntimeDotfiles returns whether a CloudShell's default dotfiles are installed by its agent rather than by an
+// init container. This is the case for pooled shells and shells claimed from a pool, whose pods must not depend on
+// the owner, so that claiming a pooled shell does not restart it.
+func usesRuntimeDotfiles(instance *v1alpha1.CloudShell) bool {
+	return instance.Spec.Dotfiles == nil && config.ControllerCfg.GetDefaultDotfilesFormat() != "" &&
+		(isPooled(instance) || instance.Status.Pool != "")
+}
+
+// validateDotfiles checks that exactly one source of dotfiles is set
+func validateDotfiles(instance *v1alpha1.CloudShell) error {
+	dotfiles := instance.Spec.Dotfiles
+	if dotfiles == nil {
+		return nil
+	}
+	count := 0
+	if dotfiles.Git != nil {
+		if dotfiles.Git.URL == "" {
+			return fmt.Errorf("dotfiles must have a git url")
+		}
+		count++
+	}
+	if dotfiles.ConfigMap != "" {
+		count++
+	}
+	if dotfiles.Secret != "" {
+		count++
+	}
+	if count != 1 {
+		return fmt.Errorf("exactly one of git, configMap, or secret must be set in dotfiles")
+	}
+	return nil
+}
+
+// applyDotfiles adds the init container that installs a CloudShell's dotfiles. ConfigMaps and Secrets are also
+// mounted in the shell so that the links to their files resolve. They are optional, so that a missing ConfigMap or
+// Secret does not prevent the shell from starting; this is reported in the DotfilesInstalled condition instead.
+func applyDotfiles(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	source, _ := getDotfilesSource(instance)
+	if source == nil || usesRuntimeDotfiles(instance) {
+		return
+	}
+	var volumeDefaultMode int32 = 420
+	optional := true
+	container := corev1.Container{
+		Name:                     dotfilesContainerName,
+		Image:                    config.ControllerCfg.GetGitImage(),
+		ImagePullPolicy:          corev1.PullIfNotPresent,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		Env: []corev1.EnvVar{
+			{
+				Name:  "HOME",
+				Value: homeDir,
+			},
+			{
+				Name:  "GIT_TERMINAL_PROMPT",
+				Value: "0",
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      homeVolumeName,
+				MountPath: homeDir,
+			},
+		},
+	}
+
+	if source.Git != nil {
+		creds := ""
+		if source.Git.CredentialsSecret != "" {
+			creds = path.Join(gitCredentialsMountDir, dotfilesCredentialsVolumeName)
+			podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+				Name: dotfilesCredentialsVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName:  source.Git.CredentialsSecret,
+						DefaultMode: &volumeDefaultMode,
+					},
+				},
+			})
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      dotfilesCredentialsVolumeName,
+				MountPath: creds,
+				ReadOnly:  true,
+			})
+		}
+		args := []string{dotfilesContainerName, "/tmp/dotfiles", source.Git.URL, source.Git.Ref, creds}
+		for i := range args {
+			args[i] = shellQuote(args[i])
+		}
+		// Clone in a subshell with HOME set elsewhere, so that credentials are not left in the shell's home
+		script := cloneFunction + "(HOME=/tmp; clone " + strings.Join(args, " ") + ")\n" + installDotfilesScript
+		container.Command = []string{"/bin/sh", "-c", script}
+		podSpec.InitContainers = append(podSpec.InitContainers, container)
+		return
+	}
+
+	volume := corev1.Volume{Name: dotfilesVolumeName}
+	if source.ConfigMap != "" {
+		volume.ConfigMap = &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: source.ConfigMap},
+			DefaultMode:          &volumeDefaultMode,
+			Optional:             &optional,
+		}
+	} else {
+		volume.Secret = &corev1.SecretVolumeSource{
+			SecretName:  source.Secret,
+			DefaultMode: &volumeDefaultMode,
+			Optional:    &optional,
+		}
+	}
+	podSpec.Volumes = append(podSpec.Volumes, volume)
+	mount := corev1.VolumeMount{
+		Name:      dotfilesVolumeName,
+		MountPath: dotfilesMountDir,
+		ReadOnly:  true,
+	}
+	container.VolumeMounts = append(container.VolumeMounts, mount)
+	container.Command = []string{"/bin/sh", "-c", linkDotfilesScript}
+	podSpec.InitContainers = append(podSpec.InitContainers, container)
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == shellHostContainerName {
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, mount)
+		}
+	}
+}
+
+// getDotfilesFiles returns the sorted file names in a dotfiles ConfigMap or Secret, and whether it exists. Secrets
+// are read through the uncached reader, to avoid caching every Secret the operator can read.
+func (r *ReconcileCloudShell) getDotfilesFiles(instance *v1alpha1.CloudShell, source *v1alpha1.DotfilesSource) (files []string, found bool, err error) {
+	namespacedName := types.NamespacedName{Namespace: getShellNamespace(instance)}
+	switch {
+	case source.ConfigMap != "":
+		namespacedName.Name = source.ConfigMap
+		configMap := &corev1.ConfigMap{}
+		err = r.client.Get(context.TODO(), namespacedName, configMap)
+		for key := range configMap.Data {
+			files = append(files, key)
+		}
+		for key := range configMap.BinaryData {
+			files = append(files, key)
+		}
+	case source.Secret != "":
+		namespacedName.Name = source.Secret
+		secret := &corev1.Secret{}
+		err = r.apiReader.Get(context.TODO(), namespacedName, secret)
+		for key := range secret.Data {
+			files = append(files, key)
+		}
+	default:
+		return nil, true, nil
+	}
+	if errors.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(files)
+	return files, true, nil
+}
+
+// getDotfilesContents returns the files of a dotfiles ConfigMap by name, and whether it exists
+func (r *ReconcileCloudShell) getDotfilesContents(instance *v1alpha1.CloudShell, source *v1alpha1.DotfilesSource) (map[string][]byte, bool, error) {
+	configMap := &corev1.ConfigMap{}
+	namespacedName := types.NamespacedName{Name: source.ConfigMap, Namespace: getShellNamespace(instance)}
+	err := r.client.Get(context.TODO(), namespacedName, configMap)
+	if errors.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	files := map[string][]byte{}
+	for key, value := range configMap.Data {
+		files[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		files[key] = value
+	}
+	return files, true, nil
+}
+
+// getDotfilesAnnotations returns pod template annotations that change when files are added to or removed from a
+// CloudShell's dotfiles ConfigMap or Secret
+func (r *ReconcileCloudShell) getDotfilesAnnotations(instance *v1alpha1.CloudShell) (map[string]string, error) {
+	source, _ := getDotfilesSource(instance)
+	if source == nil || source.Git != nil || usesRuntimeDotfiles(instance) {
+		return nil, nil
+	}
+	files, _, err := r.getDotfilesFiles(instance, source)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(strings.Join(files, "\n")))
+	return map[string]string{
+		dotfilesHashAnnotation: fmt.Sprintf("%x", hash[:8]),
+	}, nil
+}
+
+// reconcileDotfilesStatus sets the DotfilesInstalled condition. A missing ConfigMap or Secret is reported unless it
+// is the owner's default, which is not required to exist. Dotfiles installed by the agent are reported by
+// reconcileAgentConfig.
+func (r *ReconcileCloudShell) reconcileDotfilesStatus(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if usesRuntimeDotfiles(instance) {
+		return deployStatus{Continue: true}
+	}
+	source, isDefault := getDotfilesSource(instance)
+	if source == nil {
+		return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.DotfilesInstalled))
+	}
+	_, found, err := r.getDotfilesFiles(instance, source)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	if !found {
+		if isDefault {
+			return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.DotfilesInstalled))
+		}
+		kind, name := "ConfigMap", source.ConfigMap
+		if source.Secret != "" {
+			kind, name = "Secret", source.Secret
+		}
+		return r.updateStatusIf(ctx, setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+			Type:    v1alpha1.DotfilesInstalled,
+			Status:  corev1.ConditionFalse,
+			Reason:  "NotFound",
+			Message: fmt.Sprintf("%s %s not found in namespace %s", kind, name, getShellNamespace(instance)),
+		}))
+	}
+	state, err := r.getInitContainerState(instance, dotfilesContainerName)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	condition := getInitContainerCondition(v1alpha1.DotfilesInstalled, state, "Installed", "Dotfiles were installed", "InstallFailed")
+	return r.updateStatusIf(ctx, setCondition(&instance.Status, condition))
+}
+
+// indexDotfilesConfigMap returns the key of a CloudShell in dotfilesConfigMapIndex: the shell namespace and name of
+// the ConfigMap holding its dotfiles, including the owner's default
+func indexDotfilesConfigMap(obj runtime.Object) []string {
+	shell, ok := obj.(*v1alpha1.CloudShell)
+	if !ok || validateShellNamespace(shell) != nil {
+		return nil
+	}
+	source, _ := getDotfilesSource(shell)
+	if source == nil || source.ConfigMap == "" {
+		return nil
+	}
+	return []string{getDotfilesConfigMapKey(getShellNamespace(shell), source.ConfigMap)}
+}
+
+func getDotfilesConfigMapKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// getRequestsForDotfiles returns reconcile requests for the CloudShells using a ConfigMap for their dotfiles. They
+// are looked up in dotfilesConfigMapIndex, so that changes to other ConfigMaps do not list CloudShells.
+func getRequestsForDotfiles(c client.Client, namespace, name string) []reconcile.Request {
+	shells := &v1alpha1.CloudShellList{}
+	err := c.List(context.TODO(), shells,
+		client.MatchingFields{dotfilesConfigMapIndex: getDotfilesConfigMapKey(namespace, name)})
+	if err != nil {
+		log.Error(err, "Failed to list CloudShells", "namespace", namespace)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, shell := range shells.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: shell.Name, Namespace: shell.Namespace},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,189 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/che-incubator/cloudshell-operator/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// registryTimeout limits each request made when resolving an image tag
+const registryTimeout = 10 * time.Second
+
+// validateImageUpdate checks that the shell's idleness can be known if it is updated automatically
+func validateImageUpdate(instance *v1alpha1.CloudShell) error {
+	if instance.Spec.ImageUpdatePolicy == v1alpha1.ImageUpdateAutomatic && !config.ControllerCfg.GetActivityTracking() {
+		return fmt.Errorf("imageUpdatePolicy %s requires activity tracking; enable it in the operator configuration",
+			v1alpha1.ImageUpdateAutomatic)
+	}
+	return nil
+}
+
+// getShellImage returns the image the shell container runs: the resolved digest if the shell follows its tag, or
+// the image as written
+func getShellImage(instance *v1alpha1.CloudShell) string {
+	image := instance.Status.Image
+	if instance.Spec.ImageUpdatePolicy == "" || image == nil || image.Reference != instance.Spec.Image || image.Digest == "" {
+		return instance.Spec.Image
+	}
+	ref, err := registry.ParseReference(instance.Spec.Image)
+	if err != nil {
+		return instance.Spec.Image
+	}
+	return ref.Pinned(image.Digest)
+}
+
+// needsImageCheck returns whether the shell's image tag is due to be resolved again
+func needsImageCheck(instance *v1alpha1.CloudShell, now time.Time) bool {
+	image := instance.Status.Image
+	if image == nil || image.Reference != instance.Spec.Image {
+		return true
+	}
+	due := image.CheckedAt == nil || now.Sub(image.CheckedAt.Time) >= config.ControllerCfg.GetImageCheckInterval()
+	switch {
+	case image.Digest == "":
+		// The tag was never resolved successfully
+		return due
+	case instance.Spec.ImageUpdatePolicy == v1alpha1.ImageUpdateOnRestart:
+		// CheckedAt is cleared when a restart is requested
+		return image.CheckedAt == nil || due && !instance.Status.Ready
+	case instance.Spec.ImageUpdatePolicy == v1alpha1.ImageUpdateAutomatic:
+		return due
+	}
+	return false
+}
+
+// isImageUpdateAllowed returns whether the shell may be restarted with a new image now: always if it is not running,
+// and with the Automatic policy once it has had no terminal activity for the idle period
+func isImageUpdateAllowed(instance *v1alpha1.CloudShell, now time.Time) bool {
+	if !instance.Status.Ready {
+		return true
+	}
+	if instance.Spec.ImageUpdatePolicy != v1alpha1.ImageUpdateAutomatic {
+		return false
+	}
+	last := instance.Status.LastActivityTime
+	if last == nil {
+		last = instance.Status.StartedAt
+	}
+	return last == nil || now.Sub(last.Time) >= config.ControllerCfg.GetImageIdlePeriod()
+}
+
+// getImageRequeue returns how long until a CloudShell must be reconciled again to resolve its image tag, or zero if
+// it does not follow its tag
+func getImageRequeue(instance *v1alpha1.CloudShell, now time.Time) time.Duration {
+	image := instance.Status.Image
+	if instance.Spec.ImageUpdatePolicy == "" || image == nil || image.CheckedAt == nil {
+		return 0
+	}
+	if image.Digest != "" && instance.Spec.ImageUpdatePolicy == v1alpha1.ImageUpdateNever {
+		return 0
+	}
+	next := image.CheckedAt.Add(config.ControllerCfg.GetImageCheckInterval()).Sub(now)
+	if next < time.Second {
+		next = time.Second
+	}
+	return next
+}
+
+// reconcileImage resolves the shell's image tag to a digest and records it in the status, from which the shell's
+// pod spec is built. A new digest is only recorded as the one to run when the shell may be restarted; until then,
+// it is kept in LatestDigest. Resolution failures are reported in the ImageResolved condition and do not stop the
+// shell, which keeps running the last digest.
+func (r *ReconcileCloudShell) reconcileImage(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if instance.Spec.ImageUpdatePolicy == "" {
+		modified := instance.Status.Image != nil
+		instance.Status.Image = nil
+		modified = removeCondition(&instance.Status, v1alpha1.ImageResolved) || modified
+		return r.updateStatusIf(ctx, modified)
+	}
+	now := time.Now()
+	image := instance.Status.Image.DeepCopy()
+	// A restart request clears CheckedAt, so that the restarted shell runs the newest digest
+	restarting := image != nil && image.CheckedAt == nil
+
+	if !needsImageCheck(instance, now) {
+		if image.LatestDigest == "" || !isImageUpdateAllowed(instance, now) {
+			return deployStatus{Continue: true}
+		}
+		r.updateImage(ctx, image, image.LatestDigest)
+		instance.Status.Image = image
+		return r.updateStatusIf(ctx, true)
+	}
+
+	if image == nil || image.Reference != instance.Spec.Image {
+		image = &v1alpha1.ImageStatus{Reference: instance.Spec.Image}
+	}
+	image.CheckedAt = &metav1.Time{Time: now}
+	instance.Status.Image = image
+	digest, err := r.resolveImage(instance.Spec.Image)
+	if err != nil {
+		ctx.log.Info("Failed to resolve image", "image", instance.Spec.Image, "error", err.Error())
+		setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+			Type:    v1alpha1.ImageResolved,
+			Status:  corev1.ConditionFalse,
+			Reason:  "ResolveFailed",
+			Message: err.Error(),
+		})
+		return r.updateStatusIf(ctx, true)
+	}
+	setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.ImageResolved,
+		Status:  corev1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("%s resolved to %s", instance.Spec.Image, digest),
+	})
+	switch {
+	case image.Digest == "":
+		image.Digest = digest
+	case digest == image.Digest:
+		image.LatestDigest = ""
+	case restarting || isImageUpdateAllowed(instance, now):
+		r.updateImage(ctx, image, digest)
+	default:
+		image.LatestDigest = digest
+	}
+	return r.updateStatusIf(ctx, true)
+}
+
+// updateImage makes the shell run a new digest, which restarts it
+func (r *ReconcileCloudShell) updateImage(ctx reconcileContext, image *v1alpha1.ImageStatus, digest string) {
+	ctx.log.Info("Updating shell image", "image", image.Reference, "digest", digest)
+	r.recorder.Eventf(ctx.instance, corev1.EventTypeNormal, "ImageUpdated", "Restarting with %s, the new digest of %s",
+		digest, image.Reference)
+	image.Digest = digest
+	image.LatestDigest = ""
+}
+
+// resolveImage returns the digest an image reference points to, using the configured registry credentials
+func (r *ReconcileCloudShell) resolveImage(image string) (string, error) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	client := &registry.Client{
+		Timeout:    registryTimeout,
+		Registries: config.ControllerCfg.GetAllowedRegistries(),
+		Internal:   config.ControllerCfg.GetInternalRegistries(),
+		Insecure:   config.ControllerCfg.GetInsecureRegistries(),
+	}
+	if name := config.ControllerCfg.GetImagePullSecret(); name != "" {
+		secret := &corev1.Secret{}
+		namespacedName := types.NamespacedName{Name: name, Namespace: config.ControllerCfg.GetOperatorNamespace()}
+		if err := r.apiReader.Get(context.TODO(), namespacedName, secret); err != nil {
+			return "", fmt.Errorf("reading registry credentials: %s", err)
+		}
+		client.Credentials, err = registry.ParseDockerConfig(secret.Data[corev1.DockerConfigJsonKey])
+		if err != nil {
+			return "", err
+		}
+	}
+	return client.Resolve(ref)
+}
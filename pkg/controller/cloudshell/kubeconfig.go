@@ -0,0 +1,156 @@
+package cloudshell
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	kubeconfigVolumeName = "cloudshell-kubeconfig"
+	// kubeconfigMountDir is where the kubeconfig is mounted in the shell
+	kubeconfigMountDir = "/var/run/cloudshell/kubeconfig"
+	kubeconfigKey      = "config"
+	// kubeconfigCAKey holds the API server CA bundle, which is also projected next to the ServiceAccount token
+	kubeconfigCAKey = "ca.crt"
+	inClusterServer = "https://kubernetes.default.svc"
+	// serviceAccountCAFile is the CA bundle mounted in pods with an automounted service account token, such as the
+	// operator's
+	serviceAccountCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// loadClusterCA returns the CA bundle for the API server from the operator's client configuration, falling back to
+// the CA bundle mounted with the operator's service account token. It returns nil if neither is available (e.g. when
+// run locally against an insecure cluster).
+func loadClusterCA(cfg *rest.Config) ([]byte, error) {
+	if len(cfg.CAData) > 0 {
+		return cfg.CAData, nil
+	}
+	if cfg.CAFile != "" {
+		return ioutil.ReadFile(cfg.CAFile)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountCAFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return ca, err
+}
+
+// getSpecKubeconfigSecret returns the Secret holding the kubeconfig for a shell's ServiceAccount and the API server CA
+// bundle. The kubeconfig does not contain a token; it refers to the projected ServiceAccount token, which the kubelet
+// refreshes.
+func (r *ReconcileCloudShell) getSpecKubeconfigSecret(instance *v1alpha1.CloudShell) (*corev1.Secret, error) {
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["cluster"] = &clientcmdapi.Cluster{
+		Server:                   inClusterServer,
+		CertificateAuthorityData: r.clusterCA,
+	}
+	kubeconfig.AuthInfos[getServiceAccountName(instance)] = &clientcmdapi.AuthInfo{
+		TokenFile: path.Join(serviceAccountMountDir, serviceAccountTokenKey),
+	}
+	kubeconfig.Contexts["cloudshell"] = &clientcmdapi.Context{
+		Cluster:   "cluster",
+		AuthInfo:  getServiceAccountName(instance),
+		Namespace: getShellNamespace(instance),
+	}
+	kubeconfig.CurrentContext = "cloudshell"
+	data, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getKubeconfigSecretName(instance),
+			Namespace: getShellNamespace(instance),
+			Labels:    getLabelsForID(instance.Status.Id),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			kubeconfigKey: data,
+			// Always set, as the key is projected into shell pods
+			kubeconfigCAKey: append([]byte{}, r.clusterCA...),
+		},
+	}
+	err = r.setOwner(instance, secret)
+	return secret, err
+}
+
+// reconcileKubeconfig creates the kubeconfig Secret for a shell. Secrets are read through the uncached reader, to
+// avoid caching every Secret the operator can read; changes to the Secret are corrected on the next reconcile.
+func (r *ReconcileCloudShell) reconcileKubeconfig(ctx reconcileContext) deployStatus {
+	spec, err := r.getSpecKubeconfigSecret(ctx.instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	cluster := &corev1.Secret{}
+	err = r.apiReader.Get(context.TODO(), types.NamespacedName{Name: spec.Name, Namespace: spec.Namespace}, cluster)
+	if errors.IsNotFound(err) {
+		ctx.log.Info("Creating kubeconfig secret")
+		err = r.client.Create(context.TODO(), spec)
+		return deployStatus{Requeue: true, Error: err}
+	} else if err != nil {
+		return deployStatus{Error: err}
+	}
+	if !bytes.Equal(cluster.Data[kubeconfigKey], spec.Data[kubeconfigKey]) ||
+		!bytes.Equal(cluster.Data[kubeconfigCAKey], spec.Data[kubeconfigCAKey]) || len(cluster.Data) != len(spec.Data) {
+		ctx.log.Info("Updating kubeconfig secret")
+		cluster.Data = spec.Data
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	return deployStatus{Continue: true}
+}
+
+// applyKubeconfig mounts the kubeconfig Secret in the shell and points KUBECONFIG at it. ~/.kube/config is listed
+// first so that a kubeconfig supplied by the user takes precedence.
+func applyKubeconfig(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	if instance.Spec.DisableServiceAccountToken {
+		return
+	}
+	var volumeDefaultMode int32 = 420
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: kubeconfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: getKubeconfigSecretName(instance),
+				Items: []corev1.KeyToPath{
+					{
+						Key:  kubeconfigKey,
+						Path: kubeconfigKey,
+					},
+				},
+				DefaultMode: &volumeDefaultMode,
+			},
+		},
+	})
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container.Name != shellHostContainerName {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      kubeconfigVolumeName,
+			MountPath: kubeconfigMountDir,
+			ReadOnly:  true,
+		})
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "KUBECONFIG",
+			Value: path.Join(homeDir, ".kube/config") + ":" + path.Join(kubeconfigMountDir, kubeconfigKey),
+		})
+	}
+}
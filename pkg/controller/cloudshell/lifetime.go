@@ -0,0 +1,120 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// validateLifetime checks that a CloudShell's TTL is positive
+func validateLifetime(instance *v1alpha1.CloudShell) error {
+	if instance.Spec.TTL != nil && instance.Spec.TTL.Duration <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	return nil
+}
+
+// getExpiry returns the time a CloudShell expires, or nil if its lifetime is unlimited. This is the shorter of its TTL
+// and the operator's maximum lifetime after its creation, but never less than the warning period after its users were
+// warned, so that lowering the lifetime does not stop or delete shells without warning. If they have not been warned
+// yet, they are assumed to be warned now, which reconcileLifetime does.
+func getExpiry(instance *v1alpha1.CloudShell, now time.Time) *metav1.Time {
+	lifetime := config.ControllerCfg.GetMaxLifetime()
+	if ttl := instance.Spec.TTL; ttl != nil && ttl.Duration > 0 && (lifetime == 0 || ttl.Duration < lifetime) {
+		lifetime = ttl.Duration
+	}
+	if lifetime == 0 {
+		return nil
+	}
+	expiry := instance.CreationTimestamp.Add(lifetime)
+	warnedAt := now
+	if condition := getCondition(&instance.Status, v1alpha1.Expiring); condition != nil {
+		warnedAt = condition.LastTransitionTime.Time
+	}
+	if earliest := warnedAt.Add(config.ControllerCfg.GetLifetimeWarningPeriod()); earliest.After(expiry) {
+		expiry = earliest
+	}
+	return &metav1.Time{Time: expiry}
+}
+
+// isExpired returns whether a shell expired and was stopped by the operator
+func isExpired(instance *v1alpha1.CloudShell) bool {
+	condition := getCondition(&instance.Status, v1alpha1.Expiring)
+	return condition != nil && condition.Reason == "Expired"
+}
+
+// getLifetimeRequeue returns how long until a CloudShell must be reconciled again to warn its users or expire it, or
+// zero if there is nothing left to do
+func getLifetimeRequeue(instance *v1alpha1.CloudShell, now time.Time) time.Duration {
+	expiry := getExpiry(instance, now)
+	if expiry == nil || isExpired(instance) {
+		return 0
+	}
+	if warning := expiry.Add(-config.ControllerCfg.GetLifetimeWarningPeriod()); now.Before(warning) {
+		return warning.Sub(now)
+	}
+	if now.Before(expiry.Time) {
+		return expiry.Sub(now)
+	}
+	return 0
+}
+
+// reconcileLifetime sets the time a CloudShell expires in its status, warns its users as the expiry approaches, and
+// deletes or stops the shell when it expires. Warnings are reported as events and through the Expiring condition.
+func (r *ReconcileCloudShell) reconcileLifetime(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	now := time.Now()
+	expiry := getExpiry(instance, now)
+	modified := !expiry.Equal(instance.Status.ExpiresAt)
+	instance.Status.ExpiresAt = expiry
+	if expiry == nil {
+		modified = removeCondition(&instance.Status, v1alpha1.Expiring) || modified
+		return r.updateStatusIf(ctx, modified)
+	}
+
+	if !now.Before(expiry.Time) {
+		if config.ControllerCfg.GetExpiryPolicy() == config.ExpiryPolicyDelete {
+			ctx.log.Info("Deleting expired CloudShell")
+			r.recorder.Event(instance, corev1.EventTypeWarning, "Expired", "The shell reached its maximum lifetime and is deleted")
+			err := r.client.Delete(context.TODO(), instance)
+			if errors.IsNotFound(err) {
+				err = nil
+			}
+			return deployStatus{Error: err}
+		}
+		if setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+			Type:    v1alpha1.Expiring,
+			Status:  corev1.ConditionTrue,
+			Reason:  "Expired",
+			Message: "The shell reached its maximum lifetime and was stopped",
+		}) {
+			ctx.log.Info("Stopping expired CloudShell")
+			r.recorder.Event(instance, corev1.EventTypeWarning, "Expired", "The shell reached its maximum lifetime and is stopped")
+			modified = true
+		}
+		return r.updateStatusIf(ctx, modified)
+	}
+
+	if expiry.Sub(now) > config.ControllerCfg.GetLifetimeWarningPeriod() {
+		// The lifetime may have been extended since the warning
+		modified = removeCondition(&instance.Status, v1alpha1.Expiring) || modified
+		return r.updateStatusIf(ctx, modified)
+	}
+	message := fmt.Sprintf("The shell expires at %s", expiry.UTC().Format(time.RFC3339))
+	if setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.Expiring,
+		Status:  corev1.ConditionTrue,
+		Reason:  "ExpiresSoon",
+		Message: message,
+	}) {
+		r.recorder.Event(instance, corev1.EventTypeWarning, "Expiring", message)
+		modified = true
+	}
+	return r.updateStatusIf(ctx, modified)
+}
@@ -0,0 +1,163 @@
+package cloudshell
+
+import (
+	"context"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Metrics are registered with the controller-runtime registry, which is served on the manager's metrics address
+var (
+	timeToReady = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cloudshell_time_to_ready_seconds",
+		Help:    "Time from the creation of a CloudShell until it is first ready",
+		Buckets: []float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+	})
+	reconcileStepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloudshell_reconcile_step_duration_seconds",
+		Help:    "Duration of each step of reconciling a CloudShell",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"step"})
+	reconcileStepErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudshell_reconcile_step_errors_total",
+		Help: "Number of errors returned by each step of reconciling a CloudShell",
+	}, []string{"step"})
+	poolClaims = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudshell_pool_claims_total",
+		Help: "Number of CloudShells matching a pool that claimed a ready shell from it (hit) or found none (miss)",
+	}, []string{"namespace", "pool", "result"})
+
+	shellsDesc = prometheus.NewDesc("cloudshell_shells",
+		"Number of CloudShells by namespace and phase", []string{"namespace", "phase"}, nil)
+	sessionsDesc = prometheus.NewDesc("cloudshell_terminal_sessions",
+		"Number of active terminal sessions by namespace, for CloudShells with sessions enabled", []string{"namespace"}, nil)
+	runningDesc = prometheus.NewDesc("cloudshell_running_seconds",
+		"Total time each CloudShell has been running", []string{"namespace", "name", "owner"}, nil)
+	lastActivityDesc = prometheus.NewDesc("cloudshell_last_activity_timestamp_seconds",
+		"Time of the last terminal activity in each CloudShell, if activity is tracked", []string{"namespace", "name", "owner"}, nil)
+	poolShellsDesc = prometheus.NewDesc("cloudshell_pool_shells",
+		"Number of unclaimed shells in each CloudShellPool by state", []string{"namespace", "pool", "state"}, nil)
+	poolSizeDesc = prometheus.NewDesc("cloudshell_pool_size",
+		"Configured size of each CloudShellPool", []string{"namespace", "pool"}, nil)
+)
+
+// Phases of a CloudShell reported in metrics
+const (
+	phasePending       = "Pending"
+	phaseReady         = "Ready"
+	phaseStopped       = "Stopped"
+	phaseQuotaExceeded = "QuotaExceeded"
+	phaseTerminating   = "Terminating"
+)
+
+// registerMetrics registers the controller's metrics. Gauges describing CloudShells are computed from the cache when
+// metrics are scraped.
+func registerMetrics(c client.Client) error {
+	collectors := []prometheus.Collector{
+		timeToReady, reconcileStepDuration, reconcileStepErrors, poolClaims, &shellCollector{client: c}, &poolCollector{client: c},
+	}
+	for _, collector := range collectors {
+		if err := metrics.Registry.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStep runs a step of reconciling a CloudShell, recording its duration and errors
+func runStep(step string, ctx reconcileContext, reconcileStep func(reconcileContext) deployStatus) deployStatus {
+	start := time.Now()
+	status := reconcileStep(ctx)
+	reconcileStepDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+	if status.Error != nil {
+		reconcileStepErrors.WithLabelValues(step).Inc()
+	}
+	return status
+}
+
+// getPhase returns the phase of a CloudShell reported in metrics
+func getPhase(instance *v1alpha1.CloudShell) string {
+	switch {
+	case instance.DeletionTimestamp != nil:
+		return phaseTerminating
+	case isExpired(instance):
+		return phaseStopped
+	case isQueued(instance):
+		return phaseQuotaExceeded
+	case instance.Status.Ready:
+		return phaseReady
+	default:
+		return phasePending
+	}
+}
+
+// shellCollector reports the number of CloudShells and terminal sessions, and the usage of each CloudShell
+type shellCollector struct {
+	client client.Client
+}
+
+func (c *shellCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shellsDesc
+	ch <- sessionsDesc
+	ch <- runningDesc
+	ch <- lastActivityDesc
+}
+
+func (c *shellCollector) Collect(ch chan<- prometheus.Metric) {
+	shells := &v1alpha1.CloudShellList{}
+	if err := c.client.List(context.TODO(), shells); err != nil {
+		log.Error(err, "Failed to list CloudShells for metrics")
+		return
+	}
+	type key struct{ namespace, phase string }
+	counts := map[key]int{}
+	sessions := map[string]int{}
+	now := time.Now()
+	for i := range shells.Items {
+		shell := &shells.Items[i]
+		counts[key{shell.Namespace, getPhase(shell)}]++
+		if shell.Spec.Sessions != nil {
+			sessions[shell.Namespace] += len(shell.Status.Sessions)
+		}
+		owner := getOwner(shell)
+		ch <- prometheus.MustNewConstMetric(runningDesc, prometheus.CounterValue,
+			shell.Status.GetRunningTime(now).Seconds(), shell.Namespace, shell.Name, owner)
+		if last := shell.Status.LastActivityTime; last != nil {
+			ch <- prometheus.MustNewConstMetric(lastActivityDesc, prometheus.GaugeValue,
+				float64(last.Unix()), shell.Namespace, shell.Name, owner)
+		}
+	}
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(shellsDesc, prometheus.GaugeValue, float64(count), k.namespace, k.phase)
+	}
+	for namespace, count := range sessions {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(count), namespace)
+	}
+}
+
+// poolCollector reports the size of CloudShellPools and their unclaimed shells
+type poolCollector struct {
+	client client.Client
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolShellsDesc
+	ch <- poolSizeDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	pools := &v1alpha1.CloudShellPoolList{}
+	if err := c.client.List(context.TODO(), pools); err != nil {
+		log.Error(err, "Failed to list CloudShellPools for metrics")
+		return
+	}
+	for _, pool := range pools.Items {
+		ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(pool.Spec.Size), pool.Namespace, pool.Name)
+		ch <- prometheus.MustNewConstMetric(poolShellsDesc, prometheus.GaugeValue, float64(pool.Status.Ready), pool.Namespace, pool.Name, "ready")
+		ch <- prometheus.MustNewConstMetric(poolShellsDesc, prometheus.GaugeValue, float64(pool.Status.Starting), pool.Namespace, pool.Name, "starting")
+	}
+}
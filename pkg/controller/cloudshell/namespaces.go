@@ -0,0 +1,66 @@
+package cloudshell
+
+import (
+	"context"
+
+	cloudshellv1alpha1 "github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// namespaceAllowed checks whether CloudShells in namespace should be served, according to the namespace label
+// selector in the controller config. The namespace is read through the uncached reader, since the manager's cache may
+// be restricted to a set of namespaces and does not hold cluster-scoped objects.
+func namespaceAllowed(reader client.Reader, namespace string) (bool, error) {
+	selector := config.ControllerCfg.GetNamespaceSelector()
+	if selector.Empty() {
+		return true, nil
+	}
+	ns := &corev1.Namespace{}
+	err := reader.Get(context.TODO(), types.NamespacedName{Name: namespace}, ns)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// getRequestsForNamespace returns reconcile requests for all CloudShells in a namespace
+func getRequestsForNamespace(c client.Client, namespace string) []reconcile.Request {
+	shells := &cloudshellv1alpha1.CloudShellList{}
+	err := c.List(context.TODO(), shells, client.InNamespace(namespace))
+	if err != nil {
+		log.Error(err, "Failed to list CloudShells", "namespace", namespace)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, shell := range shells.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: shell.Name, Namespace: shell.Namespace},
+		})
+	}
+	return requests
+}
+
+// getShellsForNamespace returns the CloudShells whose resources are created in namespace. In per-user namespace
+// mode, these may live in any namespace.
+func getShellsForNamespace(c client.Client, namespace string) ([]cloudshellv1alpha1.CloudShell, error) {
+	shells := &cloudshellv1alpha1.CloudShellList{}
+	var opts []client.ListOption
+	if config.ControllerCfg.GetNamespaceMode() != config.NamespaceModePerUser {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+	if err := c.List(context.TODO(), shells, opts...); err != nil {
+		return nil, err
+	}
+	var result []cloudshellv1alpha1.CloudShell
+	for _, shell := range shells.Items {
+		if validateShellNamespace(&shell) == nil && getShellNamespace(&shell) == namespace {
+			result = append(result, shell)
+		}
+	}
+	return result, nil
+}
@@ -2,22 +2,27 @@ package cloudshell
 
 import (
 	"context"
-	"fmt"
 	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
 	"github.com/go-logr/logr"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	routeV1 "github.com/openshift/api/route/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sort"
 	"strings"
 )
 
+// managedAnnotationsAnnotation lists the annotations of an Ingress that are set from the operator's configuration, so
+// that annotations removed from the configuration are also removed from existing Ingresses
+const managedAnnotationsAnnotation = "cloudshell.eclipse.org/managed-annotations"
+
 var serviceDiffOpts = cmp.Options{
 	cmpopts.IgnoreFields(corev1.Service{}, "TypeMeta", "ObjectMeta", "Status"),
 	cmpopts.IgnoreFields(corev1.ServiceSpec{}, "ClusterIP", "SessionAffinity"),
@@ -33,9 +38,12 @@ var routeDiffOpts = cmp.Options{
 	cmpopts.IgnoreFields(routeV1.RouteTargetReference{}, "Weight"),
 }
 
-func (r *ReconcileCloudShell) reconcileRouting(ctx reconcileContext) deployStatus {
-	specService, specRoute := r.getSpecRouting(ctx.instance)
+var ingressDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(networkingv1beta1.Ingress{}, "TypeMeta", "ObjectMeta", "Status"),
+}
 
+func (r *ReconcileCloudShell) reconcileRouting(ctx reconcileContext) deployStatus {
+	specService := r.getSpecService(ctx.instance)
 	serviceOk, err := r.reconcileService(specService, ctx.log)
 	if err != nil || !serviceOk {
 		return deployStatus{
@@ -44,8 +52,13 @@ func (r *ReconcileCloudShell) reconcileRouting(ctx reconcileContext) deployStatu
 		}
 	}
 
-	routeOk, err := r.reconcileRoute(specRoute, ctx.log)
-	if err != nil || !routeOk {
+	var routingOk bool
+	if config.ControllerCfg.IsOpenShift() {
+		routingOk, err = r.reconcileRoute(r.getSpecRoute(ctx.instance, specService), ctx.log)
+	} else {
+		routingOk, err = r.reconcileIngress(r.getSpecIngress(ctx.instance, specService), ctx.log)
+	}
+	if err != nil || !routingOk {
 		return deployStatus{
 			Requeue: true,
 			Error:   err,
@@ -57,40 +70,46 @@ func (r *ReconcileCloudShell) reconcileRouting(ctx reconcileContext) deployStatu
 	}
 }
 
-func (r *ReconcileCloudShell) getSpecRouting(instance *v1alpha1.CloudShell) (*corev1.Service, *routeV1.Route) {
+func (r *ReconcileCloudShell) getSpecService(instance *v1alpha1.CloudShell) *corev1.Service {
 	id := instance.Status.Id
 	labels := getLabelsForID(id)
+	annotations := map[string]string{}
+	if config.ControllerCfg.GetTLSProvider() == config.TLSProviderOpenShift {
+		annotations["service.alpha.openshift.io/serving-cert-secret-name"] = getProxySecretName(instance)
+	}
 	service := &corev1.Service{
 		ObjectMeta: v1.ObjectMeta{
-			Name:      getServiceName(instance),
-			Namespace: instance.Namespace, // TODO: Make configurable
-			Labels:    labels,
-			Annotations: map[string]string{
-				"service.alpha.openshift.io/serving-cert-secret-name": getServiceAccountName(instance),
-			},
+			Name:        getServiceName(instance),
+			Namespace:   getShellNamespace(instance),
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
 				{
 					Name:       "cloud-shell-proxy",
 					Protocol:   corev1.ProtocolTCP,
-					Port:       8443,
-					TargetPort: intstr.FromInt(8443),
+					Port:       proxyPort,
+					TargetPort: intstr.FromInt(proxyPort),
 				},
 			},
 			Selector: labels,
 			Type:     corev1.ServiceTypeClusterIP,
 		},
 	}
+	r.setOwner(instance, service)
+	return service
+}
 
+func (r *ReconcileCloudShell) getSpecRoute(instance *v1alpha1.CloudShell, service *corev1.Service) *routeV1.Route {
 	route := &routeV1.Route{
 		ObjectMeta: v1.ObjectMeta{
 			Name:      getRouteName(instance),
-			Namespace: instance.Namespace,
-			Labels:    labels,
+			Namespace: getShellNamespace(instance),
+			Labels:    getLabelsForID(instance.Status.Id),
 		},
 		Spec: routeV1.RouteSpec{
-			Host: fmt.Sprintf("%s-%s.%s", "cloudshell", instance.Status.Id, "192.168.42.191.nip.io"),
+			Host: getHostname(instance),
 			To: routeV1.RouteTargetReference{
 				Kind: "Service",
 				Name: service.Name,
@@ -101,11 +120,58 @@ func (r *ReconcileCloudShell) getSpecRouting(instance *v1alpha1.CloudShell) (*co
 			},
 		},
 	}
+	r.setOwner(instance, route)
+	return route
+}
 
-	controllerutil.SetControllerReference(instance, service, r.scheme)
-	controllerutil.SetControllerReference(instance, route, r.scheme)
-
-	return service, route
+// getSpecIngress returns the Ingress used in place of a Route on non-OpenShift clusters. TLS is terminated at the
+// ingress controller using the external certificate and re-encrypted to the proxy.
+func (r *ReconcileCloudShell) getSpecIngress(instance *v1alpha1.CloudShell, service *corev1.Service) *networkingv1beta1.Ingress {
+	host := getHostname(instance)
+	annotations := config.ControllerCfg.GetIngressAnnotations()
+	annotations["kubernetes.io/ingress.class"] = config.ControllerCfg.GetIngressClass()
+	managed := make([]string, 0, len(annotations))
+	for key := range annotations {
+		managed = append(managed, key)
+	}
+	sort.Strings(managed)
+	annotations[managedAnnotationsAnnotation] = strings.Join(managed, ",")
+	ingress := &networkingv1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        getIngressName(instance),
+			Namespace:   getShellNamespace(instance),
+			Labels:      getLabelsForID(instance.Status.Id),
+			Annotations: annotations,
+		},
+		Spec: networkingv1beta1.IngressSpec{
+			TLS: []networkingv1beta1.IngressTLS{
+				{
+					Hosts:      []string{host},
+					SecretName: getExternalTLSSecretName(instance),
+				},
+			},
+			Rules: []networkingv1beta1.IngressRule{
+				{
+					Host: host,
+					IngressRuleValue: networkingv1beta1.IngressRuleValue{
+						HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+							Paths: []networkingv1beta1.HTTPIngressPath{
+								{
+									Path: "/",
+									Backend: networkingv1beta1.IngressBackend{
+										ServiceName: service.Name,
+										ServicePort: intstr.FromInt(proxyPort),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	r.setOwner(instance, ingress)
+	return ingress
 }
 
 // The remaining functions are a good argument for type parameters/generics in Go.
@@ -183,3 +249,61 @@ func (r *ReconcileCloudShell) getClusterRoute(spec *routeV1.Route) (*routeV1.Rou
 	}
 	return found, err
 }
+
+func (r *ReconcileCloudShell) reconcileIngress(spec *networkingv1beta1.Ingress, log logr.Logger) (ok bool, err error) {
+	cluster, err := r.getClusterIngress(spec)
+	if err != nil {
+		return false, err
+	}
+	if cluster == nil {
+		log.Info("Creating ingress")
+		err = r.client.Create(context.TODO(), spec)
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !cmp.Equal(spec, cluster, ingressDiffOpts) || !containsAll(cluster.Labels, spec.Labels) ||
+		!containsAll(cluster.Annotations, spec.Annotations) {
+		log.Info("Updating ingress")
+		cluster.Spec = spec.Spec
+		// Annotations set by others, such as cert-manager, are kept
+		for _, key := range strings.Split(cluster.Annotations[managedAnnotationsAnnotation], ",") {
+			delete(cluster.Annotations, key)
+		}
+		cluster.Annotations = mergeLabels(cluster.Annotations, spec.Annotations)
+		cluster.Labels = mergeLabels(cluster.Labels, spec.Labels)
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *ReconcileCloudShell) getClusterIngress(spec *networkingv1beta1.Ingress) (*networkingv1beta1.Ingress, error) {
+	found := &networkingv1beta1.Ingress{}
+	namespaceName := types.NamespacedName{
+		Name:      spec.Name,
+		Namespace: spec.Namespace,
+	}
+	err := r.client.Get(context.TODO(), namespaceName, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return found, err
+}
+
+// containsAll returns whether m holds every key in required with the same value
+func containsAll(m, required map[string]string) bool {
+	for key, value := range required {
+		if existing, ok := m[key]; !ok || existing != value {
+			return false
+		}
+	}
+	return true
+}
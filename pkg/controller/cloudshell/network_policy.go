@@ -0,0 +1,284 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func (r *ReconcileCloudShell) reconcileNetworkPolicy(ctx reconcileContext) deployStatus {
+	spec, err := r.getSpecNetworkPolicy(ctx.instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	cluster := &networkingv1.NetworkPolicy{}
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: spec.Name, Namespace: spec.Namespace}, cluster)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return deployStatus{Error: err}
+		}
+		ctx.log.Info("Creating network policy")
+		err = r.client.Create(context.TODO(), spec)
+		if errors.IsAlreadyExists(err) {
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	if !cmp.Equal(spec, cluster, networkPolicyDiffOpts) {
+		ctx.log.Info("Updating network policy")
+		cluster.Spec = spec.Spec
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	return deployStatus{Continue: true}
+}
+
+// getSpecNetworkPolicy returns a NetworkPolicy for the shell pod that only allows ingress to the proxy port from the
+// router namespaces and to the agent port from the operator, and egress according to the CloudShell's egress policy
+// merged with operator defaults.
+func (r *ReconcileCloudShell) getSpecNetworkPolicy(instance *v1alpha1.CloudShell) (*networkingv1.NetworkPolicy, error) {
+	egress, err := getEgressPolicy(instance, config.ControllerCfg.GetDefaultEgressPolicy())
+	if err != nil {
+		return nil, err
+	}
+	egressRules, err := r.getEgressRules(egress)
+	if err != nil {
+		return nil, err
+	}
+	tcp := corev1.ProtocolTCP
+	port := intstr.FromInt(proxyPort)
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getNetworkPolicyName(instance),
+			Namespace: getShellNamespace(instance),
+			Labels:    getLabelsForID(instance.Status.Id),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: getLabelsForID(instance.Status.Id),
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Protocol: &tcp, Port: &port},
+					},
+					From: []networkingv1.NetworkPolicyPeer{
+						{NamespaceSelector: getRouterNamespaceSelector()},
+					},
+				},
+			},
+			Egress:      egressRules,
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+	// The agent is only reachable from the operator's pods in the operator's namespace. An empty namespace selector
+	// would match every namespace, in which anyone may label a pod like the operator's.
+	operatorNamespace := config.ControllerCfg.GetOperatorNamespaceSelector()
+	if needsAgent(instance) && !operatorNamespace.Empty() {
+		agent := intstr.FromInt(agentPort)
+		namespaceSelector, err := metav1.ParseToLabelSelector(operatorNamespace.String())
+		if err != nil {
+			return nil, err
+		}
+		policy.Spec.Ingress = append(policy.Spec.Ingress, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &tcp, Port: &agent},
+			},
+			From: []networkingv1.NetworkPolicyPeer{
+				{
+					NamespaceSelector: namespaceSelector,
+					PodSelector:       &metav1.LabelSelector{MatchLabels: operatorPodLabels},
+				},
+			},
+		})
+	}
+	err = r.setOwner(instance, policy)
+	return policy, err
+}
+
+// getEgressPolicy merges the CloudShell's egress policy with the operator's default policy. A CloudShell can only
+// narrow the defaults: it may disallow DNS or the API server, restrict the allowed CIDRs to ones within the default
+// allowed CIDRs, and deny additional CIDRs. The default denied CIDRs always apply.
+func getEgressPolicy(instance *v1alpha1.CloudShell, policy v1alpha1.EgressPolicy) (v1alpha1.EgressPolicy, error) {
+	if instance.Spec.Network == nil || instance.Spec.Network.Egress == nil {
+		return policy, nil
+	}
+	egress := instance.Spec.Network.Egress
+	if egress.AllowDNS != nil {
+		if *egress.AllowDNS && !isTrue(policy.AllowDNS) {
+			return policy, fmt.Errorf("egress to DNS is not allowed by the operator's egress policy")
+		}
+		policy.AllowDNS = egress.AllowDNS
+	}
+	if egress.AllowAPIServer != nil {
+		if *egress.AllowAPIServer && !isTrue(policy.AllowAPIServer) {
+			return policy, fmt.Errorf("egress to the API server is not allowed by the operator's egress policy")
+		}
+		policy.AllowAPIServer = egress.AllowAPIServer
+	}
+	if egress.AllowedCIDRs != nil {
+		for _, cidr := range egress.AllowedCIDRs {
+			within, err := cidrWithinAny(cidr, policy.AllowedCIDRs)
+			if err != nil {
+				return policy, err
+			}
+			if !within {
+				return policy, fmt.Errorf("egress to %s is not allowed by the operator's egress policy", cidr)
+			}
+		}
+		policy.AllowedCIDRs = egress.AllowedCIDRs
+	}
+	policy.DeniedCIDRs = append(policy.DeniedCIDRs, egress.DeniedCIDRs...)
+	return policy, nil
+}
+
+func isTrue(value *bool) bool {
+	return value != nil && *value
+}
+
+// cidrWithinAny returns whether cidr is contained in, or equal to, one of the outer CIDRs
+func cidrWithinAny(cidr string, outer []string) (bool, error) {
+	_, inner, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, fmt.Errorf("invalid allowed CIDR %q: %s", cidr, err)
+	}
+	for _, outerCIDR := range outer {
+		_, outerNet, err := net.ParseCIDR(outerCIDR)
+		if err != nil {
+			return false, fmt.Errorf("invalid allowed CIDR %q: %s", outerCIDR, err)
+		}
+		if cidrContains(outerNet, inner) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *ReconcileCloudShell) getEgressRules(policy v1alpha1.EgressPolicy) ([]networkingv1.NetworkPolicyEgressRule, error) {
+	// An empty (non-nil) list of rules denies all egress
+	rules := []networkingv1.NetworkPolicyEgressRule{}
+	tcp, udp := corev1.ProtocolTCP, corev1.ProtocolUDP
+
+	if policy.AllowDNS != nil && *policy.AllowDNS {
+		// OpenShift's cluster DNS listens on 5353; other distributions use 53
+		var ports []networkingv1.NetworkPolicyPort
+		for _, p := range []int{53, 5353} {
+			port := intstr.FromInt(p)
+			ports = append(ports,
+				networkingv1.NetworkPolicyPort{Protocol: &udp, Port: &port},
+				networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &port})
+		}
+		rules = append(rules, networkingv1.NetworkPolicyEgressRule{Ports: ports})
+	}
+
+	if policy.AllowAPIServer != nil && *policy.AllowAPIServer {
+		rule, err := r.getAPIServerEgressRule()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if len(policy.AllowedCIDRs) > 0 {
+		peers, err := getIPBlockPeers(policy.AllowedCIDRs, policy.DeniedCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		// A rule without peers would allow all destinations
+		if len(peers) > 0 {
+			rules = append(rules, networkingv1.NetworkPolicyEgressRule{To: peers})
+		}
+	}
+	return rules, nil
+}
+
+// getAPIServerEgressRule allows traffic to the API server endpoints. NetworkPolicies apply after service address
+// translation, so the endpoints of the default/kubernetes service are used rather than its cluster IP. Reading these
+// endpoints requires cluster-level permissions; when running with a namespaced Role, configure the API server CIDRs
+// in the controller config instead.
+func (r *ReconcileCloudShell) getAPIServerEgressRule() (networkingv1.NetworkPolicyEgressRule, error) {
+	if cidrs := config.ControllerCfg.GetAPIServerCIDRs(); len(cidrs) > 0 {
+		peers, err := getIPBlockPeers(cidrs, nil)
+		return networkingv1.NetworkPolicyEgressRule{To: peers}, err
+	}
+	endpoints := &corev1.Endpoints{}
+	err := r.apiReader.Get(context.TODO(), types.NamespacedName{Name: "kubernetes", Namespace: "default"}, endpoints)
+	if err != nil {
+		return networkingv1.NetworkPolicyEgressRule{}, err
+	}
+	rule := networkingv1.NetworkPolicyEgressRule{}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			rule.To = append(rule.To, networkingv1.NetworkPolicyPeer{
+				IPBlock: &networkingv1.IPBlock{CIDR: address.IP + "/32"},
+			})
+		}
+		for _, endpointPort := range subset.Ports {
+			protocol := endpointPort.Protocol
+			port := intstr.FromInt(int(endpointPort.Port))
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port})
+		}
+	}
+	return rule, nil
+}
+
+// getIPBlockPeers converts allowed and denied CIDRs into IPBlock peers. Denied CIDRs are added as exceptions to each
+// allowed CIDR that strictly contains them, as required by the NetworkPolicy API; allowed CIDRs within a denied CIDR
+// are left out.
+func getIPBlockPeers(allowed, denied []string) ([]networkingv1.NetworkPolicyPeer, error) {
+	var deniedNets []*net.IPNet
+	for _, cidr := range denied {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied CIDR %q: %s", cidr, err)
+		}
+		deniedNets = append(deniedNets, ipNet)
+	}
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, cidr := range allowed {
+		_, allowedNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %s", cidr, err)
+		}
+		block := &networkingv1.IPBlock{CIDR: allowedNet.String()}
+		denied := false
+		for _, deniedNet := range deniedNets {
+			if cidrContains(deniedNet, allowedNet) {
+				denied = true
+				break
+			}
+			if cidrStrictlyContains(allowedNet, deniedNet) {
+				block.Except = append(block.Except, deniedNet.String())
+			}
+		}
+		if !denied {
+			peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: block})
+		}
+	}
+	return peers, nil
+}
+
+func cidrContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+func cidrStrictlyContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && innerOnes > outerOnes && outer.Contains(inner.IP)
+}
@@ -0,0 +1,188 @@
+package cloudshell
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/google/go-cmp/cmp"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+func TestGetEgressPolicy(t *testing.T) {
+	yes, no := true, false
+	defaults := v1alpha1.EgressPolicy{
+		AllowDNS:       &yes,
+		AllowAPIServer: &no,
+		AllowedCIDRs:   []string{"10.0.0.0/8", "192.168.0.0/16"},
+		DeniedCIDRs:    []string{"169.254.169.254/32"},
+	}
+	tests := []struct {
+		name     string
+		egress   *v1alpha1.EgressPolicy
+		expected v1alpha1.EgressPolicy
+		valid    bool
+	}{
+		{
+			name:     "defaults",
+			expected: defaults,
+			valid:    true,
+		},
+		{
+			name:   "disallow DNS",
+			egress: &v1alpha1.EgressPolicy{AllowDNS: &no},
+			expected: v1alpha1.EgressPolicy{
+				AllowDNS:       &no,
+				AllowAPIServer: &no,
+				AllowedCIDRs:   defaults.AllowedCIDRs,
+				DeniedCIDRs:    defaults.DeniedCIDRs,
+			},
+			valid: true,
+		},
+		{
+			name:   "allow API server",
+			egress: &v1alpha1.EgressPolicy{AllowAPIServer: &yes},
+		},
+		{
+			name:   "narrow allowed CIDRs",
+			egress: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"10.1.0.0/16", "192.168.0.0/16"}},
+			expected: v1alpha1.EgressPolicy{
+				AllowDNS:       &yes,
+				AllowAPIServer: &no,
+				AllowedCIDRs:   []string{"10.1.0.0/16", "192.168.0.0/16"},
+				DeniedCIDRs:    defaults.DeniedCIDRs,
+			},
+			valid: true,
+		},
+		{
+			name:   "widen allowed CIDRs",
+			egress: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"0.0.0.0/0"}},
+		},
+		{
+			name:   "allowed CIDR outside the defaults",
+			egress: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"172.16.0.0/12"}},
+		},
+		{
+			name:   "invalid allowed CIDR",
+			egress: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"10.0.0.0"}},
+		},
+		{
+			name:   "additional denied CIDRs",
+			egress: &v1alpha1.EgressPolicy{DeniedCIDRs: []string{"10.0.0.0/24"}},
+			expected: v1alpha1.EgressPolicy{
+				AllowDNS:       &yes,
+				AllowAPIServer: &no,
+				AllowedCIDRs:   defaults.AllowedCIDRs,
+				DeniedCIDRs:    []string{"169.254.169.254/32", "10.0.0.0/24"},
+			},
+			valid: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := &v1alpha1.CloudShell{}
+			if test.egress != nil {
+				instance.Spec.Network = &v1alpha1.NetworkSpec{Egress: test.egress}
+			}
+			policy, err := getEgressPolicy(instance, *defaults.DeepCopy())
+			if test.valid && err != nil {
+				t.Fatalf("expected egress policy to be valid, got %s", err)
+			}
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected egress policy to be invalid")
+				}
+				return
+			}
+			if !cmp.Equal(policy, test.expected) {
+				t.Errorf("unexpected egress policy: %s", cmp.Diff(test.expected, policy))
+			}
+		})
+	}
+}
+
+func TestGetIPBlockPeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		denied   []string
+		expected []networkingv1.IPBlock
+		valid    bool
+	}{
+		{
+			name:     "allowed only",
+			allowed:  []string{"10.0.0.0/8"},
+			expected: []networkingv1.IPBlock{{CIDR: "10.0.0.0/8"}},
+			valid:    true,
+		},
+		{
+			name:     "normalized CIDR",
+			allowed:  []string{"10.1.2.3/8"},
+			expected: []networkingv1.IPBlock{{CIDR: "10.0.0.0/8"}},
+			valid:    true,
+		},
+		{
+			name:    "denied within allowed",
+			allowed: []string{"0.0.0.0/0", "10.0.0.0/8"},
+			denied:  []string{"169.254.169.254/32", "10.1.0.0/16"},
+			expected: []networkingv1.IPBlock{
+				{CIDR: "0.0.0.0/0", Except: []string{"169.254.169.254/32", "10.1.0.0/16"}},
+				{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16"}},
+			},
+			valid: true,
+		},
+		{
+			name:     "allowed within denied",
+			allowed:  []string{"10.1.0.0/16", "192.168.0.0/16"},
+			denied:   []string{"10.0.0.0/8"},
+			expected: []networkingv1.IPBlock{{CIDR: "192.168.0.0/16"}},
+			valid:    true,
+		},
+		{
+			name:    "allowed equal to denied",
+			allowed: []string{"10.0.0.0/8"},
+			denied:  []string{"10.0.0.0/8"},
+			valid:   true,
+		},
+		{
+			name:     "different address families",
+			allowed:  []string{"0.0.0.0/0", "::/0"},
+			denied:   []string{"fd00::/8"},
+			expected: []networkingv1.IPBlock{{CIDR: "0.0.0.0/0"}, {CIDR: "::/0", Except: []string{"fd00::/8"}}},
+			valid:    true,
+		},
+		{
+			name:    "invalid allowed CIDR",
+			allowed: []string{"10.0.0.0/33"},
+		},
+		{
+			name:    "invalid denied CIDR",
+			allowed: []string{"10.0.0.0/8"},
+			denied:  []string{"10.0.0.1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers, err := getIPBlockPeers(test.allowed, test.denied)
+			if test.valid && err != nil {
+				t.Fatalf("expected CIDRs to be valid, got %s", err)
+			}
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected CIDRs to be invalid")
+				}
+				return
+			}
+			var blocks []networkingv1.IPBlock
+			for _, peer := range peers {
+				if peer.IPBlock == nil || peer.PodSelector != nil || peer.NamespaceSelector != nil {
+					t.Fatalf("expected IPBlock peers only, got %+v", peer)
+				}
+				blocks = append(blocks, *peer.IPBlock)
+			}
+			if fmt.Sprint(blocks) != fmt.Sprint(test.expected) {
+				t.Errorf("expected IPBlocks %v, got %v", test.expected, blocks)
+			}
+		})
+	}
+}
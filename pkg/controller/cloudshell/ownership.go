@@ -0,0 +1,167 @@
+package cloudshell
+
+import (
+	"context"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	routeV1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// cleanupFinalizer is added to CloudShells whose resources live in another namespace, as owner references
+	// cannot cross namespaces and garbage collection will not remove them.
+	cleanupFinalizer = "cloudshell.eclipse.org/cleanup"
+
+	// ownerUIDLabel is set to the UID of the CloudShell owning an object in another namespace. CloudShell names can
+	// be longer than label values, so the name and namespace are kept in annotations.
+	ownerUIDLabel            = "cloudshell.eclipse.org/cloudshell-uid"
+	ownerNameAnnotation      = "cloudshell.eclipse.org/cloudshell-name"
+	ownerNamespaceAnnotation = "cloudshell.eclipse.org/cloudshell-namespace"
+)
+
+// setOwner marks obj as owned by instance. Objects in the CloudShell's namespace get a controller reference; objects
+// in other namespaces are labelled with the CloudShell's UID, annotated with its name and namespace, and cleaned up by
+// the finalizer.
+func (r *ReconcileCloudShell) setOwner(instance *v1alpha1.CloudShell, obj metav1.Object) error {
+	if obj.GetNamespace() == instance.Namespace {
+		return controllerutil.SetControllerReference(instance, obj, r.scheme)
+	}
+	obj.SetLabels(mergeLabels(obj.GetLabels(), map[string]string{ownerUIDLabel: string(instance.UID)}))
+	obj.SetAnnotations(mergeLabels(obj.GetAnnotations(), map[string]string{
+		ownerNameAnnotation:      instance.Name,
+		ownerNamespaceAnnotation: instance.Namespace,
+	}))
+	return nil
+}
+
+// getOwnerSelectors returns the label selectors matching the objects setOwner marked as owned by instance in another
+// namespace. Objects created before the UID label was used are labelled with the CloudShell's name and namespace,
+// under the same keys as the annotations, which was only possible for names that fit in a label value.
+func getOwnerSelectors(instance *v1alpha1.CloudShell) []client.MatchingLabels {
+	selectors := []client.MatchingLabels{{ownerUIDLabel: string(instance.UID)}}
+	if len(validation.IsValidLabelValue(instance.Name)) == 0 {
+		selectors = append(selectors, client.MatchingLabels{
+			ownerNameAnnotation:      instance.Name,
+			ownerNamespaceAnnotation: instance.Namespace,
+		})
+	}
+	return selectors
+}
+
+// needsCleanupFinalizer returns whether a CloudShell's resources are created outside its own namespace
+func needsCleanupFinalizer(instance *v1alpha1.CloudShell) bool {
+	return getShellNamespace(instance) != instance.Namespace
+}
+
+// ownedObjectLists returns the list types of all objects the controller may create for a CloudShell
+func ownedObjectLists() []runtime.Object {
+	lists := []runtime.Object{
+		&appsv1.DeploymentList{},
+		&appsv1.StatefulSetList{},
+		&corev1.PersistentVolumeClaimList{},
+		&corev1.ServiceList{},
+		&corev1.ServiceAccountList{},
+		&corev1.SecretList{},
+		&networkingv1.NetworkPolicyList{},
+	}
+	if config.ControllerCfg.IsOpenShift() {
+		lists = append(lists, &routeV1.RouteList{})
+	} else {
+		lists = append(lists, &networkingv1beta1.IngressList{})
+	}
+	if config.ControllerCfg.UseCertManager() {
+		certificates := &unstructured.UnstructuredList{}
+		certificates.SetGroupVersionKind(certificateGVK.GroupVersion().WithKind(certificateGVK.Kind + "List"))
+		lists = append(lists, certificates)
+	}
+	return lists
+}
+
+// finalize deletes the objects created for a CloudShell in another namespace and removes the cleanup finalizer once
+// none remain. Objects are listed through the uncached reader, so that kinds that are not watched (e.g. Secrets) are
+// not cached.
+func (r *ReconcileCloudShell) finalize(ctx reconcileContext) (reconcile.Result, error) {
+	instance := ctx.instance
+	if !hasFinalizer(instance, cleanupFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	ctx.log.Info("Cleaning up CloudShell resources", "namespace", getShellNamespace(instance))
+	remaining := false
+	for _, selector := range getOwnerSelectors(instance) {
+		for _, list := range ownedObjectLists() {
+			err := r.apiReader.List(context.TODO(), list, client.InNamespace(getShellNamespace(instance)), selector)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			items, err := meta.ExtractList(list)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			for _, item := range items {
+				remaining = true
+				err := r.client.Delete(context.TODO(), item)
+				if err != nil && !errors.IsNotFound(err) {
+					return reconcile.Result{}, err
+				}
+			}
+		}
+	}
+	if remaining {
+		return reconcile.Result{Requeue: true}, nil
+	}
+	instance.Finalizers = removeString(instance.Finalizers, cleanupFinalizer)
+	return reconcile.Result{}, r.client.Update(context.TODO(), instance)
+}
+
+func hasFinalizer(instance *v1alpha1.CloudShell, finalizer string) bool {
+	for _, f := range instance.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// enqueueForOwnerLabels maps objects marked by setOwner back to the CloudShell that created them. Objects created
+// before the name and namespace were kept in annotations have them in labels.
+var enqueueForOwnerLabels = &handler.EnqueueRequestsFromMapFunc{
+	ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+		marks := obj.Meta.GetAnnotations()
+		if marks[ownerNameAnnotation] == "" {
+			marks = obj.Meta.GetLabels()
+		}
+		name, namespace := marks[ownerNameAnnotation], marks[ownerNamespaceAnnotation]
+		if name == "" || namespace == "" {
+			return nil
+		}
+		return []reconcile.Request{
+			{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}},
+		}
+	}),
+}
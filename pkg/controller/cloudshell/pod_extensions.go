@@ -0,0 +1,149 @@
+package cloudshell
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// isOperatorSidecar returns whether a container is a sidecar managed by the operator, as opposed to the shell
+// container or containers added through the CloudShell spec.
+func isOperatorSidecar(name string) bool {
+	return name == machineExecContainerName || name == oauthProxyContainerName || name == agentContainerName
+}
+
+// getReservedContainerNames returns the names of containers and init containers managed by the operator
+func getReservedContainerNames() map[string]bool {
+	return map[string]bool{
+		shellHostContainerName:    true,
+		machineExecContainerName:  true,
+		oauthProxyContainerName:   true,
+		projectCloneContainerName: true,
+		dotfilesContainerName:     true,
+		credentialsContainerName:  true,
+		agentContainerName:        true,
+	}
+}
+
+// validatePodExtensions checks that sidecars, init containers, and volumes in a CloudShell's spec do not collide with
+// each other or with those managed by the operator, and that the volume mounts of the shell and of user containers
+// only refer to volumes in spec.volumes, as the operator's volumes hold credentials and other shells' recordings. User
+// containers run with the operator's security profile, so they may not set their own security context.
+func validatePodExtensions(instance *v1alpha1.CloudShell) error {
+	containerNames := getReservedContainerNames()
+	userContainers := append([]corev1.Container{}, instance.Spec.Sidecars...)
+	userContainers = append(userContainers, instance.Spec.InitContainers...)
+	for _, container := range userContainers {
+		if container.Name == "" {
+			return fmt.Errorf("sidecars and init containers must have a name")
+		}
+		if containerNames[container.Name] {
+			return fmt.Errorf("container name %s is reserved or duplicated", container.Name)
+		}
+		containerNames[container.Name] = true
+		if container.SecurityContext != nil {
+			return fmt.Errorf("container %s sets a security context; containers run with the operator's security profile",
+				container.Name)
+		}
+	}
+
+	// Volumes generated by the operator, excluding the volumes, sidecars and init containers from the spec
+	generated := getSpecPod(&v1alpha1.CloudShell{
+		ObjectMeta: instance.ObjectMeta,
+		Spec: v1alpha1.CloudShellSpec{
+			Projects:    instance.Spec.Projects,
+			Dotfiles:    instance.Spec.Dotfiles,
+			Credentials: instance.Spec.Credentials,
+		},
+		Status: instance.Status,
+	})
+	volumeNames := map[string]bool{}
+	for _, volume := range generated.Volumes {
+		volumeNames[volume.Name] = true
+	}
+	userVolumes := map[string]bool{}
+	for _, volume := range instance.Spec.Volumes {
+		// Volumes added depending on the operator's configuration, such as those for audit, are not generated above
+		if volumeNames[volume.Name] || userVolumes[volume.Name] || isOperatorManagedName(volume.Name) {
+			return fmt.Errorf("volume name %s is reserved or duplicated", volume.Name)
+		}
+		userVolumes[volume.Name] = true
+		if err := validateVolumeSource(volume); err != nil {
+			return err
+		}
+	}
+	if err := validateVolumeMounts(shellHostContainerName, instance.Spec.VolumeMounts, userVolumes); err != nil {
+		return err
+	}
+	for _, container := range userContainers {
+		if err := validateVolumeMounts(container.Name, container.VolumeMounts, userVolumes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateVolumeMounts checks that the volume mounts a CloudShell's spec adds to a container refer to volumes in
+// spec.volumes
+func validateVolumeMounts(container string, mounts []corev1.VolumeMount, userVolumes map[string]bool) error {
+	for _, mount := range mounts {
+		if !userVolumes[mount.Name] {
+			return fmt.Errorf("volume mount %s of container %s does not refer to a volume in spec.volumes",
+				mount.Name, container)
+		}
+	}
+	return nil
+}
+
+// validateVolumeSource checks that a volume from a CloudShell's spec is of a type users may add, and does not refer to
+// a ConfigMap or PersistentVolumeClaim managed by the operator. Other volume types, such as hostPath, would give
+// access to the node, and Secrets are made available through spec.credentials.
+func validateVolumeSource(volume corev1.Volume) error {
+	source := volume.VolumeSource
+	switch {
+	case source.EmptyDir != nil, source.DownwardAPI != nil:
+		return nil
+	case source.ConfigMap != nil:
+		if isOperatorManagedName(source.ConfigMap.Name) {
+			return fmt.Errorf("volume %s refers to ConfigMap %s, which is managed by the operator",
+				volume.Name, source.ConfigMap.Name)
+		}
+		return nil
+	case source.PersistentVolumeClaim != nil:
+		claimName := source.PersistentVolumeClaim.ClaimName
+		if isOperatorManagedName(claimName) || claimName == config.ControllerCfg.GetAuditClaimName() {
+			return fmt.Errorf("volume %s refers to PersistentVolumeClaim %s, which is managed by the operator",
+				volume.Name, claimName)
+		}
+		return nil
+	}
+	return fmt.Errorf("volume %s is not allowed; only emptyDir, configMap, downwardAPI and persistentVolumeClaim "+
+		"volumes may be added", volume.Name)
+}
+
+// isOperatorManagedName returns whether a resource name is reserved for resources the operator creates for shells
+func isOperatorManagedName(name string) bool {
+	return strings.HasPrefix(name, "cloudshell-")
+}
+
+// applyPodExtensions merges the sidecars, init containers, volumes and volume mounts from a CloudShell's spec into
+// the generated pod spec. User init containers run after those managed by the operator.
+func applyPodExtensions(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	for _, sidecar := range instance.Spec.Sidecars {
+		podSpec.Containers = append(podSpec.Containers, *sidecar.DeepCopy())
+	}
+	for _, initContainer := range instance.Spec.InitContainers {
+		podSpec.InitContainers = append(podSpec.InitContainers, *initContainer.DeepCopy())
+	}
+	for _, volume := range instance.Spec.Volumes {
+		podSpec.Volumes = append(podSpec.Volumes, *volume.DeepCopy())
+	}
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == shellHostContainerName {
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, instance.Spec.VolumeMounts...)
+		}
+	}
+}
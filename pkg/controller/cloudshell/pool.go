@@ -0,0 +1,321 @@
+package cloudshell
+
+import (
+	"context"
+	"sort"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// claimedByAnnotation is set on a pooled CloudShell to the name of the CloudShell claiming it, while its resources
+// are handed over
+const claimedByAnnotation = "cloudshell.eclipse.org/claimed-by"
+
+var poolLog = log.WithName("pool")
+
+// AddPool creates the CloudShellPool controller and adds it to the Manager
+func AddPool(mgr manager.Manager) error {
+	r := &ReconcilePool{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+	c, err := controller.New("cloudshellpool-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: &v1alpha1.CloudShellPool{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+	// Refill the pool as its shells are claimed, and update its status as they become ready
+	return c.Watch(&source.Kind{Type: &v1alpha1.CloudShell{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &v1alpha1.CloudShellPool{},
+	})
+}
+
+var _ reconcile.Reconciler = &ReconcilePool{}
+
+// ReconcilePool keeps the number of unclaimed CloudShells of a CloudShellPool at its size. The pool's shells are
+// regular CloudShells, labelled with the pool's name and owned by it.
+type ReconcilePool struct {
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+func (r *ReconcilePool) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := poolLog.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+
+	pool := &v1alpha1.CloudShellPool{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// The pool's shells are garbage collected
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if pool.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+	if config.ControllerCfg.GetNamespaceMode() == config.NamespaceModePerUser {
+		// Pooled shells have no owner, so there is no namespace to start them in
+		reqLogger.Info("Pools are not supported with per-user namespaces; ignoring CloudShellPool")
+		return reconcile.Result{}, nil
+	}
+
+	shells, err := getPoolShells(r.client, pool)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	var unclaimed []*v1alpha1.CloudShell
+	for i := range shells {
+		shell := &shells[i]
+		if shell.DeletionTimestamp != nil || shell.Annotations[claimedByAnnotation] != "" {
+			continue
+		}
+		// Shells whose spec no longer matches the template can never be claimed, and expired shells can not run.
+		// Shells waiting for a quota are kept, so that they start in turn rather than being replaced.
+		if !cmp.Equal(shell.Spec, pool.Spec.Template, cmpopts.EquateEmpty()) || isExpired(shell) {
+			reqLogger.Info("Deleting outdated pooled CloudShell", "CloudShell.Name", shell.Name)
+			if err := r.client.Delete(context.TODO(), shell); err != nil && !errors.IsNotFound(err) {
+				return reconcile.Result{}, err
+			}
+			continue
+		}
+		unclaimed = append(unclaimed, shell)
+	}
+
+	size := int(pool.Spec.Size)
+	if max := config.ControllerCfg.GetPoolMaxSize(); size > max {
+		reqLogger.Info("Pool size exceeds the configured maximum", "size", size, "max", max)
+		size = max
+	}
+	for i := len(unclaimed); i < size; i++ {
+		shell := &v1alpha1.CloudShell{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: pool.Name + "-",
+				Namespace:    pool.Namespace,
+				Labels:       map[string]string{v1alpha1.PoolLabel: pool.Name},
+			},
+			Spec: *pool.Spec.Template.DeepCopy(),
+		}
+		if err := controllerutil.SetControllerReference(pool, shell, r.scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+		reqLogger.Info("Creating pooled CloudShell")
+		if err := r.client.Create(context.TODO(), shell); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if len(unclaimed) > size {
+		// Remove the shells that are furthest from ready first
+		sort.SliceStable(unclaimed, func(i, j int) bool {
+			if unclaimed[i].Status.Ready != unclaimed[j].Status.Ready {
+				return !unclaimed[i].Status.Ready
+			}
+			return unclaimed[j].CreationTimestamp.Before(&unclaimed[i].CreationTimestamp)
+		})
+		for _, shell := range unclaimed[:len(unclaimed)-size] {
+			reqLogger.Info("Deleting excess pooled CloudShell", "CloudShell.Name", shell.Name)
+			if err := r.client.Delete(context.TODO(), shell); err != nil && !errors.IsNotFound(err) {
+				return reconcile.Result{}, err
+			}
+		}
+		unclaimed = unclaimed[len(unclaimed)-size:]
+	}
+
+	status := v1alpha1.CloudShellPoolStatus{}
+	for _, shell := range unclaimed {
+		if shell.Status.Ready {
+			status.Ready++
+		} else {
+			status.Starting++
+		}
+	}
+	if status != pool.Status {
+		pool.Status = status
+		return reconcile.Result{}, r.client.Status().Update(context.TODO(), pool)
+	}
+	return reconcile.Result{}, nil
+}
+
+// getPoolShells returns the CloudShells belonging to a pool, including those being claimed
+func getPoolShells(c client.Reader, pool *v1alpha1.CloudShellPool) ([]v1alpha1.CloudShell, error) {
+	shells := &v1alpha1.CloudShellList{}
+	err := c.List(context.TODO(), shells,
+		client.InNamespace(pool.Namespace),
+		client.MatchingLabels{v1alpha1.PoolLabel: pool.Name})
+	return shells.Items, err
+}
+
+// isPooled returns whether a CloudShell belongs to a pool and has not been claimed
+func isPooled(instance *v1alpha1.CloudShell) bool {
+	return instance.Labels[v1alpha1.PoolLabel] != ""
+}
+
+// getMatchingPool returns the pool in a CloudShell's namespace whose template is the CloudShell's spec, or nil if
+// there is none
+func (r *ReconcileCloudShell) getMatchingPool(instance *v1alpha1.CloudShell) (*v1alpha1.CloudShellPool, error) {
+	pools := &v1alpha1.CloudShellPoolList{}
+	if err := r.client.List(context.TODO(), pools, client.InNamespace(instance.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		if pool.DeletionTimestamp == nil && cmp.Equal(pool.Spec.Template, instance.Spec, cmpopts.EquateEmpty()) {
+			return pool, nil
+		}
+	}
+	return nil, nil
+}
+
+// claimPooledShell gives a new CloudShell the id and resources of a ready shell from a matching pool, so that it
+// is ready without starting a pod. It returns whether a shell was claimed. A claim hands the pooled shell's
+// resources over to the claiming CloudShell before deleting the pooled CloudShell; if it is interrupted, it is
+// resumed from the claimed-by annotation.
+func (r *ReconcileCloudShell) claimPooledShell(log logr.Logger, instance *v1alpha1.CloudShell) (bool, error) {
+	if isPooled(instance) || config.ControllerCfg.GetNamespaceMode() == config.NamespaceModePerUser {
+		return false, nil
+	}
+	pool, err := r.getMatchingPool(instance)
+	if err != nil || pool == nil {
+		return false, err
+	}
+	shells, err := getPoolShells(r.client, pool)
+	if err != nil {
+		return false, err
+	}
+	var claimed *v1alpha1.CloudShell
+	for i := range shells {
+		if shells[i].Annotations[claimedByAnnotation] == instance.Name {
+			claimed = &shells[i]
+			break
+		}
+	}
+	if claimed == nil {
+		if quotasEnabled() {
+			// The claimed shell's admission is handed over to the claiming CloudShell, so no other shell may be
+			// admitted in between
+			quotaLock.Lock()
+			defer quotaLock.Unlock()
+		}
+		for i := range shells {
+			shell := &shells[i]
+			if shell.Status.Ready && shell.Status.Id != "" && shell.DeletionTimestamp == nil &&
+				shell.Annotations[claimedByAnnotation] == "" && !isStopped(shell) &&
+				(!quotasEnabled() || holdsQuota(shell)) {
+				claimed = shell
+				break
+			}
+		}
+		if claimed == nil {
+			poolClaims.WithLabelValues(pool.Namespace, pool.Name, "miss").Inc()
+			log.Info("No ready shell in pool", "pool", pool.Name)
+			return false, nil
+		}
+		if quotasEnabled() {
+			// The claimed shell already counts towards the quotas of its namespace and the cluster, so the claiming
+			// CloudShell is checked in its place. A shell over its quota waits stopped rather than taking a running
+			// shell from the pool.
+			all, err := listShellsForQuotas(r.apiReader)
+			if err != nil {
+				return false, err
+			}
+			var others []v1alpha1.CloudShell
+			for i := range all {
+				if all[i].UID != claimed.UID {
+					others = append(others, all[i])
+				}
+			}
+			if checkShellQuotas(instance, others) != "" {
+				return false, nil
+			}
+		}
+		log.Info("Claiming shell from pool", "pool", pool.Name, "CloudShell.Id", claimed.Status.Id)
+		if claimed.Annotations == nil {
+			claimed.Annotations = map[string]string{}
+		}
+		claimed.Annotations[claimedByAnnotation] = instance.Name
+		// Fails on conflict if another CloudShell claimed it first
+		if err := r.client.Update(context.TODO(), claimed); err != nil {
+			return false, err
+		}
+		poolClaims.WithLabelValues(pool.Namespace, pool.Name, "hit").Inc()
+	}
+
+	if err := r.rebindOwnedObjects(claimed, instance); err != nil {
+		return false, err
+	}
+	instance.Status.Id = claimed.Status.Id
+	instance.Status.Pool = pool.Name
+	// The pooled shell runs the same spec, so its image was resolved the same way
+	instance.Status.Image = claimed.Status.Image.DeepCopy()
+	if condition := getCondition(&claimed.Status, v1alpha1.QuotaExceeded); condition != nil && holdsQuota(claimed) {
+		// The claiming CloudShell takes over the claimed shell's place in the quotas
+		setCondition(&instance.Status, *condition)
+	}
+	if err := r.client.Status().Update(context.TODO(), instance); err != nil {
+		return false, err
+	}
+	err = r.client.Delete(context.TODO(), claimed)
+	if errors.IsNotFound(err) {
+		err = nil
+	}
+	return true, err
+}
+
+// rebindOwnedObjects moves the controller references of the objects created for a pooled CloudShell to the
+// CloudShell claiming it, so that they are not garbage collected with the pooled CloudShell. Objects are listed
+// through the uncached reader, as not all kinds are cached, and by owner rather than by label, as not all objects
+// are labelled with the shell's id.
+func (r *ReconcileCloudShell) rebindOwnedObjects(from, to *v1alpha1.CloudShell) error {
+	for _, list := range ownedObjectLists() {
+		err := r.apiReader.List(context.TODO(), list, client.InNamespace(from.Namespace))
+		if err != nil {
+			return err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			obj, err := meta.Accessor(item)
+			if err != nil {
+				return err
+			}
+			var refs []metav1.OwnerReference
+			owned := false
+			for _, ref := range obj.GetOwnerReferences() {
+				if ref.UID == from.UID {
+					owned = true
+					continue
+				}
+				refs = append(refs, ref)
+			}
+			if !owned {
+				continue
+			}
+			obj.SetOwnerReferences(refs)
+			if err := controllerutil.SetControllerReference(to, obj, r.scheme); err != nil {
+				return err
+			}
+			if err := r.client.Update(context.TODO(), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
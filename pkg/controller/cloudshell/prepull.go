@@ -0,0 +1,249 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	prePullerName = "cloudshell-prepuller"
+	// prePullerBinDir holds a copy of the operator binary, which every image runs to wait without pulling anything
+	// else, as shell images need not provide a shell or sleep command
+	prePullerBinDir     = "/var/run/cloudshell/prepuller"
+	prePullerVolumeName = "prepuller-bin"
+	// operatorBinary is the path of the operator binary in the operator image
+	operatorBinary = "/usr/local/bin/cloudshell-operator"
+)
+
+var prePullLog = log.WithName("prepull")
+
+// AddPrePuller creates the controller managing the pre-puller DaemonSet and adds it to the Manager. The DaemonSet is
+// reconciled at startup and whenever a CloudShellPool changes, as the pools' templates determine the shell images.
+func AddPrePuller(mgr manager.Manager) error {
+	namespace := config.ControllerCfg.GetOperatorNamespace()
+	if namespace == "" {
+		return nil
+	}
+	r := &ReconcilePrePuller{client: mgr.GetClient(), apiReader: mgr.GetAPIReader()}
+	c, err := controller.New("prepuller-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Name: prePullerName, Namespace: namespace}}
+	err = c.Watch(&source.Kind{Type: &v1alpha1.CloudShellPool{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{request}
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	startup := make(chan event.GenericEvent, 1)
+	startup <- event.GenericEvent{
+		Meta:   &metav1.ObjectMeta{Name: prePullerName, Namespace: namespace},
+		Object: &appsv1.DaemonSet{},
+	}
+	return c.Watch(&source.Channel{Source: startup}, &handler.EnqueueRequestForObject{})
+}
+
+var _ reconcile.Reconciler = &ReconcilePrePuller{}
+
+// ReconcilePrePuller manages a DaemonSet in the operator's namespace that keeps the images used by shells on nodes.
+// Each image runs as a container that waits forever, so the kubelet keeps the image and pulls it on new nodes.
+type ReconcilePrePuller struct {
+	client client.Client
+	// apiReader reads the DaemonSet, which may be outside the namespaces the manager caches
+	apiReader client.Reader
+}
+
+func (r *ReconcilePrePuller) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	cluster := &appsv1.DaemonSet{}
+	err := r.apiReader.Get(context.TODO(), request.NamespacedName, cluster)
+	if errors.IsNotFound(err) {
+		cluster = nil
+	} else if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if !config.ControllerCfg.IsPrePullEnabled() {
+		if cluster == nil {
+			return reconcile.Result{}, nil
+		}
+		prePullLog.Info("Deleting pre-puller DaemonSet")
+		err = r.client.Delete(context.TODO(), cluster)
+		if errors.IsNotFound(err) {
+			err = nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	images, err := r.getPrePullImages()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	spec := getSpecPrePuller(request.Namespace, images)
+	if cluster == nil {
+		prePullLog.Info("Creating pre-puller DaemonSet", "images", images)
+		err = r.client.Create(context.TODO(), spec)
+		if errors.IsAlreadyExists(err) {
+			return reconcile.Result{Requeue: true}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !cmp.Equal(spec.Spec.Template.Spec, cluster.Spec.Template.Spec, prePullerDiffOpts, getSecurityContextDiffOpts()) {
+		prePullLog.Info("Updating pre-puller DaemonSet", "images", images)
+		cluster.Spec = spec.Spec
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return reconcile.Result{Requeue: true}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+var prePullerDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(corev1.PodSpec{}, "DNSPolicy", "SchedulerName", "DeprecatedServiceAccount", "RestartPolicy", "ServiceAccountName"),
+	cmpopts.IgnoreFields(corev1.Container{}, "TerminationMessagePath", "TerminationMessagePolicy"),
+	cmpopts.EquateEmpty(),
+}
+
+// getPrePullImages returns the images to cache, sorted and without duplicates: the images of the operator's sidecars
+// and init containers, any configured additional images, and the images of CloudShellPool templates that the
+// configuration allows. Pool templates are written by users, so other images in them are not pulled on every node.
+func (r *ReconcilePrePuller) getPrePullImages() ([]string, error) {
+	pools := &v1alpha1.CloudShellPoolList{}
+	if err := r.client.List(context.TODO(), pools); err != nil {
+		return nil, err
+	}
+	cfg := config.ControllerCfg
+	set := map[string]bool{}
+	for _, image := range append([]string{
+		cfg.GetMachineExecImage(), cfg.GetOAuthProxyImage(), cfg.GetGitImage(), cfg.GetAgentImage(),
+	}, cfg.GetPrePullImages()...) {
+		set[image] = true
+	}
+	for _, pool := range pools.Items {
+		template := pool.Spec.Template
+		images := []string{template.Image}
+		for _, container := range append(template.Sidecars, template.InitContainers...) {
+			images = append(images, container.Image)
+		}
+		for _, image := range images {
+			if image == "" || set[image] {
+				continue
+			}
+			if !cfg.IsPrePullAllowed(image) {
+				prePullLog.Info("Not pre-pulling image that is not allowed", "image", image,
+					"CloudShellPool.Namespace", pool.Namespace, "CloudShellPool.Name", pool.Name)
+				continue
+			}
+			set[image] = true
+		}
+	}
+	delete(set, "")
+	images := make([]string, 0, len(set))
+	for image := range set {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// getSpecPrePuller returns the pre-puller DaemonSet caching images
+func getSpecPrePuller(namespace string, images []string) *appsv1.DaemonSet {
+	labels := map[string]string{"app": prePullerName}
+	profile := getSecurityProfile()
+	pause := path.Join(prePullerBinDir, path.Base(operatorBinary))
+	resources := corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("10m"),
+			corev1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1m"),
+			corev1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+	}
+	mounts := []corev1.VolumeMount{{Name: prePullerVolumeName, MountPath: prePullerBinDir}}
+	var containers []corev1.Container
+	for i, image := range images {
+		containers = append(containers, corev1.Container{
+			Name:            fmt.Sprintf("image-%d", i),
+			Image:           image,
+			ImagePullPolicy: getPullPolicy(image),
+			Command:         []string{pause, "pause"},
+			Resources:       resources,
+			VolumeMounts:    mounts,
+			SecurityContext: profile.sidecar.DeepCopy(),
+		})
+	}
+	terminationGracePeriod := int64(1)
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      prePullerName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: getPodAnnotations(),
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{
+						Name:            "install",
+						Image:           config.ControllerCfg.GetAgentImage(),
+						ImagePullPolicy: getPullPolicy(config.ControllerCfg.GetAgentImage()),
+						Command:         []string{"cp", operatorBinary, pause},
+						Resources:       resources,
+						VolumeMounts:    mounts,
+						SecurityContext: profile.sidecar.DeepCopy(),
+					}},
+					Containers: containers,
+					Volumes: []corev1.Volume{{
+						Name: prePullerVolumeName,
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					}},
+					ImagePullSecrets:              getPrePullSecrets(),
+					NodeSelector:                  config.ControllerCfg.GetPrePullNodeSelector(),
+					SecurityContext:               profile.pod.DeepCopy(),
+					TerminationGracePeriodSeconds: &terminationGracePeriod,
+					AutomountServiceAccountToken:  new(bool),
+				},
+			},
+		},
+	}
+}
+
+// getPrePullSecrets returns the pull secrets of the pre-puller, if one is configured
+func getPrePullSecrets() []corev1.LocalObjectReference {
+	if secret := config.ControllerCfg.GetPrePullSecret(); secret != "" {
+		return []corev1.LocalObjectReference{{Name: secret}}
+	}
+	return nil
+}
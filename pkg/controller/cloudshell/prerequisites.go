@@ -2,17 +2,207 @@ package cloudshell
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+
+	cloudshellv1alpha1 "github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
-import rbacv1 "k8s.io/api/rbac/v1"
 
-func (r *ReconcileCloudShell) reconcilePrereqs(ctx reconcileContext) deployStatus {
+// prereqsRequestName is the name used for reconcile requests of the prerequisites controller; requests are keyed
+// by namespace only.
+const prereqsRequestName = "cloudshell-prerequisites"
+
+var prereqLog = log.WithName("prerequisites")
+
+var roleDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(rbacv1.Role{}, "TypeMeta", "ObjectMeta"),
+}
+
+var roleBindingDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(rbacv1.RoleBinding{}, "TypeMeta", "ObjectMeta"),
+}
+
+// addPrereqs adds a controller that manages per-namespace prerequisites (RBAC, and quotas if configured) for
+// CloudShells. Prerequisites are shared by all shells in a namespace, so they are not owned by any single CloudShell;
+// they are created when the first shell appears in a namespace and removed when the last one is deleted.
+func addPrereqs(mgr manager.Manager) error {
+	r := &ReconcilePrerequisites{
+		client:    mgr.GetClient(),
+		apiReader: mgr.GetAPIReader(),
+		scheme:    mgr.GetScheme(),
+		recorder:  mgr.GetEventRecorderFor("cloudshell-prerequisites-controller"),
+	}
+	c, err := controller.New("cloudshell-prerequisites-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	toNamespaceRequest := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+			if shell, isShell := obj.Object.(*cloudshellv1alpha1.CloudShell); isShell {
+				if validateShellNamespace(shell) != nil {
+					return nil
+				}
+				return []reconcile.Request{prereqsRequestForNamespace(getShellNamespace(shell))}
+			}
+			if !isManagedPrereq(obj.Meta) {
+				return nil
+			}
+			return []reconcile.Request{prereqsRequestForNamespace(obj.Meta.GetNamespace())}
+		}),
+	}
+
+	watched := []runtime.Object{&cloudshellv1alpha1.CloudShell{}, &rbacv1.Role{}, &rbacv1.RoleBinding{}}
+	if config.ControllerCfg.HasLocalNamespaceQuota() {
+		watched = append(watched, &corev1.ResourceQuota{}, &corev1.LimitRange{})
+	}
+	for _, obj := range watched {
+		if err := c.Watch(&source.Kind{Type: obj}, toNamespaceRequest); err != nil {
+			return err
+		}
+	}
+
+	if !config.ControllerCfg.GetNamespaceSelector().Empty() && config.ControllerCfg.IsClusterWide() {
+		err = c.Watch(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+				return []reconcile.Request{prereqsRequestForNamespace(obj.Meta.GetName())}
+			}),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prereqsRequestForNamespace(namespace string) reconcile.Request {
+	return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: prereqsRequestName}}
+}
+
+func isManagedPrereq(obj metav1.Object) bool {
+	return obj.GetLabels()[managedByLabel] == managedByValue
+}
+
+// checkManaged returns an error if an existing object was not created by the operator, so that objects of the same
+// name created by others are not taken over. Prerequisites created by earlier versions of the operator are owned by a
+// CloudShell rather than labelled.
+func checkManaged(obj runtime.Object) error {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	if isManagedPrereq(objMeta) {
+		return nil
+	}
+	for _, ref := range objMeta.GetOwnerReferences() {
+		if ref.Kind == "CloudShell" && ref.APIVersion == cloudshellv1alpha1.SchemeGroupVersion.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s already exists in namespace %s and is not managed by the operator",
+		reflect.Indirect(reflect.ValueOf(obj)).Type().Name(), objMeta.GetName(), objMeta.GetNamespace())
+}
+
+// blank assignment to verify that ReconcilePrerequisites implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcilePrerequisites{}
+
+// ReconcilePrerequisites reconciles the RBAC objects required by CloudShells in a namespace
+type ReconcilePrerequisites struct {
+	client    client.Client
+	apiReader client.Reader
+	scheme    *runtime.Scheme
+	recorder  record.EventRecorder
+}
+
+func (r *ReconcilePrerequisites) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	namespace := request.Namespace
+	reqLogger := prereqLog.WithValues("Request.Namespace", namespace)
+
+	candidates, err := getShellsForNamespace(r.client, namespace)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	// Only serve shells created in namespaces matching the namespace selector
+	var shells []cloudshellv1alpha1.CloudShell
+	for _, shell := range candidates {
+		allowed, err := namespaceAllowed(r.apiReader, shell.Namespace)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if allowed {
+			shells = append(shells, shell)
+		}
+	}
+
+	if len(shells) == 0 {
+		return reconcile.Result{}, r.deletePrereqs(namespace)
+	}
+
+	var owners []string
+	if config.ControllerCfg.GetNamespaceMode() == config.NamespaceModePerUser {
+		for _, shell := range shells {
+			owners = append(owners, getOwner(&shell))
+		}
+	}
+	role, bindings := getSpecPrereqs(namespace, owners)
+	reqLogger.Info("Reconciling CloudShell prerequisites")
+	if err := r.reconcileRole(role); err != nil {
+		return reconcile.Result{}, r.reportError(shells, err)
+	}
+	for _, binding := range bindings {
+		if err := r.reconcileRoleBinding(binding); err != nil {
+			return reconcile.Result{}, r.reportError(shells, err)
+		}
+	}
+	if config.ControllerCfg.HasLocalNamespaceQuota() {
+		for _, obj := range getSpecQuotaObjects(namespace) {
+			ok, err := reconcileNamespaceObject(r.client, obj)
+			if err != nil {
+				return reconcile.Result{}, r.reportError(shells, err)
+			}
+			if !ok {
+				return reconcile.Result{Requeue: true}, nil
+			}
+		}
+	}
+	return reconcile.Result{}, nil
+}
+
+// reportError records a warning event on the shells in a namespace when its prerequisites cannot be reconciled, such
+// as when an object of the same name was created by someone else, and returns err so that it is retried
+func (r *ReconcilePrerequisites) reportError(shells []cloudshellv1alpha1.CloudShell, err error) error {
+	for i := range shells {
+		r.recorder.Eventf(&shells[i], corev1.EventTypeWarning, "PrerequisitesFailed", "Failed to reconcile prerequisites: %s", err)
+	}
+	return err
+}
+
+// getSpecPrereqs returns the RBAC objects required in a namespace. If owners is non-empty, the listed users are
+// additionally allowed to exec into pods in the namespace, as required by the proxy for per-user namespaces.
+func getSpecPrereqs(namespace string, owners []string) (*rbacv1.Role, []*rbacv1.RoleBinding) {
+	labels := map[string]string{managedByLabel: managedByValue}
 	role := &rbacv1.Role{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "cloudshell-exec",
-			Namespace: ctx.instance.Namespace,
+			Namespace: namespace,
+			Labels:    labels,
 		},
 		Rules: []rbacv1.PolicyRule{
 			{
@@ -22,53 +212,185 @@ func (r *ReconcileCloudShell) reconcilePrereqs(ctx reconcileContext) deployStatu
 			},
 		},
 	}
-	controllerutil.SetControllerReference(ctx.instance, role, r.scheme)
-	err := r.client.Create(context.TODO(), role)
-	if err != nil && !errors.IsAlreadyExists(err) {
-		return deployStatus{Error: err}
-	}
 
 	bindings := []*rbacv1.RoleBinding{
 		{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "cloudshell-view",
-				Namespace: ctx.instance.Namespace,
+				Namespace: namespace,
+				Labels:    labels,
 			},
 			RoleRef: rbacv1.RoleRef{
-				Kind: "ClusterRole",
-				Name: "view",
+				APIGroup: rbacv1.GroupName,
+				Kind:     "ClusterRole",
+				Name:     "view",
 			},
 			Subjects: []rbacv1.Subject{
 				{
-					Kind: "Group",
-					Name: "system:serviceaccounts:" + ctx.instance.Namespace,
+					APIGroup: rbacv1.GroupName,
+					Kind:     "Group",
+					Name:     "system:serviceaccounts:" + namespace,
 				},
 			},
 		},
 		{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "cloudshell-exec",
-				Namespace: ctx.instance.Namespace,
+				Namespace: namespace,
+				Labels:    labels,
 			},
 			RoleRef: rbacv1.RoleRef{
-				Kind: "Role",
-				Name: "cloudshell-exec",
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     "cloudshell-exec",
 			},
 			Subjects: []rbacv1.Subject{
 				{
-					Kind: "Group",
-					Name: "system:serviceaccounts:" + ctx.instance.Namespace,
+					APIGroup: rbacv1.GroupName,
+					Kind:     "Group",
+					Name:     "system:serviceaccounts:" + namespace,
 				},
 			},
 		},
 	}
-	for _, binding := range bindings {
-		controllerutil.SetControllerReference(ctx.instance, binding, r.scheme)
-		err := r.client.Create(context.TODO(), binding)
-		if err != nil && !errors.IsAlreadyExists(err) {
-			return deployStatus{Error: err}
+	if len(owners) > 0 {
+		var subjects []rbacv1.Subject
+		seen := map[string]bool{}
+		for _, owner := range owners {
+			if seen[owner] {
+				continue
+			}
+			seen[owner] = true
+			subjects = append(subjects, rbacv1.Subject{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "User",
+				Name:     owner,
+			})
 		}
+		bindings = append(bindings, &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cloudshell-owner-exec",
+				Namespace: namespace,
+				Labels:    labels,
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     "cloudshell-exec",
+			},
+			Subjects: subjects,
+		})
 	}
+	return role, bindings
+}
 
-	return deployStatus{Continue: true}
+func (r *ReconcilePrerequisites) reconcileRole(spec *rbacv1.Role) error {
+	cluster := &rbacv1.Role{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: spec.Name, Namespace: spec.Namespace}, cluster)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			err = r.client.Create(context.TODO(), spec)
+			if errors.IsAlreadyExists(err) {
+				return nil
+			}
+		}
+		return err
+	}
+	if err := checkManaged(cluster); err != nil {
+		return err
+	}
+	if !cmp.Equal(spec, cluster, roleDiffOpts) || !isManagedPrereq(cluster) {
+		cluster.Rules = spec.Rules
+		cluster.Labels = mergeLabels(cluster.Labels, spec.Labels)
+		cluster.OwnerReferences = nil
+		return r.client.Update(context.TODO(), cluster)
+	}
+	return nil
+}
+
+func (r *ReconcilePrerequisites) reconcileRoleBinding(spec *rbacv1.RoleBinding) error {
+	cluster := &rbacv1.RoleBinding{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: spec.Name, Namespace: spec.Namespace}, cluster)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			err = r.client.Create(context.TODO(), spec)
+			if errors.IsAlreadyExists(err) {
+				return nil
+			}
+		}
+		return err
+	}
+	if err := checkManaged(cluster); err != nil {
+		return err
+	}
+	if cluster.RoleRef != spec.RoleRef {
+		// RoleRef is immutable; recreate the binding
+		err = r.client.Delete(context.TODO(), cluster)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return r.client.Create(context.TODO(), spec)
+	}
+	if !cmp.Equal(spec, cluster, roleBindingDiffOpts) || !isManagedPrereq(cluster) {
+		cluster.Subjects = spec.Subjects
+		cluster.Labels = mergeLabels(cluster.Labels, spec.Labels)
+		cluster.OwnerReferences = nil
+		return r.client.Update(context.TODO(), cluster)
+	}
+	return nil
+}
+
+// deletePrereqs removes prerequisites created by the operator in a namespace that no longer contains CloudShells.
+// Quotas are only removed in local mode, as per-user namespaces are deleted with their last shell.
+func (r *ReconcilePrerequisites) deletePrereqs(namespace string) error {
+	managed := client.MatchingLabels{managedByLabel: managedByValue}
+	roles := &rbacv1.RoleList{}
+	if err := r.client.List(context.TODO(), roles, client.InNamespace(namespace), managed); err != nil {
+		return err
+	}
+	bindings := &rbacv1.RoleBindingList{}
+	if err := r.client.List(context.TODO(), bindings, client.InNamespace(namespace), managed); err != nil {
+		return err
+	}
+	var objs []runtime.Object
+	for i := range roles.Items {
+		objs = append(objs, &roles.Items[i])
+	}
+	for i := range bindings.Items {
+		objs = append(objs, &bindings.Items[i])
+	}
+	if config.ControllerCfg.HasLocalNamespaceQuota() {
+		quotas := &corev1.ResourceQuotaList{}
+		if err := r.client.List(context.TODO(), quotas, client.InNamespace(namespace), managed); err != nil {
+			return err
+		}
+		limitRanges := &corev1.LimitRangeList{}
+		if err := r.client.List(context.TODO(), limitRanges, client.InNamespace(namespace), managed); err != nil {
+			return err
+		}
+		for i := range quotas.Items {
+			objs = append(objs, &quotas.Items[i])
+		}
+		for i := range limitRanges.Items {
+			objs = append(objs, &limitRanges.Items[i])
+		}
+	}
+	for _, obj := range objs {
+		err := r.client.Delete(context.TODO(), obj)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeLabels(existing, required map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range required {
+		merged[k] = v
+	}
+	return merged
 }
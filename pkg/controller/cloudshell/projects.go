@@ -0,0 +1,191 @@
+package cloudshell
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	projectCloneContainerName = "project-clone"
+	// gitCredentialsMountDir is where credentials Secrets for projects are mounted in the clone container
+	gitCredentialsMountDir = "/var/run/cloudshell/git-credentials"
+)
+
+// cloneFunction is the shell function used by the clone container to clone a single project. Clones that fail are
+// removed so that they are retried when the pod restarts, and a summary of the failure is appended to the
+// termination log, which is reported in the ProjectsCloned condition. The container always succeeds so that a
+// failed clone does not prevent the shell from starting.
+const cloneFunction = `clone() {
+  name="$1" dest="$2" url="$3" ref="$4" creds="$5"
+  if [ -e "$dest" ]; then
+    echo "$name: $dest already exists, skipping"
+    return 0
+  fi
+  unset GIT_SSH_COMMAND
+  helper=""
+  if [ -f "$creds/ssh-privatekey" ]; then
+    key=$(mktemp)
+    cp "$creds/ssh-privatekey" "$key"
+    chmod 600 "$key"
+    if [ -f "$creds/known_hosts" ]; then
+      export GIT_SSH_COMMAND="ssh -i $key -o IdentitiesOnly=yes -o UserKnownHostsFile=$creds/known_hosts"
+    else
+      export GIT_SSH_COMMAND="ssh -i $key -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new"
+    fi
+  elif [ -f "$creds/password" ]; then
+    helper=$(mktemp)
+    cat > "$helper" <<EOF
+#!/bin/sh
+[ "\$1" = get ] || exit 0
+echo "username=\$(cat '$creds/username' 2>/dev/null || echo git)"
+echo "password=\$(cat '$creds/password')"
+EOF
+    chmod 700 "$helper"
+  fi
+  log=$(mktemp)
+  echo "$name: cloning $url into $dest"
+  if git -c credential.helper="$helper" clone "$url" "$dest" >"$log" 2>&1 &&
+    { [ -z "$ref" ] || git -C "$dest" checkout -q "$ref" >>"$log" 2>&1; }; then
+    return 0
+  fi
+  cat "$log" >&2
+  rm -rf "$dest"
+  echo "$name: failed to clone $url: $(tail -n 1 "$log")" >> /dev/termination-log
+}
+`
+
+// getProjectsDir returns the directory projects are cloned into
+func getProjectsDir() string {
+	return path.Join(homeDir, "projects")
+}
+
+// getProjectPath returns the absolute path a project is cloned to
+func getProjectPath(project v1alpha1.Project) string {
+	if project.Path == "" {
+		return path.Join(getProjectsDir(), project.Name)
+	}
+	return path.Join(getProjectsDir(), project.Path)
+}
+
+func getGitCredentialsVolumeName(index int) string {
+	return fmt.Sprintf("git-credentials-%d", index)
+}
+
+// validateProjects checks that project names and paths are unique and that paths stay within the projects directory
+func validateProjects(instance *v1alpha1.CloudShell) error {
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	for _, project := range instance.Spec.Projects {
+		if project.Name == "" {
+			return fmt.Errorf("projects must have a name")
+		}
+		if names[project.Name] {
+			return fmt.Errorf("project name %s is duplicated", project.Name)
+		}
+		names[project.Name] = true
+		if project.Git.URL == "" {
+			return fmt.Errorf("project %s must have a git url", project.Name)
+		}
+		relPath := project.Path
+		if relPath == "" {
+			relPath = project.Name
+		}
+		if path.IsAbs(relPath) || path.Clean(relPath) != relPath || relPath == "." || strings.HasPrefix(relPath, "..") {
+			return fmt.Errorf("project %s: path %s must be a relative path within the projects directory", project.Name, relPath)
+		}
+		if paths[relPath] {
+			return fmt.Errorf("project %s: path %s is duplicated", project.Name, relPath)
+		}
+		paths[relPath] = true
+	}
+	return nil
+}
+
+// getCloneScript returns the script run by the clone container for the given projects
+func getCloneScript(projects []v1alpha1.Project) string {
+	var script strings.Builder
+	script.WriteString(cloneFunction)
+	for idx, project := range projects {
+		creds := ""
+		if project.Git.CredentialsSecret != "" {
+			creds = path.Join(gitCredentialsMountDir, getGitCredentialsVolumeName(idx))
+		}
+		args := []string{project.Name, getProjectPath(project), project.Git.URL, project.Git.Ref, creds}
+		for i := range args {
+			args[i] = shellQuote(args[i])
+		}
+		script.WriteString("clone " + strings.Join(args, " ") + "\n")
+	}
+	return script.String()
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// applyProjects adds the init container that clones a CloudShell's projects, and mounts the credentials Secrets it
+// uses. When there are projects, the shell starts in the projects directory.
+func applyProjects(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	projects := instance.Spec.Projects
+	if len(projects) == 0 {
+		return
+	}
+	var secretMode int32 = 420
+	container := corev1.Container{
+		Name:                     projectCloneContainerName,
+		Image:                    config.ControllerCfg.GetGitImage(),
+		ImagePullPolicy:          corev1.PullIfNotPresent,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		Command:                  []string{"/bin/sh", "-c", getCloneScript(projects)},
+		Env: []corev1.EnvVar{
+			{
+				// Used by ssh for known_hosts; credentials must not be written to the shell's home
+				Name:  "HOME",
+				Value: "/tmp",
+			},
+			{
+				Name:  "GIT_TERMINAL_PROMPT",
+				Value: "0",
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      homeVolumeName,
+				MountPath: homeDir,
+			},
+		},
+	}
+	for idx, project := range projects {
+		if project.Git.CredentialsSecret == "" {
+			continue
+		}
+		volumeName := getGitCredentialsVolumeName(idx)
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  project.Git.CredentialsSecret,
+					DefaultMode: &secretMode,
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: path.Join(gitCredentialsMountDir, volumeName),
+			ReadOnly:  true,
+		})
+	}
+	podSpec.InitContainers = append(podSpec.InitContainers, container)
+
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == shellHostContainerName {
+			podSpec.Containers[i].WorkingDir = getProjectsDir()
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// quotaRetryInterval is how often a shell waiting for a quota checks whether it may start
+const quotaRetryInterval = 30 * time.Second
+
+// quotaLock serializes quota decisions in the operator, so that shells admitted concurrently by the controller, pool
+// claims and the quota webhook cannot together exceed a quota
+var quotaLock sync.Mutex
+
+// shellQuota is a limit on the number of running shells that share a scope, such as an owner
+type shellQuota struct {
+	limit int
+	scope string
+	// matches returns whether a shell is in the quota's scope
+	matches func(shell *v1alpha1.CloudShell) bool
+}
+
+// quotasEnabled returns whether the operator limits the number of running shells
+func quotasEnabled() bool {
+	return config.ControllerCfg.GetShellQuotas() != config.ShellQuotas{}
+}
+
+// getShellQuotas returns the quotas that apply to a shell. The owner of a shell is set by the owner webhook to the
+// user who created it; shells without one must be rejected by checkShellQuotas when there is a per-user quota.
+func getShellQuotas(instance *v1alpha1.CloudShell) []shellQuota {
+	limits := config.ControllerCfg.GetShellQuotas()
+	var quotas []shellQuota
+	if owner := getOwner(instance); owner != "" && limits.PerUser > 0 {
+		quotas = append(quotas, shellQuota{
+			limit:   limits.PerUser,
+			scope:   fmt.Sprintf("for user %s", owner),
+			matches: func(shell *v1alpha1.CloudShell) bool { return getOwner(shell) == owner },
+		})
+	}
+	if limits.PerNamespace > 0 {
+		quotas = append(quotas, shellQuota{
+			limit:   limits.PerNamespace,
+			scope:   fmt.Sprintf("in namespace %s", instance.Namespace),
+			matches: func(shell *v1alpha1.CloudShell) bool { return shell.Namespace == instance.Namespace },
+		})
+	}
+	if limits.Total > 0 {
+		quotas = append(quotas, shellQuota{
+			limit:   limits.Total,
+			scope:   "in the cluster",
+			matches: func(shell *v1alpha1.CloudShell) bool { return true },
+		})
+	}
+	return quotas
+}
+
+// isQueued returns whether a shell is kept stopped because a quota is reached
+func isQueued(instance *v1alpha1.CloudShell) bool {
+	condition := getCondition(&instance.Status, v1alpha1.QuotaExceeded)
+	return condition != nil && condition.Status == corev1.ConditionTrue
+}
+
+// holdsQuota returns whether a shell was admitted by the quotas and counts towards them
+func holdsQuota(instance *v1alpha1.CloudShell) bool {
+	condition := getCondition(&instance.Status, v1alpha1.QuotaExceeded)
+	return condition != nil && condition.Status == corev1.ConditionFalse &&
+		instance.DeletionTimestamp == nil && !isExpired(instance)
+}
+
+// createdBefore returns whether a was created before b, breaking ties by namespace and name
+func createdBefore(a, b *v1alpha1.CloudShell) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// checkShellQuotas returns a message describing the first quota that keeps a shell from running, or an empty
+// string if it may run. Shells that hold a quota count towards it, as do shells waiting for it that were created
+// earlier, so that waiting shells start in order of creation.
+func checkShellQuotas(instance *v1alpha1.CloudShell, shells []v1alpha1.CloudShell) string {
+	if config.ControllerCfg.GetShellQuotas().PerUser > 0 && getOwner(instance) == "" && !isPooled(instance) {
+		// Pooled shells have no owner until they are claimed, and are checked against their claimant's quota then
+		return "The shell has no owner, so the quota on running shells per user cannot be checked"
+	}
+	for _, quota := range getShellQuotas(instance) {
+		count := 0
+		for i := range shells {
+			shell := &shells[i]
+			if shell.UID == instance.UID || !quota.matches(shell) || shell.DeletionTimestamp != nil {
+				continue
+			}
+			if holdsQuota(shell) || (isQueued(shell) && createdBefore(shell, instance)) {
+				count++
+			}
+		}
+		if count >= quota.limit {
+			return fmt.Sprintf("The limit of %d running shells %s is reached", quota.limit, quota.scope)
+		}
+	}
+	return ""
+}
+
+// listShellsForQuotas lists the CloudShells that may count towards a shell's quotas. c must read from the API server
+// rather than the cache, which may not include shells just admitted.
+func listShellsForQuotas(c client.Reader) ([]v1alpha1.CloudShell, error) {
+	shells := &v1alpha1.CloudShellList{}
+	if err := c.List(context.TODO(), shells); err != nil {
+		return nil, err
+	}
+	return shells.Items, nil
+}
+
+// reconcileQuota admits a shell if the quotas on running shells allow it, and otherwise keeps it stopped with the
+// QuotaExceeded condition until they do. Admitted shells keep counting towards the quotas until they are deleted or
+// expire, even if the quotas are lowered. Shells that are already running when quotas are enabled are admitted
+// without a check, so that enabling quotas does not stop running shells; only later starts are limited.
+func (r *ReconcileCloudShell) reconcileQuota(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if !quotasEnabled() || isExpired(instance) {
+		// Expired shells release their quota, and are checked again if their lifetime is extended
+		return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.QuotaExceeded))
+	}
+	if holdsQuota(instance) {
+		return deployStatus{Continue: true}
+	}
+	if getCondition(&instance.Status, v1alpha1.QuotaExceeded) == nil && instance.Status.StartedAt != nil {
+		ctx.log.Info("Admitting running shell to quotas")
+		return r.updateStatusIf(ctx, setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+			Type:    v1alpha1.QuotaExceeded,
+			Status:  corev1.ConditionFalse,
+			Reason:  "AdmittedRunning",
+			Message: "The shell was running when quotas on running shells were enabled",
+		}))
+	}
+	// The lock is held until the shell's admission is recorded in its status
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	shells, err := listShellsForQuotas(r.apiReader)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	if message := checkShellQuotas(instance, shells); message != "" {
+		modified := setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+			Type:    v1alpha1.QuotaExceeded,
+			Status:  corev1.ConditionTrue,
+			Reason:  "QuotaExceeded",
+			Message: message,
+		})
+		if modified {
+			ctx.log.Info("Shell quota exceeded", "message", message)
+			r.recorder.Event(instance, corev1.EventTypeWarning, "QuotaExceeded", message)
+		}
+		return r.updateStatusIf(ctx, modified)
+	}
+	ctx.log.Info("Shell admitted by quotas")
+	return r.updateStatusIf(ctx, setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.QuotaExceeded,
+		Status:  corev1.ConditionFalse,
+		Reason:  "Admitted",
+		Message: "The shell is within the quotas on running shells",
+	}))
+}
+
+// getQuotaRequeue returns how long until a shell waiting for a quota checks it again, or zero if it is not waiting
+func getQuotaRequeue(instance *v1alpha1.CloudShell) time.Duration {
+	if isQueued(instance) {
+		return quotaRetryInterval
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package cloudshell
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// quotaWebhookPath is the path the quota webhook is served on; see deploy/webhook.yaml
+	quotaWebhookPath = "/validate-cloudshell-quota"
+	// quotaPendingTTL is how long a CloudShell allowed by the quota webhook counts towards the quotas before it is
+	// listed from the API server
+	quotaPendingTTL = 30 * time.Second
+)
+
+// addQuotaWebhook serves the webhook that rejects CloudShells created over a quota, if the operator is configured to
+// reject them
+func addQuotaWebhook(mgr manager.Manager, server *webhook.Server) {
+	if !quotasEnabled() || config.ControllerCfg.GetQuotaAdmission() != config.QuotaAdmissionReject {
+		return
+	}
+	server.Register(quotaWebhookPath, &webhook.Admission{Handler: &quotaValidator{reader: mgr.GetAPIReader()}})
+}
+
+// quotaValidator rejects CloudShells that would exceed a quota on running shells when created. Shells waiting for a
+// quota count towards it, so that CloudShells are not created while others wait. The owner quota applies to the user
+// making the request, as authenticated by the API server.
+type quotaValidator struct {
+	reader  client.Reader
+	decoder *admission.Decoder
+	// pending holds the CloudShells allowed recently, which may not be listed yet, so that concurrent requests count
+	// each other
+	pending []v1alpha1.CloudShell
+}
+
+var _ admission.DecoderInjector = &quotaValidator{}
+
+func (v *quotaValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+func (v *quotaValidator) Handle(_ context.Context, req admission.Request) admission.Response {
+	if req.Operation != v1beta1.Create || isOperator(req.UserInfo) {
+		return admission.Allowed("")
+	}
+	if req.UserInfo.Username == "" {
+		return admission.Denied("CloudShells can only be created by authenticated users")
+	}
+	instance := &v1alpha1.CloudShell{}
+	if err := v.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[ownerAnnotation] = req.UserInfo.Username
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	shells, err := listShellsForQuotas(v.reader)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	now := metav1.Now()
+	shells = v.addPending(shells, now)
+	// The new shell is created after every shell waiting for the quota
+	instance.CreationTimestamp = now
+	if message := checkShellQuotas(instance, shells); message != "" {
+		return admission.Denied(message)
+	}
+	// Until it is admitted by the controller, the new shell counts as waiting for the quotas
+	setCondition(&instance.Status, v1alpha1.CloudShellCondition{
+		Type:   v1alpha1.QuotaExceeded,
+		Status: corev1.ConditionTrue,
+		Reason: "Pending",
+	})
+	v.pending = append(v.pending, *instance)
+	return admission.Allowed("")
+}
+
+// addPending drops expired and listed CloudShells from the pending ones, and returns shells with the others added
+func (v *quotaValidator) addPending(shells []v1alpha1.CloudShell, now metav1.Time) []v1alpha1.CloudShell {
+	listed := map[string]bool{}
+	for _, shell := range shells {
+		listed[shell.Namespace+"/"+shell.Name] = true
+	}
+	var pending []v1alpha1.CloudShell
+	for _, shell := range v.pending {
+		if now.Sub(shell.CreationTimestamp.Time) < quotaPendingTTL && !listed[shell.Namespace+"/"+shell.Name] {
+			pending = append(pending, shell)
+		}
+	}
+	v.pending = pending
+	return append(shells, pending...)
+}
@@ -8,8 +8,6 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 const proxyServiceAcctAnnotationKeyFmt string = "serviceaccounts.openshift.io/oauth-redirectreference.%s"
@@ -31,10 +29,18 @@ func (r *ReconcileCloudShell) reconcileServiceAcct(ctx reconcileContext) deployS
 	}
 	redirectAnnotation := fmt.Sprintf(proxyServiceAcctAnnotationKeyFmt, ctx.instance.Status.Id)
 	val, ok := cluster.Annotations[redirectAnnotation]
-	if !ok || val != spec.Annotations[redirectAnnotation] {
+	automount := cluster.AutomountServiceAccountToken
+	if !ok || val != spec.Annotations[redirectAnnotation] || automount == nil || *automount {
 		ctx.log.Info("Updating service account")
-		patch := client.MergeFrom(spec)
-		err = r.client.Patch(context.TODO(), cluster, patch)
+		if cluster.Annotations == nil {
+			cluster.Annotations = map[string]string{}
+		}
+		cluster.Annotations[redirectAnnotation] = spec.Annotations[redirectAnnotation]
+		cluster.AutomountServiceAccountToken = spec.AutomountServiceAccountToken
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			return deployStatus{Requeue: true}
+		}
 		return deployStatus{Requeue: true, Error: err}
 	}
 
@@ -44,7 +50,8 @@ func (r *ReconcileCloudShell) reconcileServiceAcct(ctx reconcileContext) deployS
 }
 
 func (r *ReconcileCloudShell) getSpecSA(instance *v1alpha1.CloudShell) (*corev1.ServiceAccount, error) {
-	autoMountServiceAccount := true
+	// Shell pods mount a short-lived projected token instead; see applyAPIToken
+	autoMountServiceAccount := false
 	annotations := map[string]string{
 		fmt.Sprintf(proxyServiceAcctAnnotationKeyFmt, instance.Status.Id): fmt.Sprintf(proxyServiceAcctAnnotationValueFmt, getRouteName(instance)),
 	}
@@ -52,13 +59,13 @@ func (r *ReconcileCloudShell) getSpecSA(instance *v1alpha1.CloudShell) (*corev1.
 	sa := &corev1.ServiceAccount{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        getServiceAccountName(instance),
-			Namespace:   instance.Namespace,
+			Namespace:   getShellNamespace(instance),
 			Annotations: annotations,
 		},
 		AutomountServiceAccountToken: &autoMountServiceAccount,
 	}
 
-	err := controllerutil.SetControllerReference(instance, sa, r.scheme)
+	err := r.setOwner(instance, sa)
 	if err != nil {
 		return nil, err
 	}
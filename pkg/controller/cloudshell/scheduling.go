@@ -0,0 +1,97 @@
+package cloudshell
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// validateScheduling checks that a CloudShell's scheduling settings do not override the operator defaults and only
+// request priority classes, runtime classes and tolerations allowed by the operator configuration. This keeps users
+// from escaping a sandboxing runtime class or placing shells on node pools reserved for other workloads.
+func validateScheduling(instance *v1alpha1.CloudShell) error {
+	spec := instance.Spec.Scheduling
+	if spec == nil {
+		return nil
+	}
+	defaults := config.ControllerCfg.GetDefaultScheduling()
+	allowed := config.ControllerCfg.GetAllowedScheduling()
+	for key, value := range spec.NodeSelector {
+		if defaultValue, ok := defaults.NodeSelector[key]; ok && defaultValue != value {
+			return fmt.Errorf("node selector %s is set by the operator and cannot be changed", key)
+		}
+	}
+	if spec.Affinity != nil && defaults.Affinity != nil {
+		return fmt.Errorf("affinity is set by the operator and cannot be changed")
+	}
+	if name := spec.PriorityClassName; name != "" && name != defaults.PriorityClassName &&
+		!containsString(allowed.PriorityClassNames, name) {
+		return fmt.Errorf("priority class %s is not allowed", name)
+	}
+	if spec.RuntimeClassName != nil {
+		name := *spec.RuntimeClassName
+		if (defaults.RuntimeClassName == nil || name != *defaults.RuntimeClassName) &&
+			!containsString(allowed.RuntimeClassNames, name) {
+			return fmt.Errorf("runtime class %s is not allowed", name)
+		}
+	}
+	for _, toleration := range spec.Tolerations {
+		if !containsToleration(allowed.Tolerations, toleration) {
+			return fmt.Errorf("toleration for taint %s is not allowed", toleration.Key)
+		}
+	}
+	return nil
+}
+
+// getScheduling merges the CloudShell's scheduling settings with the operator defaults, which take precedence. Node
+// selectors are merged and tolerations are combined; the CloudShell's affinity, priority class and runtime class are
+// only used where the operator sets none. Settings must have been checked with validateScheduling.
+func getScheduling(instance *v1alpha1.CloudShell) v1alpha1.SchedulingSpec {
+	scheduling := config.ControllerCfg.GetDefaultScheduling()
+	spec := instance.Spec.Scheduling
+	if spec == nil {
+		return scheduling
+	}
+	if len(spec.NodeSelector) > 0 {
+		if scheduling.NodeSelector == nil {
+			scheduling.NodeSelector = map[string]string{}
+		}
+		for key, value := range spec.NodeSelector {
+			if _, ok := scheduling.NodeSelector[key]; !ok {
+				scheduling.NodeSelector[key] = value
+			}
+		}
+	}
+	scheduling.Tolerations = append(scheduling.Tolerations, spec.Tolerations...)
+	if scheduling.Affinity == nil && spec.Affinity != nil {
+		scheduling.Affinity = spec.Affinity.DeepCopy()
+	}
+	if spec.PriorityClassName != "" {
+		scheduling.PriorityClassName = spec.PriorityClassName
+	}
+	if spec.RuntimeClassName != nil {
+		runtimeClassName := *spec.RuntimeClassName
+		scheduling.RuntimeClassName = &runtimeClassName
+	}
+	return scheduling
+}
+
+func applyScheduling(podSpec *corev1.PodSpec, scheduling v1alpha1.SchedulingSpec) {
+	podSpec.NodeSelector = scheduling.NodeSelector
+	podSpec.Tolerations = scheduling.Tolerations
+	podSpec.Affinity = scheduling.Affinity
+	podSpec.PriorityClassName = scheduling.PriorityClassName
+	podSpec.RuntimeClassName = scheduling.RuntimeClassName
+}
+
+func containsToleration(tolerations []corev1.Toleration, toleration corev1.Toleration) bool {
+	for _, t := range tolerations {
+		if reflect.DeepEqual(t, toleration) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package cloudshell
+
+import (
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// seccompPodAnnotation sets the seccomp profile for all containers in a pod. The pinned Kubernetes version predates
+// the seccompProfile field in SecurityContext.
+const seccompPodAnnotation = "seccomp.security.alpha.kubernetes.io/pod"
+
+const tmpVolumeName = "cloudshell-tmp"
+
+// securityProfile holds the security settings applied to a shell pod
+type securityProfile struct {
+	pod *corev1.PodSecurityContext
+	// shell is applied to the shell-host container
+	shell *corev1.SecurityContext
+	// sidecar is applied to the operator-managed sidecar containers
+	sidecar        *corev1.SecurityContext
+	podAnnotations map[string]string
+	// sidecarTmp mounts a writable emptyDir at /tmp in sidecars, needed when their root filesystem is read-only
+	sidecarTmp bool
+}
+
+// getSecurityProfile returns the security settings for the configured profile. Security contexts are never nil, as
+// the API server defaults empty contexts and drift detection would otherwise always report a difference.
+func getSecurityProfile() securityProfile {
+	falseVal, trueVal := false, true
+	switch config.ControllerCfg.GetSecurityProfile() {
+	case config.SecurityProfileRestricted:
+		// Matches the Pod Security Standards "restricted" profile
+		container := func(readOnlyRootFS bool) *corev1.SecurityContext {
+			return &corev1.SecurityContext{
+				Privileged:               &falseVal,
+				AllowPrivilegeEscalation: &falseVal,
+				RunAsNonRoot:             &trueVal,
+				ReadOnlyRootFilesystem:   &readOnlyRootFS,
+				Capabilities: &corev1.Capabilities{
+					Drop: []corev1.Capability{"ALL"},
+				},
+			}
+		}
+		return securityProfile{
+			pod:            &corev1.PodSecurityContext{RunAsNonRoot: &trueVal},
+			shell:          container(false),
+			sidecar:        container(true),
+			podAnnotations: map[string]string{seccompPodAnnotation: "runtime/default"},
+			sidecarTmp:     true,
+		}
+	case config.SecurityProfileBaseline:
+		// Matches the Pod Security Standards "baseline" profile
+		container := func() *corev1.SecurityContext {
+			return &corev1.SecurityContext{
+				Privileged: &falseVal,
+			}
+		}
+		return securityProfile{
+			pod:     &corev1.PodSecurityContext{},
+			shell:   container(),
+			sidecar: container(),
+		}
+	default:
+		return securityProfile{
+			pod:     &corev1.PodSecurityContext{},
+			shell:   &corev1.SecurityContext{},
+			sidecar: &corev1.SecurityContext{},
+		}
+	}
+}
+
+// getSecurityContextDiffOpts returns options for comparing security contexts that ignore fields assigned by the
+// cluster (e.g. OpenShift SecurityContextConstraints assign user IDs, SELinux labels, and dropped capabilities).
+func getSecurityContextDiffOpts() cmp.Options {
+	opts := cmp.Options{
+		cmpopts.IgnoreFields(corev1.PodSecurityContext{}, "RunAsUser", "RunAsGroup", "SELinuxOptions", "FSGroup", "SupplementalGroups"),
+		cmpopts.IgnoreFields(corev1.SecurityContext{}, "RunAsUser", "RunAsGroup", "SELinuxOptions"),
+	}
+	if config.ControllerCfg.IsOpenShift() {
+		opts = append(opts, cmpopts.IgnoreFields(corev1.SecurityContext{}, "Capabilities"))
+	}
+	return opts
+}
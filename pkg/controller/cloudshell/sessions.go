@@ -0,0 +1,128 @@
+package cloudshell
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/agent"
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	sessionsVolumeName = "cloudshell-sessions"
+	// sessionsDir holds the session scripts and tmux socket, shared by the shell container and the agent
+	sessionsDir        = "/var/run/cloudshell/sessions"
+	defaultMaxSessions = 5
+	defaultScrollback  = 10000
+)
+
+// validateSessions checks that session limits are valid
+func validateSessions(instance *v1alpha1.CloudShell) error {
+	sessions := instance.Spec.Sessions
+	if sessions == nil {
+		return nil
+	}
+	if sessions.MaxSessions < 0 || sessions.Scrollback < 0 {
+		return fmt.Errorf("maxSessions and scrollback must not be negative")
+	}
+	return nil
+}
+
+// getSessionsArgs returns the agent arguments enabling named sessions
+func getSessionsArgs(instance *v1alpha1.CloudShell) []string {
+	sessions := instance.Spec.Sessions
+	if sessions == nil {
+		return nil
+	}
+	maxSessions, scrollback := sessions.MaxSessions, sessions.Scrollback
+	if maxSessions == 0 {
+		maxSessions = defaultMaxSessions
+	}
+	if scrollback == 0 {
+		scrollback = defaultScrollback
+	}
+	return []string{
+		"--sessions-dir=" + sessionsDir,
+		fmt.Sprintf("--max-sessions=%d", maxSessions),
+		fmt.Sprintf("--scrollback=%d", scrollback),
+	}
+}
+
+// applySessions adds the directory the agent shares with the shell container for terminal sessions
+func applySessions(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	if instance.Spec.Sessions == nil {
+		return
+	}
+	mount := corev1.VolumeMount{
+		Name:      sessionsVolumeName,
+		MountPath: sessionsDir,
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: sessionsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		switch container.Name {
+		case agentContainerName:
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+		case shellHostContainerName:
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+			// Terminals are opened with "$CLOUDSHELL_SESSION <name>" to attach to a named session
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  "CLOUDSHELL_SESSION",
+				Value: path.Join(sessionsDir, "session"),
+			})
+		}
+	}
+}
+
+// reconcileSessionsStatus updates the list of active sessions in the CloudShell's status from its agent. Failing to
+// reach the agent is not an error, as the shell may be starting; the status is left unchanged until the next poll.
+func (r *ReconcileCloudShell) reconcileSessionsStatus(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if instance.Spec.Sessions == nil {
+		return r.updateStatusIf(ctx, clearSessions(&instance.Status))
+	}
+	pod, err := r.getRunningShellPod(instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	if pod == nil {
+		return deployStatus{Continue: true}
+	}
+	sessions, err := r.getAgentSessions(instance, pod)
+	if err != nil {
+		ctx.log.Info("Could not read sessions from agent", "error", err.Error())
+		return deployStatus{Continue: true}
+	}
+	if cmp.Equal(sessions, instance.Status.Sessions) {
+		return deployStatus{Continue: true}
+	}
+	instance.Status.Sessions = sessions
+	return r.updateStatusIf(ctx, true)
+}
+
+func clearSessions(status *v1alpha1.CloudShellStatus) bool {
+	if len(status.Sessions) == 0 {
+		return false
+	}
+	status.Sessions = nil
+	return true
+}
+
+// getAgentSessions reads the active sessions from the agent in a shell pod
+func (r *ReconcileCloudShell) getAgentSessions(instance *v1alpha1.CloudShell, pod *corev1.Pod) ([]v1alpha1.SessionStatus, error) {
+	var sessions []v1alpha1.SessionStatus
+	if err := r.getFromAgent(instance, pod, agent.SessionsPath, &sessions); err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+	return sessions, nil
+}
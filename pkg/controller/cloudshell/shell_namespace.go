@@ -0,0 +1,279 @@
+package cloudshell
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ownerAnnotation = v1alpha1.OwnerAnnotation
+	// namespaceOwnerLabel is set on per-user namespaces to the sanitized name of the user they belong to
+	namespaceOwnerLabel = "cloudshell.eclipse.org/owner"
+
+	namespaceQuotaName         = "cloudshell-quota"
+	namespaceLimitRangeName    = "cloudshell-limits"
+	namespaceNetworkPolicyName = "cloudshell-default"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+var resourceQuotaDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(corev1.ResourceQuota{}, "TypeMeta", "ObjectMeta", "Status"),
+	cmp.Comparer(func(a, b resource.Quantity) bool { return a.Cmp(b) == 0 }),
+}
+
+var limitRangeDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(corev1.LimitRange{}, "TypeMeta", "ObjectMeta"),
+	cmp.Comparer(func(a, b resource.Quantity) bool { return a.Cmp(b) == 0 }),
+}
+
+var networkPolicyDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(networkingv1.NetworkPolicy{}, "TypeMeta", "ObjectMeta"),
+	cmpopts.EquateEmpty(),
+}
+
+// getOwner returns the user a CloudShell belongs to, or an empty string if unknown. The owner annotation is set by
+// the owner webhook to the user who created the CloudShell and cannot be changed by users.
+func getOwner(instance *v1alpha1.CloudShell) string {
+	return instance.Annotations[ownerAnnotation]
+}
+
+// getShellNamespace returns the namespace where resources for a CloudShell are created. In per-user mode, this is a
+// namespace derived from the owner's name; validateShellNamespace should be called first to ensure it can be
+// computed.
+func getShellNamespace(instance *v1alpha1.CloudShell) string {
+	if config.ControllerCfg.GetNamespaceMode() != config.NamespaceModePerUser {
+		return instance.Namespace
+	}
+	return fmt.Sprintf(config.ControllerCfg.GetNamespaceFormat(), sanitizeName(getOwner(instance)))
+}
+
+// validateShellNamespace checks that the shell namespace for a CloudShell can be computed and is a valid name
+func validateShellNamespace(instance *v1alpha1.CloudShell) error {
+	if config.ControllerCfg.GetNamespaceMode() != config.NamespaceModePerUser {
+		return nil
+	}
+	if sanitizeName(getOwner(instance)) == "" {
+		return fmt.Errorf("annotation %s must be set to provision a per-user namespace", ownerAnnotation)
+	}
+	if errs := validation.IsDNS1123Label(getShellNamespace(instance)); len(errs) > 0 {
+		return fmt.Errorf("invalid shell namespace %q: %s", getShellNamespace(instance), strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// sanitizeName converts a user name (which may contain e.g. '@' or ':') into a string usable as part of a DNS label
+// or label value. A hash of the full name is appended, so that names that only differ in characters that are replaced
+// or truncated (e.g. "Alice" and "alice") do not map to the same string.
+func sanitizeName(name string) string {
+	if name == "" {
+		return ""
+	}
+	sanitized := invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	sanitized = strings.Trim(sanitized, "-")
+	if len(sanitized) > 30 {
+		sanitized = strings.TrimRight(sanitized[:30], "-")
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:16]
+	if sanitized == "" {
+		return hash
+	}
+	return sanitized + "-" + hash
+}
+
+// reconcileShellNamespace provisions the per-user namespace for a CloudShell, along with its ResourceQuota,
+// LimitRange and default NetworkPolicy. Existing namespaces are reused if they were provisioned for the same owner.
+func (r *ReconcileCloudShell) reconcileShellNamespace(ctx reconcileContext) deployStatus {
+	if !needsCleanupFinalizer(ctx.instance) {
+		return deployStatus{Continue: true}
+	}
+	name := getShellNamespace(ctx.instance)
+	owner := sanitizeName(getOwner(ctx.instance))
+
+	namespace := &corev1.Namespace{}
+	err := r.apiReader.Get(context.TODO(), types.NamespacedName{Name: name}, namespace)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return deployStatus{Error: err}
+		}
+		ctx.log.Info("Creating shell namespace", "namespace", name)
+		namespace = &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					managedByLabel:      managedByValue,
+					namespaceOwnerLabel: owner,
+				},
+			},
+		}
+		err = r.client.Create(context.TODO(), namespace)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return deployStatus{Error: err}
+		}
+		return deployStatus{Requeue: true}
+	}
+	if namespace.Labels[managedByLabel] != managedByValue || namespace.Labels[namespaceOwnerLabel] != owner {
+		return deployStatus{Error: fmt.Errorf("namespace %s exists and was not provisioned for user %s", name, owner)}
+	}
+	if namespace.Status.Phase == corev1.NamespaceTerminating {
+		ctx.log.Info("Shell namespace is terminating", "namespace", name)
+		return deployStatus{Requeue: true}
+	}
+
+	for _, obj := range getSpecNamespaceObjects(name) {
+		ok, err := reconcileNamespaceObject(r.client, obj)
+		if err != nil || !ok {
+			return deployStatus{Requeue: true, Error: err}
+		}
+	}
+	return deployStatus{Continue: true}
+}
+
+func getSpecNamespaceObjects(namespace string) []runtime.Object {
+	labels := map[string]string{managedByLabel: managedByValue}
+	// Deny ingress from other namespaces, except from the router/ingress controller namespaces. Shell pods are not
+	// selected: policies are additive, so allowing traffic within the namespace would open every port of every
+	// shell to the other pods in it. Shell pods only accept the traffic allowed by their own NetworkPolicy.
+	routerPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: getRouterNamespaceSelector(),
+	}
+	networkPolicy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      namespaceNetworkPolicyName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: v1alpha1.IDLabel, Operator: metav1.LabelSelectorOpDoesNotExist},
+				},
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{}},
+						routerPeer,
+					},
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}
+	return append(getSpecQuotaObjects(namespace), networkPolicy)
+}
+
+// getSpecQuotaObjects returns the ResourceQuota and LimitRange created in per-user namespaces, and in namespaces served
+// in local mode if the operator is configured to
+func getSpecQuotaObjects(namespace string) []runtime.Object {
+	labels := map[string]string{managedByLabel: managedByValue}
+	limits, requests := config.ControllerCfg.GetNamespaceLimits()
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      namespaceQuotaName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: config.ControllerCfg.GetNamespaceQuota(),
+		},
+	}
+	limitRange := &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      namespaceLimitRangeName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{
+				{
+					Type:           corev1.LimitTypeContainer,
+					Default:        limits,
+					DefaultRequest: requests,
+				},
+			},
+		},
+	}
+	return []runtime.Object{quota, limitRange}
+}
+
+// getRouterNamespaceSelector converts the configured router namespace selector into a LabelSelector usable in
+// NetworkPolicies
+func getRouterNamespaceSelector() *metav1.LabelSelector {
+	selector, err := metav1.ParseToLabelSelector(config.ControllerCfg.GetRouterNamespaceSelector().String())
+	if err != nil {
+		// Selector was validated when config was loaded
+		return &metav1.LabelSelector{}
+	}
+	return selector
+}
+
+// reconcileNamespaceObject creates or updates a ResourceQuota, LimitRange or NetworkPolicy created by the operator in
+// a namespace. An object of the same name that the operator did not create is left alone and reported as an error.
+func reconcileNamespaceObject(c client.Client, spec runtime.Object) (ok bool, err error) {
+	specMeta, err := meta.Accessor(spec)
+	if err != nil {
+		return false, err
+	}
+	cluster := spec.DeepCopyObject()
+	err = c.Get(context.TODO(), types.NamespacedName{Name: specMeta.GetName(), Namespace: specMeta.GetNamespace()}, cluster)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			err = c.Create(context.TODO(), spec)
+			if errors.IsAlreadyExists(err) {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	if err := checkManaged(cluster); err != nil {
+		return false, err
+	}
+	switch o := cluster.(type) {
+	case *corev1.ResourceQuota:
+		s := spec.(*corev1.ResourceQuota)
+		if cmp.Equal(s, o, resourceQuotaDiffOpts) {
+			return true, nil
+		}
+		o.Spec = s.Spec
+	case *corev1.LimitRange:
+		s := spec.(*corev1.LimitRange)
+		if cmp.Equal(s, o, limitRangeDiffOpts) {
+			return true, nil
+		}
+		o.Spec = s.Spec
+	case *networkingv1.NetworkPolicy:
+		s := spec.(*networkingv1.NetworkPolicy)
+		if cmp.Equal(s, o, networkPolicyDiffOpts) {
+			return true, nil
+		}
+		o.Spec = s.Spec
+	default:
+		return false, fmt.Errorf("unexpected namespace object type %T", cluster)
+	}
+	err = c.Update(context.TODO(), cluster)
+	if errors.IsConflict(err) {
+		return false, nil
+	}
+	return false, err
+}
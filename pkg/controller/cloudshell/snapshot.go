@@ -0,0 +1,450 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// snapshotFinalizer is added to CloudShellSnapshots so that their VolumeSnapshot, which may live in another
+	// namespace, is deleted with them
+	snapshotFinalizer = "cloudshell.eclipse.org/volume-snapshot"
+
+	snapshotNameLabel      = "cloudshell.eclipse.org/snapshot-name"
+	snapshotNamespaceLabel = "cloudshell.eclipse.org/snapshot-namespace"
+
+	defaultSnapshotsToKeep = 3
+	// snapshotRetryInterval is how often a snapshot whose shell is not ready to be snapshotted is retried
+	snapshotRetryInterval = time.Minute
+)
+
+var volumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   "snapshot.storage.k8s.io",
+	Version: "v1beta1",
+	Kind:    "VolumeSnapshot",
+}
+
+var snapshotLog = log.WithName("snapshot")
+
+// AddSnapshot creates the CloudShellSnapshot controller and adds it to the Manager
+func AddSnapshot(mgr manager.Manager) error {
+	r := &ReconcileSnapshot{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+	c, err := controller.New("cloudshellsnapshot-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: &v1alpha1.CloudShellSnapshot{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+	if !config.ControllerCfg.HasVolumeSnapshots() {
+		return nil
+	}
+	// Update the snapshot's status as its VolumeSnapshot becomes ready
+	volumeSnapshot := &unstructured.Unstructured{}
+	volumeSnapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	return c.Watch(&source.Kind{Type: volumeSnapshot}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+			labels := obj.Meta.GetLabels()
+			name, namespace := labels[snapshotNameLabel], labels[snapshotNamespaceLabel]
+			if name == "" || namespace == "" {
+				return nil
+			}
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}}}
+		}),
+	})
+}
+
+var _ reconcile.Reconciler = &ReconcileSnapshot{}
+
+// ReconcileSnapshot takes a VolumeSnapshot of a CloudShell's home volume for each CloudShellSnapshot and reports its
+// readiness. VolumeSnapshots are created in the namespace the shell runs in, next to the claim they snapshot, and
+// are labelled with the CloudShellSnapshot's name and namespace.
+type ReconcileSnapshot struct {
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+func (r *ReconcileSnapshot) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := snapshotLog.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+
+	snapshot := &v1alpha1.CloudShellSnapshot{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, snapshot)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if snapshot.DeletionTimestamp != nil {
+		return r.finalize(snapshot, reqLogger)
+	}
+	status := snapshot.Status.DeepCopy()
+	if !config.ControllerCfg.HasVolumeSnapshots() {
+		status.Ready = false
+		status.Error = "VolumeSnapshot CRDs are not installed in the cluster"
+		return reconcile.Result{}, r.updateStatus(snapshot, status)
+	}
+
+	if status.VolumeSnapshot == "" {
+		shell := &v1alpha1.CloudShell{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: snapshot.Spec.Shell, Namespace: snapshot.Namespace}, shell)
+		if err != nil && !errors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+		if errors.IsNotFound(err) || shell.Status.Id == "" {
+			status.Error = fmt.Sprintf("CloudShell %s does not exist or has not started yet", snapshot.Spec.Shell)
+			return reconcile.Result{RequeueAfter: snapshotRetryInterval}, r.updateStatus(snapshot, status)
+		}
+		if config.ControllerCfg.GetHomeStorageSize() == nil {
+			status.Error = "Home directories are not persistent; set cloudshell.home.storage.size to snapshot them"
+			return reconcile.Result{}, r.updateStatus(snapshot, status)
+		}
+		if !containsString(snapshot.Finalizers, snapshotFinalizer) {
+			snapshot.Finalizers = append(snapshot.Finalizers, snapshotFinalizer)
+			err := r.client.Update(context.TODO(), snapshot)
+			return reconcile.Result{Requeue: true}, err
+		}
+		volumeSnapshot := getSpecVolumeSnapshot(snapshot, shell)
+		reqLogger.Info("Creating VolumeSnapshot", "namespace", volumeSnapshot.GetNamespace(), "name", volumeSnapshot.GetName())
+		err = r.client.Create(context.TODO(), volumeSnapshot)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return reconcile.Result{}, err
+		}
+		status.VolumeSnapshot = volumeSnapshot.GetName()
+		status.Namespace = volumeSnapshot.GetNamespace()
+		status.Owner = getOwner(shell)
+		status.Error = ""
+		return reconcile.Result{}, r.updateStatus(snapshot, status)
+	}
+
+	volumeSnapshot := &unstructured.Unstructured{}
+	volumeSnapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: status.VolumeSnapshot, Namespace: status.Namespace}, volumeSnapshot)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	if errors.IsNotFound(err) {
+		status.Ready = false
+		status.Error = fmt.Sprintf("VolumeSnapshot %s was deleted", status.VolumeSnapshot)
+		return reconcile.Result{}, r.updateStatus(snapshot, status)
+	}
+	if err := setVolumeSnapshotStatus(status, volumeSnapshot); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, r.updateStatus(snapshot, status)
+}
+
+// getSpecVolumeSnapshot returns the VolumeSnapshot of a shell's home claim taken for a CloudShellSnapshot. Its name
+// is derived from the CloudShellSnapshot's UID, so that it is stable if creating it is retried.
+func getSpecVolumeSnapshot(snapshot *v1alpha1.CloudShellSnapshot, shell *v1alpha1.CloudShell) *unstructured.Unstructured {
+	volumeSnapshot := &unstructured.Unstructured{}
+	volumeSnapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	volumeSnapshot.SetName(fmt.Sprintf("cloudshell-snapshot-%s", snapshot.UID))
+	volumeSnapshot.SetNamespace(getShellNamespace(shell))
+	volumeSnapshot.SetLabels(mergeLabels(getLabelsForID(shell.Status.Id), map[string]string{
+		snapshotNameLabel:      snapshot.Name,
+		snapshotNamespaceLabel: snapshot.Namespace,
+	}))
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": getHomeClaimName(shell),
+		},
+	}
+	if snapshot.Spec.VolumeSnapshotClassName != "" {
+		spec["volumeSnapshotClassName"] = snapshot.Spec.VolumeSnapshotClassName
+	}
+	volumeSnapshot.Object["spec"] = spec
+	return volumeSnapshot
+}
+
+// setVolumeSnapshotStatus copies the readiness, creation time, restore size and error of a VolumeSnapshot into a
+// CloudShellSnapshot's status
+func setVolumeSnapshotStatus(status *v1alpha1.CloudShellSnapshotStatus, volumeSnapshot *unstructured.Unstructured) error {
+	ready, _, err := unstructured.NestedBool(volumeSnapshot.Object, "status", "readyToUse")
+	if err != nil {
+		return err
+	}
+	status.Ready = ready
+	status.CreationTime = nil
+	if creationTime, _, _ := unstructured.NestedString(volumeSnapshot.Object, "status", "creationTime"); creationTime != "" {
+		parsed, err := time.Parse(time.RFC3339, creationTime)
+		if err != nil {
+			return err
+		}
+		status.CreationTime = &metav1.Time{Time: parsed}
+	}
+	status.RestoreSize = nil
+	if restoreSize, _, _ := unstructured.NestedString(volumeSnapshot.Object, "status", "restoreSize"); restoreSize != "" {
+		size, err := resource.ParseQuantity(restoreSize)
+		if err != nil {
+			return err
+		}
+		status.RestoreSize = &size
+	}
+	status.Error, _, _ = unstructured.NestedString(volumeSnapshot.Object, "status", "error", "message")
+	return nil
+}
+
+// updateStatus updates a CloudShellSnapshot's status if it differs from status
+func (r *ReconcileSnapshot) updateStatus(snapshot *v1alpha1.CloudShellSnapshot, status *v1alpha1.CloudShellSnapshotStatus) error {
+	if cmp.Equal(snapshot.Status, *status) {
+		return nil
+	}
+	snapshot.Status = *status
+	return r.client.Status().Update(context.TODO(), snapshot)
+}
+
+// finalize deletes a CloudShellSnapshot's VolumeSnapshot and removes the finalizer once it is gone
+func (r *ReconcileSnapshot) finalize(snapshot *v1alpha1.CloudShellSnapshot, reqLogger logr.Logger) (reconcile.Result, error) {
+	if !containsString(snapshot.Finalizers, snapshotFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	if snapshot.Status.VolumeSnapshot != "" && config.ControllerCfg.HasVolumeSnapshots() {
+		volumeSnapshot := &unstructured.Unstructured{}
+		volumeSnapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		volumeSnapshot.SetName(snapshot.Status.VolumeSnapshot)
+		volumeSnapshot.SetNamespace(snapshot.Status.Namespace)
+		reqLogger.Info("Deleting VolumeSnapshot", "namespace", snapshot.Status.Namespace, "name", snapshot.Status.VolumeSnapshot)
+		err := r.client.Delete(context.TODO(), volumeSnapshot)
+		if err != nil && !errors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+	}
+	snapshot.Finalizers = removeString(snapshot.Finalizers, snapshotFinalizer)
+	return reconcile.Result{}, r.client.Update(context.TODO(), snapshot)
+}
+
+// validateStorage checks that the snapshot features a CloudShell uses are available
+func validateStorage(instance *v1alpha1.CloudShell) error {
+	storage := instance.Spec.Storage
+	if storage == nil || (storage.FromSnapshot == "" && storage.SnapshotInterval == nil) {
+		return nil
+	}
+	if config.ControllerCfg.GetHomeStorageSize() == nil {
+		return fmt.Errorf("spec.storage requires persistent home directories; set cloudshell.home.storage.size")
+	}
+	if !config.ControllerCfg.HasVolumeSnapshots() {
+		return fmt.Errorf("spec.storage requires the VolumeSnapshot CRDs, which are not installed in the cluster")
+	}
+	return nil
+}
+
+// getRestoreSource returns the data source and minimum size of a home claim restored from the CloudShellSnapshot in
+// spec.storage.fromSnapshot. If the shell cannot be restored from the snapshot yet, the source is nil and message
+// explains why.
+func (r *ReconcileCloudShell) getRestoreSource(instance *v1alpha1.CloudShell) (source *corev1.TypedLocalObjectReference, size *resource.Quantity, message string, err error) {
+	snapshot := &v1alpha1.CloudShellSnapshot{}
+	name := instance.Spec.Storage.FromSnapshot
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: instance.Namespace}, snapshot)
+	if errors.IsNotFound(err) {
+		return nil, nil, fmt.Sprintf("CloudShellSnapshot %s does not exist", name), nil
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !snapshot.Status.Ready {
+		message = fmt.Sprintf("CloudShellSnapshot %s is not ready", name)
+		if snapshot.Status.Error != "" {
+			message = fmt.Sprintf("%s: %s", message, snapshot.Status.Error)
+		}
+		return nil, nil, message, nil
+	}
+	// Home directories are only restored into shells of the user whose shell was snapshotted, as shells of different
+	// users share a namespace in local mode
+	if snapshot.Status.Owner == "" || snapshot.Status.Owner != getOwner(instance) {
+		return nil, nil, fmt.Sprintf("CloudShellSnapshot %s was not taken of a shell owned by %s", name, getOwner(instance)), nil
+	}
+	// Claims can only be restored from VolumeSnapshots in their own namespace
+	if snapshot.Status.Namespace != getShellNamespace(instance) {
+		return nil, nil, fmt.Sprintf("CloudShellSnapshot %s was taken in namespace %s and cannot be restored in namespace %s",
+			name, snapshot.Status.Namespace, getShellNamespace(instance)), nil
+	}
+	group := volumeSnapshotGVK.Group
+	source = &corev1.TypedLocalObjectReference{
+		APIGroup: &group,
+		Kind:     volumeSnapshotGVK.Kind,
+		Name:     snapshot.Status.VolumeSnapshot,
+	}
+	return source, snapshot.Status.RestoreSize, "", nil
+}
+
+// getRequestsForSnapshot returns requests for the CloudShells waiting to be restored from a CloudShellSnapshot
+func getRequestsForSnapshot(c client.Client, namespace, name string) []reconcile.Request {
+	shells := &v1alpha1.CloudShellList{}
+	if err := c.List(context.TODO(), shells, client.InNamespace(namespace)); err != nil {
+		snapshotLog.Error(err, "Failed to list CloudShells for snapshot", "namespace", namespace, "name", name)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, shell := range shells.Items {
+		if shell.Spec.Storage != nil && shell.Spec.Storage.FromSnapshot == name {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: shell.Name, Namespace: shell.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
+// reconcileSnapshotSchedule takes a CloudShellSnapshot of the shell's home directory every spec.storage.snapshotInterval
+// and deletes the oldest scheduled snapshots beyond spec.storage.snapshotsToKeep, except those other shells are
+// restored from. Snapshots are labelled with the shell's name rather than owned by it, so that they outlive the shell.
+// The last snapshot taken is recorded in the status, as the cache may not list it yet when the shell is reconciled
+// again.
+func (r *ReconcileCloudShell) reconcileSnapshotSchedule(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	storage := instance.Spec.Storage
+	if storage == nil || storage.SnapshotInterval == nil || validateStorage(instance) != nil {
+		return deployStatus{Continue: true}
+	}
+	snapshots, err := r.getScheduledSnapshots(instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	modified := false
+	last := getLastScheduledSnapshotTime(instance, snapshots)
+	if last == nil || time.Since(last.Time) >= storage.SnapshotInterval.Duration {
+		snapshot := &v1alpha1.CloudShellSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: instance.Name + "-",
+				Namespace:    instance.Namespace,
+				Labels:       map[string]string{v1alpha1.ScheduledSnapshotLabel: instance.Name},
+			},
+			Spec: v1alpha1.CloudShellSnapshotSpec{
+				Shell: instance.Name,
+			},
+		}
+		ctx.log.Info("Taking scheduled snapshot of home directory")
+		if err := r.client.Create(context.TODO(), snapshot); err != nil {
+			return deployStatus{Error: err}
+		}
+		r.recorder.Eventf(instance, corev1.EventTypeNormal, "SnapshotCreated", "Created CloudShellSnapshot %s", snapshot.Name)
+		instance.Status.LastScheduledSnapshot = &v1alpha1.ScheduledSnapshotStatus{
+			Name:      snapshot.Name,
+			CreatedAt: snapshot.CreationTimestamp,
+		}
+		modified = true
+		snapshots = append([]v1alpha1.CloudShellSnapshot{*snapshot}, snapshots...)
+	}
+	keep := int(storage.SnapshotsToKeep)
+	if keep <= 0 {
+		keep = defaultSnapshotsToKeep
+	}
+	if len(snapshots) > keep {
+		restored, err := r.getRestoredSnapshots(instance.Namespace)
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		for i := keep; i < len(snapshots); i++ {
+			if restored[snapshots[i].Name] {
+				continue
+			}
+			ctx.log.Info("Deleting expired scheduled snapshot", "CloudShellSnapshot.Name", snapshots[i].Name)
+			if err := r.client.Delete(context.TODO(), &snapshots[i]); err != nil && !errors.IsNotFound(err) {
+				return deployStatus{Error: err}
+			}
+		}
+	}
+	return r.updateStatusIf(ctx, modified)
+}
+
+// getLastScheduledSnapshotTime returns the creation time of a shell's last scheduled CloudShellSnapshot, from its
+// status or from the listed snapshots, whichever is newer, or nil if none was taken
+func getLastScheduledSnapshotTime(instance *v1alpha1.CloudShell, snapshots []v1alpha1.CloudShellSnapshot) *metav1.Time {
+	var last *metav1.Time
+	if instance.Status.LastScheduledSnapshot != nil {
+		last = &instance.Status.LastScheduledSnapshot.CreatedAt
+	}
+	if len(snapshots) > 0 && (last == nil || last.Before(&snapshots[0].CreationTimestamp)) {
+		last = &snapshots[0].CreationTimestamp
+	}
+	return last
+}
+
+// getRestoredSnapshots returns the names of the CloudShellSnapshots that CloudShells in a namespace are restored from
+func (r *ReconcileCloudShell) getRestoredSnapshots(namespace string) (map[string]bool, error) {
+	shells := &v1alpha1.CloudShellList{}
+	if err := r.client.List(context.TODO(), shells, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	restored := map[string]bool{}
+	for _, shell := range shells.Items {
+		if shell.Spec.Storage != nil && shell.Spec.Storage.FromSnapshot != "" {
+			restored[shell.Spec.Storage.FromSnapshot] = true
+		}
+	}
+	return restored, nil
+}
+
+// getScheduledSnapshots returns the scheduled CloudShellSnapshots of a shell that are not being deleted, newest first
+func (r *ReconcileCloudShell) getScheduledSnapshots(instance *v1alpha1.CloudShell) ([]v1alpha1.CloudShellSnapshot, error) {
+	list := &v1alpha1.CloudShellSnapshotList{}
+	err := r.client.List(context.TODO(), list,
+		client.InNamespace(instance.Namespace),
+		client.MatchingLabels{v1alpha1.ScheduledSnapshotLabel: instance.Name})
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []v1alpha1.CloudShellSnapshot
+	for _, snapshot := range list.Items {
+		if snapshot.DeletionTimestamp == nil {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[j].CreationTimestamp.Before(&snapshots[i].CreationTimestamp)
+	})
+	return snapshots, nil
+}
+
+// getSnapshotRequeue returns the time until a shell's next scheduled snapshot is due, or zero if it has no schedule
+func (r *ReconcileCloudShell) getSnapshotRequeue(instance *v1alpha1.CloudShell, now time.Time) time.Duration {
+	storage := instance.Spec.Storage
+	if storage == nil || storage.SnapshotInterval == nil || validateStorage(instance) != nil {
+		return 0
+	}
+	snapshots, err := r.getScheduledSnapshots(instance)
+	if err != nil {
+		return storage.SnapshotInterval.Duration
+	}
+	last := getLastScheduledSnapshotTime(instance, snapshots)
+	if last == nil {
+		return storage.SnapshotInterval.Duration
+	}
+	next := last.Add(storage.SnapshotInterval.Duration).Sub(now)
+	if next <= 0 {
+		return time.Second
+	}
+	return next
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// snapshotWebhookPath is the path the snapshot webhook is served on; see deploy/webhook.yaml
+const snapshotWebhookPath = "/validate-cloudshell-snapshot"
+
+// snapshotValidator rejects CloudShellSnapshots of shells that the user creating them does not own, and changes to
+// the shell a snapshot is taken of. Shells in local mode share a namespace, so the permission to create snapshots in
+// it does not imply access to every shell's home directory. The operator itself takes scheduled snapshots.
+type snapshotValidator struct {
+	reader  client.Reader
+	decoder *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &snapshotValidator{}
+
+func (v *snapshotValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+func (v *snapshotValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if isOperator(req.UserInfo) {
+		return admission.Allowed("")
+	}
+	snapshot := &v1alpha1.CloudShellSnapshot{}
+	if err := v.decoder.Decode(req, snapshot); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	switch req.Operation {
+	case v1beta1.Create:
+		if req.UserInfo.Username == "" {
+			return admission.Denied("CloudShellSnapshots can only be created by authenticated users")
+		}
+		// The shell is read from the API server, as its owner decides whether the snapshot is allowed
+		shell := &v1alpha1.CloudShell{}
+		err := v.reader.Get(ctx, types.NamespacedName{Name: snapshot.Spec.Shell, Namespace: req.Namespace}, shell)
+		if errors.IsNotFound(err) {
+			return admission.Denied(fmt.Sprintf("CloudShell %s does not exist", snapshot.Spec.Shell))
+		}
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if getOwner(shell) != req.UserInfo.Username {
+			return admission.Denied(fmt.Sprintf("%s does not own CloudShell %s", req.UserInfo.Username, shell.Name))
+		}
+	case v1beta1.Update:
+		old := &v1alpha1.CloudShellSnapshot{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if snapshot.Spec.Shell != old.Spec.Shell {
+			return admission.Denied("spec.shell is immutable")
+		}
+	}
+	return admission.Allowed("")
+}
@@ -0,0 +1,218 @@
+package cloudshell
+
+import (
+	"context"
+	"strings"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// getCondition returns the condition of the given type from a CloudShell's status, or nil if it is not set
+func getCondition(status *v1alpha1.CloudShellStatus, conditionType v1alpha1.CloudShellConditionType) *v1alpha1.CloudShellCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition sets a condition in a CloudShell's status, preserving its transition time if the status is unchanged.
+// It returns whether the status was modified.
+func setCondition(status *v1alpha1.CloudShellStatus, condition v1alpha1.CloudShellCondition) bool {
+	existing := getCondition(status, condition.Type)
+	if existing == nil {
+		condition.LastTransitionTime = metav1.Now()
+		status.Conditions = append(status.Conditions, condition)
+		return true
+	}
+	if existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+		return false
+	}
+	if existing.Status != condition.Status {
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Status = condition.Status
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+	return true
+}
+
+// setReady sets the Ready condition and status.ready. It returns whether the status was modified and whether the
+// shell became ready for the first time after being seen starting. Shells without a Ready condition, such as those
+// created before the operator set it, are not reported as first ready, as the time since their creation does not
+// measure their startup.
+func setReady(status *v1alpha1.CloudShellStatus, ready bool) (modified, first bool) {
+	existing := getCondition(status, v1alpha1.Ready)
+	neverRan := status.StartedAt == nil && status.RunningSeconds == 0
+	waited := existing != nil && (existing.Reason == "QuotaExceeded" || existing.Reason == "WaitingForSnapshot")
+	starting := existing == nil || existing.Reason == "Starting" || (waited && neverRan)
+	restarting := existing != nil && !starting &&
+		(existing.Reason == "Stopped" || waited || existing.Reason == "Restarting")
+	condition := v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.Ready,
+		Status:  corev1.ConditionTrue,
+		Reason:  "Available",
+		Message: "The shell is available",
+	}
+	if !ready {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "Unavailable"
+		condition.Message = "The shell's deployment is not available"
+		if starting {
+			condition.Reason = "Starting"
+			condition.Message = "The shell is starting"
+		} else if restarting {
+			condition.Reason = "Restarting"
+			condition.Message = "The shell is restarting"
+		}
+	}
+	modified = setCondition(status, condition) || status.Ready != ready
+	status.Ready = ready
+	return modified, ready && starting && existing != nil
+}
+
+// getStopReason returns the reason and message of the Ready condition of a shell that the operator keeps stopped, or
+// an empty reason if the shell should run
+func getStopReason(instance *v1alpha1.CloudShell) (reason, message string) {
+	if isExpired(instance) {
+		return "Stopped", "The shell reached its maximum lifetime and was stopped"
+	}
+	if isQueued(instance) {
+		return "QuotaExceeded", getCondition(&instance.Status, v1alpha1.QuotaExceeded).Message
+	}
+	if isResetting(instance) {
+		return "Resetting", "The shell's home directory is being reset"
+	}
+	return "", ""
+}
+
+// isStopped returns whether the operator keeps a shell stopped, in which case its deployment is scaled down
+func isStopped(instance *v1alpha1.CloudShell) bool {
+	reason, _ := getStopReason(instance)
+	return reason != ""
+}
+
+// setStopped sets the Ready condition and status.ready for a shell stopped by the operator. It returns whether the
+// status was modified.
+func setStopped(status *v1alpha1.CloudShellStatus, reason, message string) bool {
+	modified := setCondition(status, v1alpha1.CloudShellCondition{
+		Type:    v1alpha1.Ready,
+		Status:  corev1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	}) || status.Ready
+	status.Ready = false
+	return modified
+}
+
+// removeCondition removes a condition from a CloudShell's status. It returns whether the status was modified.
+func removeCondition(status *v1alpha1.CloudShellStatus, conditionType v1alpha1.CloudShellConditionType) bool {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			status.Conditions = append(status.Conditions[:i], status.Conditions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileProjectsStatus sets the ProjectsCloned condition from the result of the clone init container in the most
+// recent shell pod. Clone failures are not fatal to the shell, so this never blocks reconciling.
+func (r *ReconcileCloudShell) reconcileProjectsStatus(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if len(instance.Spec.Projects) == 0 {
+		return r.updateStatusIf(ctx, removeCondition(&instance.Status, v1alpha1.ProjectsCloned))
+	}
+	state, err := r.getInitContainerState(instance, projectCloneContainerName)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	condition := getInitContainerCondition(v1alpha1.ProjectsCloned, state, "Cloned", "All projects were cloned", "CloneFailed")
+	return r.updateStatusIf(ctx, setCondition(&instance.Status, condition))
+}
+
+// getInitContainerState returns the terminated state of an init container in the most recent shell pod, or nil if
+// it has not terminated in any pod
+func (r *ReconcileCloudShell) getInitContainerState(instance *v1alpha1.CloudShell, name string) (*corev1.ContainerStateTerminated, error) {
+	pods := &corev1.PodList{}
+	err := r.client.List(context.TODO(), pods,
+		client.InNamespace(getShellNamespace(instance)),
+		client.MatchingLabels(getLabelsForID(instance.Status.Id)))
+	if err != nil {
+		return nil, err
+	}
+	var state *corev1.ContainerStateTerminated
+	var newest metav1.Time
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.InitContainerStatuses {
+			if status.Name != name || status.State.Terminated == nil {
+				continue
+			}
+			if state == nil || newest.Before(&pod.CreationTimestamp) {
+				state = status.State.Terminated
+				newest = pod.CreationTimestamp
+			}
+		}
+	}
+	return state, nil
+}
+
+// getRunningShellPod returns a running shell pod with an IP address, or nil if there is none
+func (r *ReconcileCloudShell) getRunningShellPod(instance *v1alpha1.CloudShell) (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	err := r.client.List(context.TODO(), pods,
+		client.InNamespace(getShellNamespace(instance)),
+		client.MatchingLabels(getLabelsForID(instance.Status.Id)))
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" && pod.DeletionTimestamp == nil {
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
+
+// getInitContainerCondition returns a condition reporting the result of an init container that records failures in
+// its termination message. The condition is Unknown until the init container has terminated.
+func getInitContainerCondition(conditionType v1alpha1.CloudShellConditionType, state *corev1.ContainerStateTerminated,
+	successReason, successMessage, failureReason string) v1alpha1.CloudShellCondition {
+	condition := v1alpha1.CloudShellCondition{
+		Type:    conditionType,
+		Status:  corev1.ConditionUnknown,
+		Reason:  "Pending",
+		Message: "Waiting for the shell to start",
+	}
+	if state == nil {
+		return condition
+	}
+	if message := strings.TrimSpace(state.Message); message != "" || state.ExitCode != 0 {
+		if message == "" {
+			message = state.Reason
+		}
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = failureReason
+		condition.Message = message
+		return condition
+	}
+	condition.Status = corev1.ConditionTrue
+	condition.Reason = successReason
+	condition.Message = successMessage
+	return condition
+}
+
+// updateStatusIf updates the status of the CloudShell being reconciled if it was modified
+func (r *ReconcileCloudShell) updateStatusIf(ctx reconcileContext, modified bool) deployStatus {
+	if !modified {
+		return deployStatus{Continue: true}
+	}
+	ctx.log.Info("Updating status conditions")
+	err := r.client.Status().Update(context.TODO(), ctx.instance)
+	return deployStatus{Requeue: true, Error: err}
+}
@@ -0,0 +1,80 @@
+package cloudshell
+
+import (
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	apiTokenVolumeName = "cloudshell-api-token"
+	// serviceAccountMountDir is where ServiceAccount tokens are automounted; the projected token is mounted at the
+	// same path so that in-cluster clients find it
+	serviceAccountMountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	serviceAccountTokenKey = "token"
+)
+
+// applyAPIToken mounts a short-lived projected ServiceAccount token, along with the API server CA bundle and the
+// pod's namespace, in place of the automounted token. Only the sidecars that call the API server and the shell
+// container, unless disabled in the CloudShell's spec, get the token.
+func applyAPIToken(podSpec *corev1.PodSpec, instance *v1alpha1.CloudShell) {
+	automount := false
+	var volumeDefaultMode int32 = 420
+	expiration := config.ControllerCfg.GetTokenExpiration()
+	podSpec.AutomountServiceAccountToken = &automount
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: apiTokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          config.ControllerCfg.GetTokenAudience(),
+							ExpirationSeconds: &expiration,
+							Path:              serviceAccountTokenKey,
+						},
+					},
+					{
+						Secret: &corev1.SecretProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: getKubeconfigSecretName(instance)},
+							Items: []corev1.KeyToPath{
+								{
+									Key:  kubeconfigCAKey,
+									Path: kubeconfigCAKey,
+								},
+							},
+						},
+					},
+					{
+						DownwardAPI: &corev1.DownwardAPIProjection{
+							Items: []corev1.DownwardAPIVolumeFile{
+								{
+									Path: "namespace",
+									FieldRef: &corev1.ObjectFieldSelector{
+										APIVersion: "v1",
+										FieldPath:  "metadata.namespace",
+									},
+								},
+							},
+						},
+					},
+				},
+				DefaultMode: &volumeDefaultMode,
+			},
+		},
+	})
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		switch {
+		case container.Name == machineExecContainerName || container.Name == oauthProxyContainerName:
+		case container.Name == shellHostContainerName && !instance.Spec.DisableServiceAccountToken:
+		default:
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      apiTokenVolumeName,
+			MountPath: serviceAccountMountDir,
+			ReadOnly:  true,
+		})
+	}
+}
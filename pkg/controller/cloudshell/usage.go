@@ -0,0 +1,113 @@
+package cloudshell
+
+import (
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/agent"
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// accountRunningTime starts or stops the running time of a shell as it becomes ready or not ready. The time of a run
+// is added to status.runningSeconds when it ends, and the resources reserved during the run, recorded in
+// status.requests, to status.usage. requests are those of the running pod, or nil if it is not known yet; they are
+// recorded once per run. It returns whether the status was modified.
+func accountRunningTime(status *v1alpha1.CloudShellStatus, ready bool, requests corev1.ResourceList, now time.Time) bool {
+	if ready {
+		modified := false
+		if status.StartedAt == nil {
+			status.StartedAt = &metav1.Time{Time: now}
+			modified = true
+		}
+		if status.Requests == nil && requests != nil {
+			status.Requests = requests
+			modified = true
+		}
+		return modified
+	}
+	if status.StartedAt == nil {
+		return false
+	}
+	if now.After(status.StartedAt.Time) {
+		seconds := int64(now.Sub(status.StartedAt.Time) / time.Second)
+		status.RunningSeconds += seconds
+		status.Usage.Add(status.Requests, seconds)
+	}
+	status.StartedAt = nil
+	status.Requests = nil
+	return true
+}
+
+// getRunRequests returns the resources reserved for a shell's running pod, or nil if it already recorded them for
+// the current run or has no running pod
+func (r *ReconcileCloudShell) getRunRequests(instance *v1alpha1.CloudShell) (corev1.ResourceList, error) {
+	if instance.Status.Requests != nil {
+		return nil, nil
+	}
+	pod, err := r.getRunningShellPod(instance)
+	if err != nil || pod == nil {
+		return nil, err
+	}
+	return getPodRequests(&pod.Spec), nil
+}
+
+// getPodRequests returns the CPU and memory reserved for a pod: the larger of the total requests of its containers
+// and the requests of each init container, as the scheduler computes them. Requests are read from the pod rather than
+// its template, as pods include defaults applied by LimitRanges; containers that set a limit but no request are
+// given the limit as request, as the API server does.
+func getPodRequests(spec *corev1.PodSpec) corev1.ResourceList {
+	total := corev1.ResourceList{}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		sum := resource.Quantity{}
+		for _, container := range spec.Containers {
+			if quantity, ok := getContainerRequest(&container, name); ok {
+				sum.Add(quantity)
+			}
+		}
+		for _, container := range spec.InitContainers {
+			if quantity, ok := getContainerRequest(&container, name); ok && quantity.Cmp(sum) > 0 {
+				sum = quantity
+			}
+		}
+		total[name] = sum
+	}
+	return total
+}
+
+func getContainerRequest(container *corev1.Container, name corev1.ResourceName) (resource.Quantity, bool) {
+	if quantity, ok := container.Resources.Requests[name]; ok {
+		return quantity, true
+	}
+	quantity, ok := container.Resources.Limits[name]
+	return quantity, ok
+}
+
+// reconcileActivityStatus updates the time of the last terminal activity in a shell from its agent. Failing to reach
+// the agent is not an error, as the shell may be starting or stopping; activity is read again at the next poll.
+func (r *ReconcileCloudShell) reconcileActivityStatus(ctx reconcileContext) deployStatus {
+	instance := ctx.instance
+	if !config.ControllerCfg.GetActivityTracking() {
+		return deployStatus{Continue: true}
+	}
+	pod, err := r.getRunningShellPod(instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	if pod == nil {
+		return deployStatus{Continue: true}
+	}
+	activity := agent.Activity{}
+	if err := r.getFromAgent(instance, pod, agent.ActivityPath, &activity); err != nil {
+		ctx.log.Info("Could not read activity from agent", "error", err.Error())
+		return deployStatus{Continue: true}
+	}
+	last := activity.LastActivityTime
+	if last == nil || (instance.Status.LastActivityTime != nil && !instance.Status.LastActivityTime.Before(last)) {
+		return deployStatus{Continue: true}
+	}
+	instance.Status.LastActivityTime = last
+	return r.updateStatusIf(ctx, true)
+}
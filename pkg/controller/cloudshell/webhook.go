@@ -0,0 +1,95 @@
+package cloudshell
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// ownerWebhookPath is the path the owner webhook is served on; see deploy/webhook.yaml
+	ownerWebhookPath = "/mutate-cloudshell-owner"
+	webhookPort      = 9443
+	// webhookCertDir holds the serving certificate of the webhook server, as tls.crt and tls.key
+	webhookCertDir = "/var/run/cloudshell/webhook-certs"
+)
+
+// addWebhooks serves the operator's admission webhooks. They are required: the owner of a CloudShell, which selects
+// its per-user namespace and quotas, is only trusted because it is set by the owner webhook, and the resources a
+// CloudShell mounts are only checked by the access webhook. The snapshot webhook keeps users from snapshotting the
+// home directories of shells they do not own.
+func addWebhooks(mgr manager.Manager) {
+	server := mgr.GetWebhookServer()
+	server.Port = webhookPort
+	server.CertDir = webhookCertDir
+	server.Register(ownerWebhookPath, &webhook.Admission{Handler: &ownerMutator{}})
+	server.Register(accessWebhookPath, &webhook.Admission{Handler: &accessValidator{
+		client: mgr.GetClient(),
+		cache:  newAccessCache(),
+	}})
+	server.Register(snapshotWebhookPath, &webhook.Admission{Handler: &snapshotValidator{reader: mgr.GetAPIReader()}})
+	addQuotaWebhook(mgr, server)
+}
+
+// ownerMutator sets the owner annotation of new CloudShells to the user creating them and rejects changes to it, so
+// that users cannot create shells on behalf of, or take over the shells of, other users. The operator itself may set
+// the owner, which it does when handing a pooled shell over to the user claiming it.
+type ownerMutator struct {
+	decoder *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &ownerMutator{}
+
+func (m *ownerMutator) InjectDecoder(decoder *admission.Decoder) error {
+	m.decoder = decoder
+	return nil
+}
+
+func (m *ownerMutator) Handle(_ context.Context, req admission.Request) admission.Response {
+	if isOperator(req.UserInfo) {
+		return admission.Allowed("")
+	}
+	instance := &v1alpha1.CloudShell{}
+	if err := m.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	switch req.Operation {
+	case v1beta1.Create:
+		if req.UserInfo.Username == "" {
+			return admission.Denied("CloudShells can only be created by authenticated users")
+		}
+		if instance.Annotations == nil {
+			instance.Annotations = map[string]string{}
+		}
+		instance.Annotations[ownerAnnotation] = req.UserInfo.Username
+		marshaled, err := json.Marshal(instance)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+	case v1beta1.Update:
+		old := &v1alpha1.CloudShell{}
+		if err := m.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if getOwner(instance) != getOwner(old) {
+			return admission.Denied(fmt.Sprintf("annotation %s is immutable", ownerAnnotation))
+		}
+	}
+	return admission.Allowed("")
+}
+
+// isOperator returns whether an admission request was made by the operator
+func isOperator(user authenticationv1.UserInfo) bool {
+	username := config.ControllerCfg.GetOperatorUsername()
+	return username != "" && user.Username == username
+}
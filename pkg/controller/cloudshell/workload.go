@@ -0,0 +1,443 @@
+package cloudshell
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"github.com/che-incubator/cloudshell-operator/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// statefulSetRevisionLabel is set by the StatefulSet controller on pods to the revision they were created from
+const statefulSetRevisionLabel = "controller-revision-hash"
+
+var workloadDiffOpts = cmp.Options{
+	cmpopts.IgnoreFields(appsv1.Deployment{}, "TypeMeta", "ObjectMeta", "Status"),
+	cmpopts.IgnoreFields(appsv1.DeploymentSpec{}, "RevisionHistoryLimit", "ProgressDeadlineSeconds"),
+	cmpopts.IgnoreFields(appsv1.StatefulSet{}, "TypeMeta", "ObjectMeta", "Status"),
+	cmpopts.IgnoreFields(appsv1.StatefulSetSpec{}, "RevisionHistoryLimit"),
+	cmpopts.IgnoreFields(corev1.PodSpec{}, "DNSPolicy", "SchedulerName", "DeprecatedServiceAccount", "RestartPolicy"),
+	cmpopts.IgnoreFields(corev1.Container{}, "TerminationMessagePath", "TerminationMessagePolicy", "ImagePullPolicy"),
+	cmpopts.SortSlices(func(a, b corev1.Container) bool {
+		return strings.Compare(a.Name, b.Name) > 0
+	}),
+	cmpopts.SortSlices(func(a, b corev1.Volume) bool {
+		return strings.Compare(a.Name, b.Name) > 0
+	}),
+	cmpopts.SortSlices(func(a, b corev1.VolumeMount) bool {
+		return strings.Compare(a.MountPath, b.MountPath) > 0
+	}),
+	cmpopts.EquateEmpty(),
+}
+
+// reconcileHomeVolume creates the claim holding the shell's home directory, if home directories are persistent. The
+// claim is created before the workload and owned by the CloudShell, so that it is shared by the Deployment and
+// StatefulSet kinds and deleted with the shell. Claims are not updated, as most of their spec is immutable. A claim
+// restored from spec.storage.fromSnapshot is only created once the snapshot is ready.
+func (r *ReconcileCloudShell) reconcileHomeVolume(ctx reconcileContext) deployStatus {
+	if err := validateStorage(ctx.instance); err != nil {
+		return deployStatus{Error: err}
+	}
+	size := config.ControllerCfg.GetHomeStorageSize()
+	if size == nil {
+		return deployStatus{Continue: true}
+	}
+	claim := &corev1.PersistentVolumeClaim{}
+	namespacedName := types.NamespacedName{Name: getHomeClaimName(ctx.instance), Namespace: getShellNamespace(ctx.instance)}
+	err := r.client.Get(context.TODO(), namespacedName, claim)
+	if err == nil {
+		return deployStatus{Continue: true}
+	}
+	if !errors.IsNotFound(err) {
+		return deployStatus{Error: err}
+	}
+	claim = &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      namespacedName.Name,
+			Namespace: namespacedName.Namespace,
+			Labels:    getLabelsForID(ctx.instance.Status.Id),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: *size,
+				},
+			},
+		},
+	}
+	if className := config.ControllerCfg.GetHomeStorageClassName(); className != "" {
+		claim.Spec.StorageClassName = &className
+	}
+	if storage := ctx.instance.Spec.Storage; storage != nil && storage.FromSnapshot != "" {
+		source, restoreSize, message, err := r.getRestoreSource(ctx.instance)
+		if err != nil {
+			return deployStatus{Error: err}
+		}
+		if source == nil {
+			// Reconciled again when the snapshot or the shell's spec changes
+			ctx.log.Info("Waiting for CloudShellSnapshot to restore home directory from", "CloudShellSnapshot.Name", storage.FromSnapshot, "reason", message)
+			if !setStopped(&ctx.instance.Status, "WaitingForSnapshot", message) {
+				return deployStatus{}
+			}
+			r.recorder.Event(ctx.instance, corev1.EventTypeWarning, "WaitingForSnapshot", message)
+			status := r.updateStatusIf(ctx, true)
+			status.Requeue = false
+			return status
+		}
+		claim.Spec.DataSource = source
+		if restoreSize != nil && restoreSize.Cmp(*size) > 0 {
+			claim.Spec.Resources.Requests[corev1.ResourceStorage] = *restoreSize
+		}
+	}
+	if err := r.setOwner(ctx.instance, claim); err != nil {
+		return deployStatus{Error: err}
+	}
+	ctx.log.Info("Creating home volume claim")
+	err = r.client.Create(context.TODO(), claim)
+	if errors.IsAlreadyExists(err) {
+		return deployStatus{Requeue: true}
+	}
+	return deployStatus{Requeue: true, Error: err}
+}
+
+// getHomeVolumeSource returns the volume holding a shell's home directory
+func getHomeVolumeSource(instance *v1alpha1.CloudShell) corev1.VolumeSource {
+	if config.ControllerCfg.GetHomeStorageSize() == nil {
+		return corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+	}
+	return corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: getHomeClaimName(instance),
+		},
+	}
+}
+
+// reconcileWorkload creates or updates the Deployment or StatefulSet running the shell pod, according to the
+// configured workload kind, and reports whether the shell is ready
+func (r *ReconcileCloudShell) reconcileWorkload(ctx reconcileContext) deployStatus {
+	spec, err := r.getSpecWorkload(ctx.instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+
+	// A workload of the other kind is left over from a change of configuration. It is removed before the new one
+	// is created, so that the shell never runs two pods.
+	deleted, err := r.deleteStaleWorkload(ctx)
+	if err != nil || deleted {
+		return deployStatus{Requeue: true, Error: err}
+	}
+
+	cluster, err := r.getClusterWorkload(spec)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	if cluster == nil {
+		ctx.log.Info("Creating workload", "kind", config.ControllerCfg.GetWorkloadKind())
+		err = r.client.Create(context.TODO(), spec)
+		if errors.IsAlreadyExists(err) {
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+	if !cmp.Equal(spec, cluster, workloadDiffOpts, getSecurityContextDiffOpts()) {
+		ctx.log.Info("Updating workload", "kind", config.ControllerCfg.GetWorkloadKind())
+		switch c := cluster.(type) {
+		case *appsv1.Deployment:
+			c.Spec = spec.(*appsv1.Deployment).Spec
+		case *appsv1.StatefulSet:
+			c.Spec = spec.(*appsv1.StatefulSet).Spec
+		}
+		err = r.client.Update(context.TODO(), cluster)
+		if errors.IsConflict(err) {
+			// Modified since we started, requeue
+			return deployStatus{Requeue: true}
+		}
+		return deployStatus{Requeue: true, Error: err}
+	}
+
+	if reason, message := getStopReason(ctx.instance); reason != "" {
+		modified := setStopped(&ctx.instance.Status, reason, message)
+		modified = accountRunningTime(&ctx.instance.Status, false, nil, time.Now()) || modified
+		return r.updateStatusIf(ctx, modified)
+	}
+
+	if !workloadReady(cluster) {
+		ctx.log.Info("Workload not ready")
+		if statefulSet, ok := cluster.(*appsv1.StatefulSet); ok {
+			if err := r.restartOutdatedPod(ctx, statefulSet); err != nil {
+				return deployStatus{Error: err}
+			}
+		}
+		modified, _ := setReady(&ctx.instance.Status, false)
+		modified = accountRunningTime(&ctx.instance.Status, false, nil, time.Now()) || modified
+		if !modified {
+			return deployStatus{}
+		}
+		status := r.updateStatusIf(ctx, true)
+		// The workload is watched; wait for it to become ready
+		status.Requeue = false
+		return status
+	}
+
+	requests, err := r.getRunRequests(ctx.instance)
+	if err != nil {
+		return deployStatus{Error: err}
+	}
+	modified, first := setReady(&ctx.instance.Status, true)
+	modified = accountRunningTime(&ctx.instance.Status, true, requests, time.Now()) || modified
+	status := r.updateStatusIf(ctx, modified)
+	if first && status.Error == nil {
+		timeToReady.Observe(time.Since(ctx.instance.CreationTimestamp.Time).Seconds())
+	}
+	return status
+}
+
+// workloadReady returns whether a workload has rolled out its current spec and runs as many ready pods as it
+// should. A workload scaled to zero is never ready.
+func workloadReady(workload runtime.Object) bool {
+	switch w := workload.(type) {
+	case *appsv1.Deployment:
+		replicas := getReplicas(w.Spec.Replicas)
+		return replicas > 0 &&
+			w.Status.ObservedGeneration >= w.Generation &&
+			w.Status.Replicas == replicas &&
+			w.Status.UpdatedReplicas == replicas &&
+			w.Status.AvailableReplicas == replicas
+	case *appsv1.StatefulSet:
+		replicas := getReplicas(w.Spec.Replicas)
+		return replicas > 0 &&
+			w.Status.ObservedGeneration >= w.Generation &&
+			w.Status.CurrentRevision == w.Status.UpdateRevision &&
+			w.Status.Replicas == replicas &&
+			w.Status.ReadyReplicas == replicas
+	}
+	return false
+}
+
+func getReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// restartOutdatedPod deletes a StatefulSet's pod if it is not ready and was created from an older revision. The
+// StatefulSet controller only replaces ready pods during a rolling update, so a shell whose previous spec is broken
+// (e.g. an image that does not exist) would otherwise never pick up a fix.
+func (r *ReconcileCloudShell) restartOutdatedPod(ctx reconcileContext, statefulSet *appsv1.StatefulSet) error {
+	if statefulSet.Status.UpdateRevision == "" {
+		return nil
+	}
+	pod := &corev1.Pod{}
+	namespacedName := types.NamespacedName{Name: statefulSet.Name + "-0", Namespace: statefulSet.Namespace}
+	err := r.client.Get(context.TODO(), namespacedName, pod)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if pod.DeletionTimestamp != nil || isPodReady(pod) || pod.Labels[statefulSetRevisionLabel] == statefulSet.Status.UpdateRevision {
+		return nil
+	}
+	ctx.log.Info("Deleting outdated shell pod", "pod", pod.Name)
+	err = r.client.Delete(context.TODO(), pod)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// deleteStaleWorkload deletes the workload of the kind that is not configured, if it exists, and returns whether
+// it is still present. Deletion is in the foreground, so the workload remains until its pod is gone.
+func (r *ReconcileCloudShell) deleteStaleWorkload(ctx reconcileContext) (bool, error) {
+	var stale runtime.Object = &appsv1.StatefulSet{}
+	if config.ControllerCfg.GetWorkloadKind() == config.WorkloadKindStatefulSet {
+		stale = &appsv1.Deployment{}
+	}
+	namespacedName := types.NamespacedName{Name: getWorkloadName(ctx.instance), Namespace: getShellNamespace(ctx.instance)}
+	err := r.client.Get(context.TODO(), namespacedName, stale)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	staleMeta, err := meta.Accessor(stale)
+	if err != nil {
+		return false, err
+	}
+	if staleMeta.GetDeletionTimestamp() != nil {
+		return true, nil
+	}
+	ctx.log.Info("Deleting workload of another kind", "kind", fmt.Sprintf("%T", stale))
+	err = r.client.Delete(context.TODO(), stale, client.PropagationPolicy(metav1.DeletePropagationForeground))
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+func (r *ReconcileCloudShell) getClusterWorkload(spec runtime.Object) (runtime.Object, error) {
+	specMeta, err := meta.Accessor(spec)
+	if err != nil {
+		return nil, err
+	}
+	cluster := spec.DeepCopyObject()
+	namespacedName := types.NamespacedName{
+		Namespace: specMeta.GetNamespace(),
+		Name:      specMeta.GetName(),
+	}
+	err = r.client.Get(context.TODO(), namespacedName, cluster)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// getSpecWorkload returns the Deployment or StatefulSet running a shell's pod. Both run at most one pod: the
+// Deployment uses the Recreate strategy, and the StatefulSet replaces its pod only once it has terminated.
+func (r *ReconcileCloudShell) getSpecWorkload(instance *v1alpha1.CloudShell) (runtime.Object, error) {
+	labels := getLabelsForID(instance.Status.Id)
+	replicas := int32(1)
+	if isStopped(instance) {
+		replicas = 0
+	}
+	template, err := r.getSpecPodTemplate(instance)
+	if err != nil {
+		return nil, err
+	}
+	objectMeta := metav1.ObjectMeta{
+		Name:      getWorkloadName(instance),
+		Namespace: getShellNamespace(instance),
+		Labels:    labels,
+	}
+
+	var workload runtime.Object
+	switch config.ControllerCfg.GetWorkloadKind() {
+	case config.WorkloadKindStatefulSet:
+		partition := int32(0)
+		workload = &appsv1.StatefulSet{
+			ObjectMeta: objectMeta,
+			Spec: appsv1.StatefulSetSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{
+					MatchLabels: labels,
+				},
+				Template:            template,
+				ServiceName:         getServiceName(instance),
+				PodManagementPolicy: appsv1.ParallelPodManagement,
+				UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+					Type: appsv1.RollingUpdateStatefulSetStrategyType,
+					RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{
+						Partition: &partition,
+					},
+				},
+			},
+		}
+	default:
+		workload = &appsv1.Deployment{
+			ObjectMeta: objectMeta,
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{
+					MatchLabels: labels,
+				},
+				Template: template,
+				Strategy: appsv1.DeploymentStrategy{
+					Type: appsv1.RecreateDeploymentStrategyType,
+				},
+			},
+		}
+	}
+	workloadMeta, err := meta.Accessor(workload)
+	if err != nil {
+		return nil, err
+	}
+	err = r.setOwner(instance, workloadMeta)
+	return workload, err
+}
+
+// getSpecPodTemplate validates a CloudShell and returns the template of its pod
+func (r *ReconcileCloudShell) getSpecPodTemplate(instance *v1alpha1.CloudShell) (corev1.PodTemplateSpec, error) {
+	template := corev1.PodTemplateSpec{}
+	if err := validatePodExtensions(instance); err != nil {
+		return template, err
+	}
+	if err := validateProjects(instance); err != nil {
+		return template, err
+	}
+	if err := validateDotfiles(instance); err != nil {
+		return template, err
+	}
+	if err := validateSessions(instance); err != nil {
+		return template, err
+	}
+	if err := validateAudit(instance); err != nil {
+		return template, err
+	}
+	if err := validateAgent(instance); err != nil {
+		return template, err
+	}
+	if err := validateLifetime(instance); err != nil {
+		return template, err
+	}
+	if err := validateCredentials(instance); err != nil {
+		return template, err
+	}
+	if err := validateImageUpdate(instance); err != nil {
+		return template, err
+	}
+	if err := validateScheduling(instance); err != nil {
+		return template, err
+	}
+	unavailable, err := r.getUnavailableCredentials(instance)
+	if err != nil {
+		return template, err
+	}
+	if len(unavailable) > 0 {
+		instance = withoutCredentials(instance, unavailable)
+	}
+	podSpec := getSpecPod(instance)
+	if err := validatePodSpec(podSpec); err != nil {
+		return template, err
+	}
+	dotfilesAnnotations, err := r.getDotfilesAnnotations(instance)
+	if err != nil {
+		return template, err
+	}
+
+	template.ObjectMeta = metav1.ObjectMeta{
+		Name:        instance.Status.Id,
+		Namespace:   getShellNamespace(instance),
+		Labels:      getLabelsForID(instance.Status.Id),
+		Annotations: mergeLabels(mergeLabels(getPodAnnotations(), dotfilesAnnotations), getActionAnnotations(instance)),
+	}
+	template.Spec = podSpec
+	return template, nil
+}
@@ -0,0 +1,89 @@
+// Package registry resolves image tags to digests using the Docker Registry HTTP API V2, which is implemented by
+// Docker Hub, Quay, GCR, ECR and the open-source registry, among others
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	dockerHub     = "docker.io"
+	dockerHubHost = "registry-1.docker.io"
+	defaultTag    = "latest"
+)
+
+var (
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRegexp        = regexp.MustCompile(`^\w[\w.-]{0,127}$`)
+	digestRegexp     = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is a parsed image reference, such as "quay.io/org/shell:1.0" or "ubuntu@sha256:..."
+type Reference struct {
+	// Name is the image name as written, without tag or digest
+	Name string
+	// Registry is the host (and port) of the registry; images without a registry are on Docker Hub ("docker.io")
+	Registry string
+	// Repository is the path of the image in the registry, such as "library/ubuntu"
+	Repository string
+	// Tag is the tag of the image; it defaults to "latest" if the reference has neither tag nor digest
+	Tag string
+	// Digest is the digest of the image, if the reference is pinned
+	Digest string
+}
+
+// ParseReference parses an image reference, applying the defaults used by container runtimes
+func ParseReference(image string) (Reference, error) {
+	ref := Reference{}
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest in image %q", image)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag in image %q", image)
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	ref.Name = name
+
+	// The first component is a registry if it looks like a host name, as in the Docker CLI
+	i := strings.Index(name, "/")
+	if i < 0 || (!strings.ContainsAny(name[:i], ".:") && name[:i] != "localhost") {
+		ref.Registry, ref.Repository = dockerHub, name
+	} else {
+		ref.Registry, ref.Repository = name[:i], name[i+1:]
+	}
+	if ref.Registry == dockerHub && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if !repositoryRegexp.MatchString(ref.Repository) {
+		return ref, fmt.Errorf("invalid repository in image %q", image)
+	}
+	return ref, nil
+}
+
+// Pinned returns the reference to the image with the given digest
+func (r Reference) Pinned(digest string) string {
+	return r.Name + "@" + digest
+}
+
+// String returns the reference in its canonical form
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		image    string
+		expected Reference
+		invalid  bool
+	}{
+		{
+			image:    "ubuntu",
+			expected: Reference{Name: "ubuntu", Registry: "docker.io", Repository: "library/ubuntu", Tag: "latest"},
+		},
+		{
+			image:    "org/shell:1.0",
+			expected: Reference{Name: "org/shell", Registry: "docker.io", Repository: "org/shell", Tag: "1.0"},
+		},
+		{
+			image:    "quay.io/org/shell:1.0",
+			expected: Reference{Name: "quay.io/org/shell", Registry: "quay.io", Repository: "org/shell", Tag: "1.0"},
+		},
+		{
+			image: "localhost:5000/team/shell",
+			expected: Reference{
+				Name: "localhost:5000/team/shell", Registry: "localhost:5000", Repository: "team/shell", Tag: "latest",
+			},
+		},
+		{
+			image:    "localhost/shell",
+			expected: Reference{Name: "localhost/shell", Registry: "localhost", Repository: "shell", Tag: "latest"},
+		},
+		{
+			image:    "ubuntu@" + digest,
+			expected: Reference{Name: "ubuntu", Registry: "docker.io", Repository: "library/ubuntu", Digest: digest},
+		},
+		{
+			image: "ubuntu:22.04@" + digest,
+			expected: Reference{
+				Name: "ubuntu", Registry: "docker.io", Repository: "library/ubuntu", Tag: "22.04", Digest: digest,
+			},
+		},
+		{image: "Ubuntu", invalid: true},
+		{image: "ubuntu:-bad", invalid: true},
+		{image: "ubuntu@sha256:short", invalid: true},
+		{image: "quay.io/", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			ref, err := ParseReference(test.image)
+			if (err != nil) != test.invalid {
+				t.Fatalf("expected invalid %t, got error %v", test.invalid, err)
+			}
+			if !test.invalid && ref != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, ref)
+			}
+		})
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	ref, err := ParseReference("ubuntu:22.04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ref.String(); s != "docker.io/library/ubuntu:22.04" {
+		t.Errorf("expected docker.io/library/ubuntu:22.04, got %s", s)
+	}
+	if pinned := ref.Pinned("sha256:abc"); pinned != "ubuntu@sha256:abc" {
+		t.Errorf("expected ubuntu@sha256:abc, got %s", pinned)
+	}
+}
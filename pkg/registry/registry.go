@@ -0,0 +1,399 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxManifestSize limits the manifests read when a registry does not return their digest in a header
+const maxManifestSize = 4 << 20
+
+// nonPublicNetworks are the networks of addresses that are not reachable from the internet, besides loopback,
+// link-local and multicast addresses: private networks, shared address space, and unique local addresses
+var nonPublicNetworks = parseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16",
+	"fc00::/7")
+
+// manifestTypes are the manifest media types accepted when resolving tags. Image indexes come first, so that the
+// digest of a multi-architecture image is the one runtimes pull.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// Credentials authenticate to a registry
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Client resolves image tags to digests. Image references are usually written by users, so the client only
+// contacts the registries it allows, and refuses to connect to addresses that are not public unless the registry is
+// internal, so that references cannot be used to reach endpoints inside the cluster or its network.
+type Client struct {
+	// Timeout limits each request to a registry or token service; zero means no limit
+	Timeout time.Duration
+	// Credentials are used for the registries they are keyed by, as in Reference.Registry. Other registries are
+	// accessed anonymously.
+	Credentials map[string]Credentials
+	// Registries lists the registries images may be resolved from, as in Reference.Registry, besides internal and
+	// insecure registries. Images from other registries are refused. Any registry is allowed if it is empty.
+	Registries []string
+	// Internal lists registries, as in Reference.Registry, that may be on private, loopback or link-local addresses,
+	// such as a registry in the cluster. Connections to other hosts, including the token services registries name,
+	// are refused if they resolve to such addresses. Insecure registries are internal.
+	Internal []string
+	// Insecure lists registries accessed over plain HTTP, such as a local registry
+	Insecure []string
+
+	once   sync.Once
+	client *http.Client
+}
+
+// Resolve returns the digest an image reference currently points to. References that are pinned to a digest are
+// returned as is.
+func (c *Client) Resolve(ref Reference) (string, error) {
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+	if len(c.Registries) > 0 && !containsRegistry(c.Registries, ref.Registry) &&
+		!containsRegistry(c.Internal, ref.Registry) && !containsRegistry(c.Insecure, ref.Registry) {
+		return "", fmt.Errorf("resolving %s: registry %s is not allowed", ref, ref.Registry)
+	}
+	defer c.httpClient().CloseIdleConnections()
+	scheme := "https"
+	if containsRegistry(c.Insecure, ref.Registry) {
+		scheme = "http"
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registryHost(ref.Registry), ref.Repository, ref.Tag)
+
+	resp, err := c.get(http.MethodHead, manifestURL, ref)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); resp.StatusCode == http.StatusOK && digest != "" {
+		return digest, nil
+	}
+
+	// Some registries only return the digest for GET requests, or not at all; compute it from the manifest
+	resp, err = c.get(http.MethodGet, manifestURL, ref)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving %s: registry returned %s", ref, resp.Status)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %s", ref, err)
+	}
+	if size > maxManifestSize {
+		// The digest of part of the manifest would not be the image's
+		return "", fmt.Errorf("resolving %s: manifest is larger than %d bytes", ref, maxManifestSize)
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// get requests a manifest, authenticating if the registry asks for it
+func (c *Client) get(method, manifestURL string, ref Reference) (*http.Response, error) {
+	req, err := http.NewRequest(method, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %s", ref, err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+	authorization, err := c.authorize(resp.Header.Get("WWW-Authenticate"), ref)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %s", ref, err)
+	}
+	req.Header.Set("Authorization", authorization)
+	resp, err = c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %s", ref, err)
+	}
+	return resp, nil
+}
+
+// authorize answers an authentication challenge, returning the value of the Authorization header. Bearer challenges
+// are answered with a token from the registry's token service, requested with the registry's credentials if any.
+func (c *Client) authorize(challenge string, ref Reference) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	credentials, hasCredentials := c.Credentials[ref.Registry]
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredentials {
+			return "", fmt.Errorf("registry %s requires credentials", ref.Registry)
+		}
+		return "Basic " + basicAuth(credentials), nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || realm.Host == "" {
+			return "", fmt.Errorf("registry %s returned an invalid token realm %q", ref.Registry, params["realm"])
+		}
+		// Credentials are only sent over HTTP to insecure registries' token services
+		if realm.Scheme != "https" && (realm.Scheme != "http" || !containsRegistry(c.Insecure, ref.Registry)) {
+			return "", fmt.Errorf("registry %s returned a token realm that is not HTTPS: %q", ref.Registry, params["realm"])
+		}
+		query := realm.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		scope := params["scope"]
+		if scope == "" {
+			scope = "repository:" + ref.Repository + ":pull"
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+		req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if hasCredentials {
+			req.Header.Set("Authorization", "Basic "+basicAuth(credentials))
+		}
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("token service returned %s", resp.Status)
+		}
+		token := struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", fmt.Errorf("invalid token response: %s", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		if token.Token == "" {
+			return "", fmt.Errorf("token service returned no token")
+		}
+		return "Bearer " + token.Token, nil
+	default:
+		return "", fmt.Errorf("registry %s requires unsupported authentication %q", ref.Registry, scheme)
+	}
+}
+
+// httpClient returns the client sending requests to registries and token services. Its connections are checked by
+// dial, and it ignores proxies, which would be connected to instead of the hosts checked.
+func (c *Client) httpClient() *http.Client {
+	c.once.Do(func() {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return c.dial(ctx, dialer, network, address)
+		}
+		c.client = &http.Client{Transport: transport, Timeout: c.Timeout}
+	})
+	return c.client
+}
+
+// dial connects to an address, refusing hosts with addresses that are not public unless they are internal
+// registries. The host is resolved once and the checked addresses are connected to, so that a second lookup cannot
+// return another address.
+func (c *Client) dial(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if c.isInternal(host) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !isPublic(addr.IP) {
+			return nil, fmt.Errorf("refusing to connect to %s: %s is not a public address", host, addr.IP)
+		}
+	}
+	err = fmt.Errorf("no address found for %s", host)
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// isInternal returns whether host is the host of an internal or insecure registry
+func (c *Client) isInternal(host string) bool {
+	for _, registry := range append(append([]string{}, c.Internal...), c.Insecure...) {
+		registryHost := registryHost(registry)
+		if h, _, err := net.SplitHostPort(registryHost); err == nil {
+			registryHost = h
+		}
+		if strings.EqualFold(strings.Trim(registryHost, "[]"), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublic returns whether an address may be reachable from the internet
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// registryHost returns the host (and port) serving a registry's API
+func registryHost(registry string) string {
+	if registry == dockerHub {
+		return dockerHubHost
+	}
+	return registry
+}
+
+func containsRegistry(registries []string, registry string) bool {
+	for _, r := range registries {
+		if r == registry {
+			return true
+		}
+	}
+	return false
+}
+
+func basicAuth(credentials Credentials) string {
+	return base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.Password))
+}
+
+// parseChallenge parses a WWW-Authenticate header such as `Bearer realm="https://auth.example.com/token",
+// service="registry.example.com"` into its scheme and parameters
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i < 0 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, ", ")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return scheme, params
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			rest = rest[1:]
+			for len(rest) > 0 && rest[0] != '"' {
+				if rest[0] == '\\' && len(rest) > 1 {
+					rest = rest[1:]
+				}
+				value.WriteByte(rest[0])
+				rest = rest[1:]
+			}
+			if len(rest) > 0 {
+				rest = rest[1:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			rest = rest[end:]
+		}
+		params[key] = value.String()
+	}
+}
+
+// ParseDockerConfig reads registry credentials from the contents of a Docker config file, as stored in Secrets of
+// type kubernetes.io/dockerconfigjson. Registries are keyed as in Reference.Registry.
+func ParseDockerConfig(data []byte) (map[string]Credentials, error) {
+	config := struct {
+		Auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid Docker config: %s", err)
+	}
+	credentials := map[string]Credentials{}
+	for server, auth := range config.Auths {
+		entry := Credentials{Username: auth.Username, Password: auth.Password}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for registry %s: %s", server, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid auth for registry %s", server)
+			}
+			entry = Credentials{Username: parts[0], Password: parts[1]}
+		}
+		credentials[normalizeServer(server)] = entry
+	}
+	return credentials, nil
+}
+
+// normalizeServer converts a server in a Docker config, which may be a URL such as "https://index.docker.io/v1/",
+// into a registry host
+func normalizeServer(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	if i := strings.IndexByte(server, '/'); i >= 0 {
+		server = server[:i]
+	}
+	switch server {
+	case "index.docker.io", dockerHubHost:
+		return dockerHub
+	}
+	return server
+}
@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		scheme    string
+		params    map[string]string
+	}{
+		{
+			challenge: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"`,
+			scheme:    "Bearer",
+			params: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/ubuntu:pull",
+			},
+		},
+		{
+			challenge: `Basic realm="Registry Realm"`,
+			scheme:    "Basic",
+			params:    map[string]string{"realm": "Registry Realm"},
+		},
+		{
+			challenge: `Bearer Realm=https://example.com/token, service=example.com`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "https://example.com/token", "service": "example.com"},
+		},
+		{
+			challenge: `Bearer realm="a \"quoted\" realm"`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": `a "quoted" realm`},
+		},
+		{
+			challenge: "Basic",
+			scheme:    "Basic",
+			params:    map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		scheme, params := parseChallenge(test.challenge)
+		if scheme != test.scheme || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s: expected %s %v, got %s %v", test.challenge, test.scheme, test.params, scheme, params)
+		}
+	}
+}
+
+// testRegistry serves a manifest for the repository "team/shell" at the tag "latest"
+type testRegistry struct {
+	manifest []byte
+	// headDigest and getDigest are returned in the Docker-Content-Digest header of HEAD and GET requests, if set
+	headDigest, getDigest string
+	// challenge is returned to requests without the authorization
+	challenge     string
+	authorization string
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if reg.challenge != "" && r.Header.Get("Authorization") != reg.authorization {
+		w.Header().Set("WWW-Authenticate", reg.challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/v2/team/shell/manifests/latest" {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+		http.Error(w, "unexpected Accept header", http.StatusBadRequest)
+		return
+	}
+	digest := reg.getDigest
+	if r.Method == http.MethodHead {
+		digest = reg.headDigest
+	}
+	if digest != "" {
+		w.Header().Set("Docker-Content-Digest", digest)
+	}
+	if r.Method == http.MethodGet {
+		w.Write(reg.manifest)
+	}
+}
+
+// resolve resolves team/shell:latest from a test registry over plain HTTP
+func resolve(t *testing.T, handler http.Handler, client *Client) (string, error) {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, err := ParseReference(host + "/team/shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Insecure = append(client.Insecure, host)
+	return client.Resolve(ref)
+}
+
+func TestResolve(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2}`)
+	sum := sha256.Sum256(manifest)
+	computed := "sha256:" + hex.EncodeToString(sum[:])
+	tests := []struct {
+		name     string
+		registry *testRegistry
+		expected string
+		invalid  bool
+	}{
+		{
+			name:     "digest in HEAD",
+			registry: &testRegistry{headDigest: testDigest},
+			expected: testDigest,
+		},
+		{
+			name:     "digest in GET",
+			registry: &testRegistry{getDigest: testDigest, manifest: manifest},
+			expected: testDigest,
+		},
+		{
+			name:     "computed digest",
+			registry: &testRegistry{manifest: manifest},
+			expected: computed,
+		},
+		{
+			name:     "manifest too large",
+			registry: &testRegistry{manifest: make([]byte, maxManifestSize+1)},
+			invalid:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			digest, err := resolve(t, test.registry, &Client{})
+			if (err != nil) != test.invalid {
+				t.Fatalf("expected invalid %t, got error %v", test.invalid, err)
+			}
+			if digest != test.expected {
+				t.Errorf("expected digest %q, got %q", test.expected, digest)
+			}
+		})
+	}
+}
+
+func TestResolveNotFound(t *testing.T) {
+	server := httptest.NewServer(&testRegistry{})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, err := ParseReference(host + "/team/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Client{Insecure: []string{host}}).Resolve(ref); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestResolveBasic(t *testing.T) {
+	reg := &testRegistry{
+		headDigest:    testDigest,
+		challenge:     `Basic realm="registry"`,
+		authorization: "Basic " + basicAuth(Credentials{Username: "user", Password: "secret"}),
+	}
+	if _, err := resolve(t, reg, &Client{}); err == nil || !strings.Contains(err.Error(), "requires credentials") {
+		t.Errorf("expected credentials to be required, got %v", err)
+	}
+
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, _ := ParseReference(host + "/team/shell")
+	client := &Client{
+		Insecure:    []string{host},
+		Credentials: map[string]Credentials{host: {Username: "user", Password: "secret"}},
+	}
+	if digest, err := client.Resolve(ref); err != nil || digest != testDigest {
+		t.Errorf("expected digest %s, got %q (%v)", testDigest, digest, err)
+	}
+}
+
+func TestResolveBearer(t *testing.T) {
+	var tokenRequests []string
+	mux := http.NewServeMux()
+	reg := &testRegistry{headDigest: testDigest, authorization: "Bearer pull-token"}
+	mux.Handle("/v2/", reg)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests = append(tokenRequests, r.URL.RawQuery)
+		if r.Header.Get("Authorization") != "Basic "+basicAuth(Credentials{Username: "user", Password: "secret"}) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "pull-token"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	reg.challenge = fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, server.URL)
+
+	ref, _ := ParseReference(host + "/team/shell")
+	client := &Client{
+		Insecure:    []string{host},
+		Credentials: map[string]Credentials{host: {Username: "user", Password: "secret"}},
+	}
+	digest, err := client.Resolve(ref)
+	if err != nil || digest != testDigest {
+		t.Fatalf("expected digest %s, got %q (%v)", testDigest, digest, err)
+	}
+	expected := "scope=repository%3Ateam%2Fshell%3Apull&service=test-registry"
+	if len(tokenRequests) == 0 || tokenRequests[0] != expected {
+		t.Errorf("expected token request %q, got %q", expected, tokenRequests)
+	}
+}
+
+func TestResolveRefusedHosts(t *testing.T) {
+	server := httptest.NewServer(&testRegistry{headDigest: testDigest})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, _ := ParseReference(host + "/team/shell")
+
+	// Registries that are not allowed are not contacted
+	_, err := (&Client{Registries: []string{"quay.io"}}).Resolve(ref)
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("expected the registry not to be allowed, got %v", err)
+	}
+	// Registries on loopback addresses must be internal
+	_, err = (&Client{}).Resolve(ref)
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the loopback address to be refused, got %v", err)
+	}
+
+	// Token services named by internal registries must be public too
+	port := host[strings.LastIndex(host, ":")+1:]
+	reg := &testRegistry{
+		headDigest:    testDigest,
+		challenge:     fmt.Sprintf(`Bearer realm="http://127.0.0.2:%s/token"`, port),
+		authorization: "Bearer token",
+	}
+	if _, err := resolve(t, reg, &Client{}); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the token service to be refused, got %v", err)
+	}
+}
+
+func TestAuthorizeRequiresHTTPSRealm(t *testing.T) {
+	ref := Reference{Registry: "registry.example.com", Repository: "team/shell"}
+	_, err := (&Client{}).authorize(`Bearer realm="http://auth.example.com/token"`, ref)
+	if err == nil || !strings.Contains(err.Error(), "not HTTPS") {
+		t.Errorf("expected a plain HTTP realm to be refused, got %v", err)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for address, public := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"127.0.0.1":       false,
+		"169.254.169.254": false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+	} {
+		ip := net.ParseIP(address)
+		if isPublic(ip) != public {
+			t.Errorf("expected isPublic(%s) to be %t", address, public)
+		}
+	}
+}
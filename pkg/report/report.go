@@ -0,0 +1,95 @@
+// Package report lists CloudShells with their usage and estimated cost, for charging back and finding abandoned shells
+package report
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/che-incubator/cloudshell-operator/pkg/apis/cloudshell/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Options configure a report
+type Options struct {
+	// Namespace limits the report to CloudShells in a namespace; empty means all namespaces
+	Namespace string
+	// CPUCost is the cost of one requested CPU core for an hour
+	CPUCost float64
+	// MemoryCost is the cost of one requested GiB of memory for an hour
+	MemoryCost float64
+}
+
+// Entry is the usage of a CloudShell
+type Entry struct {
+	Namespace string
+	Name      string
+	// Owner is the user who created the CloudShell, as recorded by the operator's owner webhook
+	Owner        string
+	Uptime       time.Duration
+	LastActivity *time.Time
+	// CPUHours and MemoryGiBHours are the resources reserved for the shell's pod multiplied by the time they were
+	// reserved for, summed over its runs
+	CPUHours       float64
+	MemoryGiBHours float64
+	Cost           float64
+}
+
+// Generate returns the usage of CloudShells, sorted by decreasing cost. Usage is computed from the requests the
+// operator records in each CloudShell's status for every run, so that changes to a shell's resources are only
+// charged from the run they apply to. Runs that ended before the operator recorded requests are not charged.
+func Generate(c client.Client, opts Options, now time.Time) ([]Entry, error) {
+	shells := &v1alpha1.CloudShellList{}
+	var listOpts []client.ListOption
+	if opts.Namespace != "" {
+		listOpts = append(listOpts, client.InNamespace(opts.Namespace))
+	}
+	if err := c.List(context.TODO(), shells, listOpts...); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, shell := range shells.Items {
+		usage := shell.Status.GetUsage(now)
+		entry := Entry{
+			Namespace:      shell.Namespace,
+			Name:           shell.Name,
+			Owner:          shell.Annotations[v1alpha1.OwnerAnnotation],
+			Uptime:         shell.Status.GetRunningTime(now),
+			CPUHours:       float64(usage.CPUMillicoreSeconds) / 1000 / 3600,
+			MemoryGiBHours: float64(usage.MemoryMiBSeconds) / 1024 / 3600,
+		}
+		if shell.Status.LastActivityTime != nil {
+			last := shell.Status.LastActivityTime.Time
+			entry.LastActivity = &last
+		}
+		entry.Cost = entry.CPUHours*opts.CPUCost + entry.MemoryGiBHours*opts.MemoryCost
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Cost > entries[j].Cost
+	})
+	return entries, nil
+}
+
+// Print writes entries as a table
+func Print(out io.Writer, entries []Entry, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tOWNER\tUPTIME\tLAST ACTIVITY\tCPU-HOURS\tMEMORY-GIB-HOURS\tCOST")
+	for _, entry := range entries {
+		owner := entry.Owner
+		if owner == "" {
+			owner = "<none>"
+		}
+		lastActivity := "<unknown>"
+		if entry.LastActivity != nil {
+			lastActivity = now.Sub(*entry.LastActivity).Truncate(time.Minute).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.2f\t%.2f\t%.2f\n", entry.Namespace, entry.Name, owner,
+			entry.Uptime.Truncate(time.Minute), lastActivity, entry.CPUHours, entry.MemoryGiBHours, entry.Cost)
+	}
+	return w.Flush()
+}